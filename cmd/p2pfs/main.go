@@ -2,73 +2,196 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/saurabhSPatel/p2p-file-sharing/config"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/chat"
 	"github.com/saurabhSPatel/p2p-file-sharing/internal/cli"
 	"github.com/saurabhSPatel/p2p-file-sharing/internal/discovery"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/feed"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/file"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/index"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/logging"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/metrics"
 	"github.com/saurabhSPatel/p2p-file-sharing/internal/network"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/outbox"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/syncer"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/tracing"
 )
 
 func main() {
+	configPath := flag.String("config", "", "path to a JSON config file")
+	flag.Parse()
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+
+	// Diagnostics go to stderr, leaving stdout to the CLI. Packages logging through
+	// the standard library's log package share the same handler.
+	logger, err := logging.New(os.Stderr, cfg.Log)
+	if err != nil {
+		log.Fatalf("Failed to setup logging: %v", err)
+	}
+	slog.SetDefault(logger)
+
 	ctx, cancel := context.WithCancel(context.Background())
 
 	defer cancel()
 
 	// Setup libp2p host
-	host, err := network.SetupHost(ctx)
+	host, err := network.SetupHost(ctx, cfg, logger)
 	if err != nil {
-		log.Fatalf("Failed to setup host: %v", err)
+		fatal("Failed to setup host", err)
 	}
 	defer func() {
 		if err := host.Close(); err != nil {
-			log.Printf("Error shutting down host: %v", err)
+			logger.Error("Error shutting down host", "error", err)
+		}
+	}()
+
+	// Export traces of discovery and transfers to the collector
+	shutdownTracing, err := tracing.Setup(ctx, cfg.Tracing, host.ID())
+	if err != nil {
+		fatal("Failed to setup tracing", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			logger.Error("Error flushing traces", "error", err)
 		}
 	}()
 
 	// Print the host's addresses
-	log.Println("Host ID:", host.ID())
-	log.Println("Host Addresses:")
-	for _, addr := range host.Addrs() {
-		log.Printf("  %s/p2p/%s\n", addr, host.ID())
+	fmt.Println("Host ID:", host.ID())
+	fmt.Println("Host Addresses:")
+	groups := network.AddrsByTransport(host.Addrs())
+	for _, name := range network.TransportNames(groups) {
+		fmt.Printf("  %s:\n", name)
+		for _, addr := range groups[name] {
+			fmt.Printf("    %s/p2p/%s\n", addr, host.ID())
+		}
+	}
+
+	if cfg.Metrics.Listen != "" {
+		addr, err := metrics.Serve(ctx, cfg.Metrics.Listen, logger)
+		if err != nil {
+			fatal("Failed to serve metrics", err)
+		}
+		logger.Info("Serving metrics", "url", fmt.Sprintf("http://%s/metrics", addr))
 	}
 
 	// Setup discovery service
-	disc := discovery.NewDiscovery(host)
+	disc := discovery.NewDiscovery(host, logger)
 	if err = disc.SetupDiscovery(); err != nil {
-		log.Fatalf("Failed to setup discovery: %v", err)
+		fatal("Failed to setup discovery", err)
 	}
+	defer func() {
+		if err := disc.Close(); err != nil {
+			logger.Error("Error shutting down discovery", "error", err)
+		}
+	}()
 
-	// Define and Ensure the directories exist
-	sharedDir := "./shared"
-	downloadDir := "./downloads"
+	// Ensure the directories exist
+	sharedDir := cfg.SharedDir
+	downloadDir := cfg.DownloadDir
 
 	if err := os.MkdirAll(sharedDir, os.ModePerm); err != nil {
-		log.Fatalf("Failed to create shared directory: %v", err)
+		fatal("Failed to create shared directory", err)
 	}
 	if err := os.MkdirAll(downloadDir, os.ModePerm); err != nil {
-		log.Fatalf("Failed to create download directory: %v", err)
+		fatal("Failed to create download directory", err)
+	}
+	if err := os.MkdirAll(cfg.DataDir, os.ModePerm); err != nil {
+		fatal("Failed to create data directory", err)
+	}
+
+	// Index the shared directory and keep it up to date
+	idx, err := index.NewIndex(sharedDir, cfg.DataDir, time.Duration(cfg.Index.Debounce), logger)
+	if err != nil {
+		fatal("Failed to load index", err)
+	}
+	defer idx.Close()
+	if err := idx.Start(ctx); err != nil {
+		fatal("Failed to index shared directory", err)
+	}
+	host.ServeIndex(idx)
+
+	// Setup folder sync and resume saved subscriptions
+	s, err := syncer.NewSyncer(ctx, host, idx, file.Policy(cfg.Receive), sharedDir, cfg.DataDir, time.Duration(cfg.Sync.Interval), logger)
+	if err != nil {
+		fatal("Failed to setup sync", err)
+	}
+	s.Start()
+
+	// Announce newly shared files and follow the announcements of other nodes
+	ps, err := pubsub.NewGossipSub(ctx, host)
+	if err != nil {
+		fatal("Failed to setup pubsub", err)
+	}
+	f, err := feed.NewFeed(ctx, host, ps, cfg.AnnounceTopic, logger)
+	if err != nil {
+		fatal("Failed to setup announcements", err)
 	}
+	for _, topic := range cfg.Topics {
+		if err := f.Subscribe(topic); err != nil {
+			fatal("Failed to follow topic", err, "topic", topic)
+		}
+	}
+	go f.AnnounceIndex(ctx, idx)
+
+	// Setup direct and group messaging
+	ch, err := chat.NewChat(ctx, host, ps, cfg.DataDir, logger)
+	if err != nil {
+		fatal("Failed to setup chat", err)
+	}
+	defer ch.Close()
+
+	// Deliver uploads queued for peers that were offline, resuming those of earlier runs
+	o, err := outbox.NewOutbox(ctx, host, cfg.DataDir, logger)
+	if err != nil {
+		fatal("Failed to setup outbox", err)
+	}
+	o.Start(disc.Events(ctx))
 
 	// Setup CLI
-	c := cli.NewCLI(host, disc, sharedDir, downloadDir, ctx)
+	c := cli.NewCLI(host, disc, idx, s, f, ch, o, sharedDir, downloadDir, file.Policy(cfg.Receive), time.Duration(cfg.Streams.TransferTimeout), os.Stdout, logger, ctx)
 
-	// Handle graceful shutdown
+	// Handle graceful shutdown. Ctrl-C during a download or upload only cancels it.
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
 
 	go func() {
-		<-sig
-		log.Println("Received interrupt signal, shutting down...")
-		cancel()
+		for s := range sig {
+			if s == syscall.SIGINT && c.Interrupt() {
+				logger.Info("Received interrupt signal, cancelling transfer")
+				continue
+			}
+			logger.Info("Received interrupt signal, shutting down")
+			cancel()
+			return
+		}
 	}()
 
 	// Run the CLI
 	fmt.Println("Starting CLI...")
 	c.Run()
 
-	log.Println("Shutdown complete")
+	logger.Info("Shutdown complete")
+}
+
+// fatal logs an error that prevents the node from starting and exits.
+func fatal(msg string, err error, args ...any) {
+	slog.Error(msg, append(args, "error", err)...)
+	os.Exit(1)
 }
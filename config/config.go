@@ -1 +1,417 @@
 package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the settings of a file-sharing node.
+type Config struct {
+	// SharedDir is the directory whose files are offered to peers.
+	SharedDir string `json:"shared_dir"`
+	// DownloadDir is the directory received files are written to.
+	DownloadDir string `json:"download_dir"`
+	// DataDir holds the node's local state, such as sync progress.
+	DataDir string `json:"data_dir"`
+	// IdentityKeyPath is the file holding the node's private key. An empty path
+	// generates a new identity on every start.
+	IdentityKeyPath string `json:"identity_key_path"`
+	// SwarmKeyPath is a swarm key file in the standard "/key/swarm/psk/1.0.0/" format.
+	// When set, the node only connects to peers holding the same key.
+	SwarmKeyPath string `json:"swarm_key_path"`
+	// AddressBook lists trusted peers as multiaddrs ending in /p2p/<peer-id>.
+	// They are dialed on startup and never pruned by the connection manager.
+	AddressBook []string `json:"address_book"`
+	// ConnManager configures connection limits.
+	ConnManager ConnManagerConfig `json:"conn_manager"`
+	// NAT configures NAT traversal and relaying.
+	NAT NATConfig `json:"nat"`
+	// Transports selects the transports and port the node listens on.
+	Transports TransportConfig `json:"transports"`
+	// Sync configures shared folder synchronization.
+	Sync SyncConfig `json:"sync"`
+	// Index configures the watcher that indexes the shared directory.
+	Index IndexConfig `json:"index"`
+	// Receive selects the file attributes restored on received files.
+	Receive ReceiveConfig `json:"receive"`
+	// Uploads controls which files peers may upload into the download directory.
+	Uploads UploadConfig `json:"uploads"`
+	// Downloads bounds the files fetched from peers.
+	Downloads DownloadConfig `json:"downloads"`
+	// Streams bounds how long transfer streams may take.
+	Streams StreamConfig `json:"streams"`
+	// Resources limits the streams, memory and file descriptors peers can use.
+	Resources ResourceConfig `json:"resources"`
+	// Metrics configures the Prometheus metrics endpoint.
+	Metrics MetricsConfig `json:"metrics"`
+	// Log configures the diagnostic log.
+	Log LogConfig `json:"log"`
+	// Tracing configures the export of OpenTelemetry traces.
+	Tracing TracingConfig `json:"tracing"`
+	// Compression is the algorithm files are compressed with on the wire: "zstd",
+	// "gzip" or "none". Peers that do not advertise compression support, and files
+	// that are already compressed, are always sent uncompressed.
+	Compression string `json:"compression"`
+	// Topics lists the team channels followed for file announcements, in addition
+	// to the channel every node follows.
+	Topics []string `json:"topics"`
+	// AnnounceTopic is the channel the node's new files are announced on. It is
+	// followed along with Topics.
+	AnnounceTopic string `json:"announce_topic"`
+}
+
+// ConnManagerConfig holds the connection manager watermarks.
+type ConnManagerConfig struct {
+	// LowWater is the number of connections the manager trims down to.
+	LowWater int `json:"low_water"`
+	// HighWater is the number of connections that triggers trimming.
+	HighWater int `json:"high_water"`
+	// GracePeriod protects new connections from being trimmed.
+	GracePeriod Duration `json:"grace_period"`
+}
+
+// NATConfig holds the NAT traversal settings.
+type NATConfig struct {
+	// PortMapping opens a port on the router with UPnP or NAT-PMP.
+	PortMapping bool `json:"port_mapping"`
+	// HolePunching upgrades relayed connections to direct ones with DCUtR.
+	HolePunching bool `json:"hole_punching"`
+	// AutoNATService helps other peers determine whether they are reachable.
+	AutoNATService bool `json:"autonat_service"`
+	// RelayService makes the node act as a circuit relay v2 server for other peers.
+	RelayService bool `json:"relay_service"`
+	// StaticRelays lists relays, as multiaddrs ending in /p2p/<peer-id>, to reserve
+	// a slot on when the node is not publicly reachable.
+	StaticRelays []string `json:"static_relays"`
+	// ForceReachability skips AutoNAT and assumes the node is "public" or "private".
+	ForceReachability string `json:"force_reachability"`
+}
+
+// TransportConfig selects the transports the node dials and listens on.
+type TransportConfig struct {
+	TCP          bool `json:"tcp"`
+	QUIC         bool `json:"quic"`
+	WebTransport bool `json:"webtransport"`
+	// IPv6 listens on IPv6 addresses in addition to IPv4.
+	IPv6 bool `json:"ipv6"`
+	// Port is the TCP and UDP port to listen on; 0 picks a random port.
+	Port int `json:"port"`
+}
+
+// SyncConfig holds the shared folder synchronization settings.
+type SyncConfig struct {
+	// Interval is the time between polls of a subscribed peer's shared folder.
+	Interval Duration `json:"interval"`
+}
+
+// IndexConfig holds the shared directory index settings.
+type IndexConfig struct {
+	// Debounce is how long the shared directory must stay unchanged before
+	// changes are indexed, so bursts of writes are handled at once.
+	Debounce Duration `json:"debounce"`
+}
+
+// ReceiveConfig is the policy for restoring the attributes a sender transfers
+// along with each file.
+type ReceiveConfig struct {
+	// Mode restores permission bits, such as the executable bit.
+	Mode bool `json:"mode"`
+	// ModTime restores modification times; otherwise received files get the current time.
+	ModTime bool `json:"mod_time"`
+	// Xattrs restores extended attributes.
+	Xattrs bool `json:"xattrs"`
+}
+
+// UploadConfig holds the settings for files and directories peers upload to the node.
+// Limits of 0 are unlimited.
+type UploadConfig struct {
+	// Allow lists the IDs of the peers allowed to upload. An empty list accepts
+	// uploads from every peer.
+	Allow []string `json:"allow"`
+	// MaxFileSize is the size of the largest file a peer may upload.
+	MaxFileSize Size `json:"max_file_size"`
+	// Quota caps the total size of the download directory.
+	Quota Size `json:"quota"`
+	// PeerQuota caps the size of the uploads each peer keeps in the download directory.
+	PeerQuota Size `json:"peer_quota"`
+	// MinFreeSpace is the disk space that must remain free after an upload.
+	MinFreeSpace Size `json:"min_free_space"`
+}
+
+// DownloadConfig holds the settings for files fetched from peers.
+type DownloadConfig struct {
+	// MaxFileSize is the size of the largest file fetched from a peer, so that a
+	// peer cannot exhaust the node's memory with a file that decompresses to more
+	// than it announced. 0 is unlimited.
+	MaxFileSize Size `json:"max_file_size"`
+}
+
+// Duration is a time.Duration that is encoded in JSON as a string such as "30s".
+type Duration time.Duration
+
+// MarshalJSON encodes the duration as a string.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON decodes a duration string such as "1m30s".
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string: %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration '%s': %w", s, err)
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// StreamConfig holds the timeouts of transfer streams. Timeouts of 0 are disabled.
+type StreamConfig struct {
+	// ReadTimeout is the longest a stream may spend receiving.
+	ReadTimeout Duration `json:"read_timeout"`
+	// WriteTimeout is the longest a stream may spend sending.
+	WriteTimeout Duration `json:"write_timeout"`
+	// IdleTimeout resets a stream when no data is sent or received for this long,
+	// so a stalled peer does not hold it open.
+	IdleTimeout Duration `json:"idle_timeout"`
+	// TransferTimeout caps a download, upload or message sent from the CLI, across
+	// all the peers it is tried with.
+	TransferTimeout Duration `json:"transfer_timeout"`
+}
+
+// ResourceConfig holds the limits of libp2p's resource manager. Limits of 0 keep
+// the defaults, which are scaled to the machine's memory and file descriptors.
+type ResourceConfig struct {
+	// System limits the whole node.
+	System ResourceLimits `json:"system"`
+	// Peer limits each peer.
+	Peer ResourceLimits `json:"peer"`
+	// Protocols limits the streams of all peers on a protocol, keyed by protocol ID.
+	Protocols map[string]ResourceLimits `json:"protocols"`
+	// ProtocolPeer limits the streams of each peer on a protocol, keyed by protocol ID.
+	ProtocolPeer map[string]ResourceLimits `json:"protocol_peer"`
+}
+
+// ResourceLimits caps the resources of a resource manager scope.
+type ResourceLimits struct {
+	// Streams is the number of open streams.
+	Streams int `json:"streams"`
+	// Memory is the memory reserved by streams, including received files that are
+	// being buffered.
+	Memory Size `json:"memory"`
+	// FDs is the number of file descriptors used by connections. It does not apply
+	// to protocols.
+	FDs int `json:"fds"`
+}
+
+// MetricsConfig holds the settings of the Prometheus metrics endpoint.
+type MetricsConfig struct {
+	// Listen is the address, such as "127.0.0.1:9464", serving the metrics at
+	// /metrics. An empty address disables the endpoint.
+	Listen string `json:"listen"`
+}
+
+// LogConfig holds the settings of the diagnostic log, which is written to stderr
+// separately from the CLI's output.
+type LogConfig struct {
+	// Level is the lowest level logged: "debug", "info", "warn" or "error".
+	Level string `json:"level"`
+	// Format is "text" for human-readable lines or "json" for log shipping.
+	Format string `json:"format"`
+}
+
+// TracingConfig holds the settings of the OpenTelemetry traces of discovery and
+// file transfers.
+type TracingConfig struct {
+	// Endpoint is the URL of the OTLP/HTTP collector receiving the traces, such as
+	// "http://localhost:4318". An empty endpoint disables tracing.
+	Endpoint string `json:"endpoint"`
+	// SampleRatio is the fraction of traces started by this node that are
+	// recorded. Traces started by peers follow the peer's decision.
+	SampleRatio float64 `json:"sample_ratio"`
+}
+
+// Size is a number of bytes that is encoded in JSON as a number, or as a string
+// such as "500MB" or "10GiB".
+type Size int64
+
+// sizeUnits maps the unit suffixes accepted by Size to their number of bytes.
+var sizeUnits = map[string]int64{
+	"":    1,
+	"B":   1,
+	"KB":  1000,
+	"MB":  1000 * 1000,
+	"GB":  1000 * 1000 * 1000,
+	"TB":  1000 * 1000 * 1000 * 1000,
+	"KiB": 1 << 10,
+	"MiB": 1 << 20,
+	"GiB": 1 << 30,
+	"TiB": 1 << 40,
+}
+
+// UnmarshalJSON decodes a number of bytes or a size string such as "1.5GB".
+func (s *Size) UnmarshalJSON(b []byte) error {
+	var n int64
+	if err := json.Unmarshal(b, &n); err == nil {
+		*s = Size(n)
+		return nil
+	}
+	var str string
+	if err := json.Unmarshal(b, &str); err != nil {
+		return fmt.Errorf("size must be a number or a string: %w", err)
+	}
+	num := strings.TrimRight(str, "BKMGTi")
+	unit, ok := sizeUnits[strings.TrimSpace(str[len(num):])]
+	v, err := strconv.ParseFloat(strings.TrimSpace(num), 64)
+	if !ok || err != nil {
+		return fmt.Errorf("invalid size '%s'", str)
+	}
+	*s = Size(v * float64(unit))
+	return nil
+}
+
+// Default returns the configuration used when no config file is given.
+func Default() Config {
+	return Config{
+		SharedDir:   "./shared",
+		DownloadDir: "./downloads",
+		DataDir:     "./data",
+		ConnManager: ConnManagerConfig{
+			LowWater:    100,
+			HighWater:   400,
+			GracePeriod: Duration(time.Minute),
+		},
+		NAT: NATConfig{
+			PortMapping:  true,
+			HolePunching: true,
+		},
+		Transports: TransportConfig{
+			TCP: true,
+		},
+		Sync: SyncConfig{
+			Interval: Duration(30 * time.Second),
+		},
+		Index: IndexConfig{
+			Debounce: Duration(500 * time.Millisecond),
+		},
+		Receive: ReceiveConfig{
+			Mode:    true,
+			ModTime: true,
+		},
+		Uploads: UploadConfig{
+			MinFreeSpace: 100 << 20,
+		},
+		Downloads: DownloadConfig{
+			MaxFileSize: 4 << 30,
+		},
+		Streams: StreamConfig{
+			IdleTimeout: Duration(time.Minute),
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "text",
+		},
+		Tracing: TracingConfig{
+			SampleRatio: 1,
+		},
+		Compression:   "zstd",
+		AnnounceTopic: "all",
+	}
+}
+
+// Load reads a JSON config file. Settings missing from the file keep their default values.
+func Load(path string) (Config, error) {
+	cfg := Default()
+	if path == "" {
+		return cfg, nil
+	}
+
+	data, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return Config{}, fmt.Errorf("error reading config file '%s': %w", path, err)
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return Config{}, fmt.Errorf("error parsing config file '%s': %w", path, err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return Config{}, fmt.Errorf("invalid config file '%s': %w", path, err)
+	}
+	return cfg, nil
+}
+
+// Validate checks the configuration for inconsistent settings.
+func (c Config) Validate() error {
+	if c.ConnManager.LowWater < 0 || c.ConnManager.HighWater < c.ConnManager.LowWater {
+		return fmt.Errorf("conn_manager: low_water (%d) must be between 0 and high_water (%d)",
+			c.ConnManager.LowWater, c.ConnManager.HighWater)
+	}
+	if !c.Transports.TCP && !c.Transports.QUIC && !c.Transports.WebTransport {
+		return fmt.Errorf("transports: at least one of tcp, quic and webtransport must be enabled")
+	}
+	if c.Transports.Port < 0 || c.Transports.Port > 65535 {
+		return fmt.Errorf("transports: port %d is out of range", c.Transports.Port)
+	}
+	if c.SwarmKeyPath != "" && (c.Transports.QUIC || c.Transports.WebTransport) {
+		return fmt.Errorf("swarm_key_path: private networks only support the tcp transport; disable quic and webtransport")
+	}
+	if c.Sync.Interval <= 0 {
+		return fmt.Errorf("sync: interval must be positive")
+	}
+	if c.Index.Debounce <= 0 {
+		return fmt.Errorf("index: debounce must be positive")
+	}
+	if c.Uploads.MaxFileSize < 0 || c.Uploads.Quota < 0 || c.Uploads.PeerQuota < 0 || c.Uploads.MinFreeSpace < 0 {
+		return fmt.Errorf("uploads: sizes must not be negative")
+	}
+	if c.Downloads.MaxFileSize < 0 {
+		return fmt.Errorf("downloads: max file size must not be negative")
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Log.Level)); err != nil {
+		return fmt.Errorf("log: unknown level '%s'", c.Log.Level)
+	}
+	if c.Log.Format != "text" && c.Log.Format != "json" {
+		return fmt.Errorf("log: format must be \"text\" or \"json\", not '%s'", c.Log.Format)
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		return fmt.Errorf("tracing: sample ratio must be between 0 and 1")
+	}
+	limits := []ResourceLimits{c.Resources.System, c.Resources.Peer}
+	for _, l := range c.Resources.Protocols {
+		limits = append(limits, l)
+	}
+	for _, l := range c.Resources.ProtocolPeer {
+		limits = append(limits, l)
+	}
+	for _, l := range limits {
+		if l.Streams < 0 || l.Memory < 0 || l.FDs < 0 {
+			return fmt.Errorf("resources: limits must not be negative")
+		}
+	}
+	if c.Streams.ReadTimeout < 0 || c.Streams.WriteTimeout < 0 || c.Streams.IdleTimeout < 0 || c.Streams.TransferTimeout < 0 {
+		return fmt.Errorf("streams: timeouts must not be negative")
+	}
+	switch c.Compression {
+	case "zstd", "gzip", "none":
+	default:
+		return fmt.Errorf("compression must be \"zstd\", \"gzip\" or \"none\", got %q", c.Compression)
+	}
+	if c.AnnounceTopic == "" {
+		return fmt.Errorf("announce_topic must not be empty")
+	}
+	switch c.NAT.ForceReachability {
+	case "", "public", "private":
+	default:
+		return fmt.Errorf("nat: force_reachability must be \"public\" or \"private\", got %q", c.NAT.ForceReachability)
+	}
+	return nil
+}
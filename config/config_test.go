@@ -0,0 +1,94 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write config: %v", err)
+		}
+		return path
+	}
+
+	withReceive := Default()
+	withReceive.Receive = ReceiveConfig{Xattrs: true}
+
+	withConnManager := Default()
+	withConnManager.ConnManager = ConnManagerConfig{LowWater: 5, HighWater: 10, GracePeriod: Duration(30 * time.Second)}
+
+	withUploads := Default()
+	withUploads.Uploads = UploadConfig{MaxFileSize: 1 << 30, Quota: 20_000_000_000, PeerQuota: 1536 << 20, MinFreeSpace: 4096}
+
+	withResources := Default()
+	withResources.Resources = ResourceConfig{
+		Peer:         ResourceLimits{Streams: 64, FDs: 8},
+		ProtocolPeer: map[string]ResourceLimits{"/p2p-file-sharing/3.0.0": {Streams: 4, Memory: 256 << 20}},
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		want    Config
+		wantErr bool
+	}{
+		{name: "no file", path: "", want: Default()},
+		{name: "empty object keeps defaults", path: write("empty.json", `{}`), want: Default()},
+		{
+			name: "overrides conn manager",
+			path: write("cm.json", `{"conn_manager": {"low_water": 5, "high_water": 10, "grace_period": "30s"}}`),
+			want: withConnManager,
+		},
+		{
+			name: "overrides receive policy",
+			path: write("recv.json", `{"receive": {"mode": false, "mod_time": false, "xattrs": true}}`),
+			want: withReceive,
+		},
+		{
+			name: "parses upload sizes",
+			path: write("up.json", `{"uploads": {"max_file_size": "1GiB", "quota": "20GB", "peer_quota": "1.5 GiB", "min_free_space": 4096}}`),
+			want: withUploads,
+		},
+		{
+			name: "parses resource limits",
+			path: write("rl.json", `{"resources": {"peer": {"streams": 64, "fds": 8}, "protocol_peer": {"/p2p-file-sharing/3.0.0": {"streams": 4, "memory": "256MiB"}}}}`),
+			want: withResources,
+		},
+		{name: "invalid size", path: write("size.json", `{"uploads": {"quota": "lots"}}`), wantErr: true},
+		{name: "negative resource limit", path: write("rlneg.json", `{"resources": {"protocols": {"/p2p-file-sharing/3.0.0": {"streams": -1}}}}`), wantErr: true},
+		{name: "unknown log level", path: write("ll.json", `{"log": {"level": "chatty"}}`), wantErr: true},
+		{name: "unknown log format", path: write("lf.json", `{"log": {"format": "xml"}}`), wantErr: true},
+		{name: "sample ratio out of range", path: write("trace.json", `{"tracing": {"sample_ratio": 1.5}}`), wantErr: true},
+		{name: "negative timeout", path: write("st.json", `{"streams": {"idle_timeout": "-1s"}}`), wantErr: true},
+		{name: "negative size", path: write("neg.json", `{"uploads": {"peer_quota": -1}}`), wantErr: true},
+		{name: "negative download size", path: write("dl.json", `{"downloads": {"max_file_size": -1}}`), wantErr: true},
+		{name: "missing file", path: filepath.Join(dir, "missing.json"), wantErr: true},
+		{name: "invalid duration", path: write("dur.json", `{"conn_manager": {"grace_period": "soon"}}`), wantErr: true},
+		{name: "unknown reachability", path: write("nat.json", `{"nat": {"force_reachability": "sometimes"}}`), wantErr: true},
+		{name: "no transports", path: write("tr.json", `{"transports": {"tcp": false, "quic": false}}`), wantErr: true},
+		{name: "port out of range", path: write("port.json", `{"transports": {"port": 70000}}`), wantErr: true},
+		{name: "swarm key with quic", path: write("psk.json", `{"swarm_key_path": "swarm.key", "transports": {"quic": true}}`), wantErr: true},
+		{name: "unknown compression", path: write("comp.json", `{"compression": "lz4"}`), wantErr: true},
+		{name: "zero debounce", path: write("idx.json", `{"index": {"debounce": "0s"}}`), wantErr: true},
+		{name: "inverted watermarks", path: write("wm.json", `{"conn_manager": {"low_water": 10, "high_water": 5}}`), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Load(tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Load() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Load() got = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,328 @@
+// Package chat exchanges text messages between peers: direct messages over a
+// stream protocol and group messages over GossipSub topics.
+package chat
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	corenet "github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/file"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/logging"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/network"
+)
+
+const (
+	// ProtocolID carries a single direct message per stream.
+	ProtocolID = "/p2p-file-sharing/chat/1.0.0"
+	// DefaultGroup is the group every node joins.
+	DefaultGroup = "all"
+	// topicPrefix keeps group topics apart from other uses of pubsub.
+	topicPrefix = "/p2p-file-sharing/chat/"
+	// historyFile is the file in the data directory holding the message history.
+	historyFile = "chat.jsonl"
+	// historySize is the number of messages kept in the history.
+	historySize = 1000
+	// maxMessageSize bounds the encoded size of a received message.
+	maxMessageSize = 64 << 10
+	// messageBufferSize is the capacity of each Messages channel.
+	messageBufferSize = 64
+)
+
+// Message is a direct message to a peer or a message to a group.
+type Message struct {
+	From peer.ID `json:"from"`
+	// To is the recipient of a direct message.
+	To peer.ID `json:"to,omitempty"`
+	// Group is the group of a group message.
+	Group string    `json:"group,omitempty"`
+	Text  string    `json:"text"`
+	Time  time.Time `json:"time"`
+}
+
+// Conversation names the conversation a message belongs to from self's point of
+// view: "#<group>" for group messages, or the other peer's ID.
+func (m Message) Conversation(self peer.ID) string {
+	if m.Group != "" {
+		return "#" + m.Group
+	}
+	if m.From == self {
+		return m.To.String()
+	}
+	return m.From.String()
+}
+
+// Chat sends and receives messages and keeps their history.
+type Chat struct {
+	host   *network.Node
+	ps     *pubsub.PubSub
+	ctx    context.Context
+	logger *slog.Logger
+
+	mu          sync.Mutex
+	groups      map[string]*pubsub.Topic
+	history     []Message
+	file        *os.File
+	subscribers map[chan Message]struct{}
+}
+
+// NewChat starts receiving direct messages and joins the default group. The history
+// is kept in dataDir.
+func NewChat(ctx context.Context, h *network.Node, ps *pubsub.PubSub, dataDir string, logger *slog.Logger) (*Chat, error) {
+	path := filepath.Join(dataDir, historyFile)
+	history, err := loadHistory(path)
+	if err != nil {
+		return nil, err
+	}
+	// The history file is compacted to the kept messages on every start.
+	var compacted []byte
+	for _, m := range history {
+		line, err := json.Marshal(m)
+		if err != nil {
+			return nil, fmt.Errorf("error encoding chat history: %w", err)
+		}
+		compacted = append(append(compacted, line...), '\n')
+	}
+	if err := file.WriteFileAtomic(path, compacted, time.Time{}); err != nil {
+		return nil, fmt.Errorf("error saving chat history '%s': %w", path, err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("error opening chat history '%s': %w", path, err)
+	}
+
+	c := &Chat{
+		host:        h,
+		ps:          ps,
+		ctx:         ctx,
+		logger:      logger,
+		groups:      make(map[string]*pubsub.Topic),
+		history:     history,
+		file:        f,
+		subscribers: make(map[chan Message]struct{}),
+	}
+	if err := c.Join(DefaultGroup); err != nil {
+		f.Close()
+		return nil, err
+	}
+	h.SetStreamHandler(ProtocolID, h.WithTimeouts(c.handleStream))
+	return c, nil
+}
+
+// Close stops receiving direct messages and closes the history.
+func (c *Chat) Close() error {
+	c.host.RemoveStreamHandler(ProtocolID)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.file.Close()
+}
+
+// Join starts receiving the messages of a group.
+func (c *Chat) Join(group string) error {
+	if group == "" {
+		return fmt.Errorf("group name must not be empty")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.groups[group]; ok {
+		return nil
+	}
+	topic, err := c.ps.Join(topicPrefix + group)
+	if err != nil {
+		return fmt.Errorf("error joining group '%s': %w", group, err)
+	}
+	sub, err := topic.Subscribe()
+	if err != nil {
+		topic.Close()
+		return fmt.Errorf("error joining group '%s': %w", group, err)
+	}
+	c.groups[group] = topic
+	go c.readGroup(group, sub)
+	return nil
+}
+
+// Send delivers a direct message to a peer.
+func (c *Chat) Send(ctx context.Context, p peer.ID, text string) error {
+	m := Message{From: c.host.ID(), To: p, Text: text, Time: time.Now()}
+	stream, err := c.host.NewStream(ctx, p, ProtocolID)
+	if err != nil {
+		return fmt.Errorf("error creating new stream: %w", err)
+	}
+	defer stream.Close()
+
+	if err := json.NewEncoder(stream).Encode(m); err != nil {
+		_ = stream.Reset()
+		return fmt.Errorf("error sending message: %w", err)
+	}
+	c.record(m, false)
+	return nil
+}
+
+// SendGroup posts a message to a group, joining it first if needed.
+func (c *Chat) SendGroup(ctx context.Context, group string, text string) error {
+	if err := c.Join(group); err != nil {
+		return err
+	}
+	m := Message{From: c.host.ID(), Group: group, Text: text, Time: time.Now()}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("error encoding message: %w", err)
+	}
+
+	c.mu.Lock()
+	topic := c.groups[group]
+	c.mu.Unlock()
+	if err := topic.Publish(ctx, data); err != nil {
+		return fmt.Errorf("error sending message to group '%s': %w", group, err)
+	}
+	c.record(m, false)
+	return nil
+}
+
+// Messages returns a channel of the messages received from other peers. The
+// channel is closed when ctx is done.
+func (c *Chat) Messages(ctx context.Context) <-chan Message {
+	ch := make(chan Message, messageBufferSize)
+
+	c.mu.Lock()
+	c.subscribers[ch] = struct{}{}
+	c.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		c.mu.Lock()
+		delete(c.subscribers, ch)
+		close(ch)
+		c.mu.Unlock()
+	}()
+
+	return ch
+}
+
+// History returns the sent and received messages of a conversation, as named by
+// Message.Conversation, oldest first. An empty conversation returns all messages.
+func (c *Chat) History(conversation string) []Message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var out []Message
+	for _, m := range c.history {
+		if conversation == "" || m.Conversation(c.host.ID()) == conversation {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// handleStream receives a direct message.
+func (c *Chat) handleStream(stream corenet.Stream) {
+	defer stream.Close()
+	remote := stream.Conn().RemotePeer()
+
+	var m Message
+	if err := json.NewDecoder(io.LimitReader(stream, maxMessageSize)).Decode(&m); err != nil {
+		c.logger.Warn("Error reading message", logging.Peer(remote), "error", err)
+		_ = stream.Reset()
+		return
+	}
+	// The sender is known from the connection, whatever the message claims.
+	m.From, m.To, m.Group = remote, c.host.ID(), ""
+	c.record(m, true)
+}
+
+// readGroup receives the messages of a group until ctx is done.
+func (c *Chat) readGroup(group string, sub *pubsub.Subscription) {
+	for {
+		msg, err := sub.Next(c.ctx)
+		if err != nil {
+			return
+		}
+		if msg.GetFrom() == c.host.ID() || len(msg.Data) > maxMessageSize {
+			continue
+		}
+		var m Message
+		if err := json.Unmarshal(msg.Data, &m); err != nil {
+			c.logger.Warn("Ignoring invalid message", logging.Peer(msg.GetFrom()), "group", group, "error", err)
+			continue
+		}
+		// Messages are signed by their author.
+		m.From, m.To, m.Group = msg.GetFrom(), "", group
+		c.record(m, true)
+	}
+}
+
+// record adds a message to the history and, if it was received, sends it to every
+// subscriber that keeps up.
+func (c *Chat) record(m Message, received bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.history = append(c.history, m)
+	if len(c.history) > historySize {
+		c.history = c.history[len(c.history)-historySize:]
+	}
+	if line, err := json.Marshal(m); err == nil {
+		if _, err := c.file.Write(append(line, '\n')); err != nil {
+			c.logger.Error("Error saving chat history", "error", err)
+		}
+	}
+	if !received {
+		return
+	}
+	for ch := range c.subscribers {
+		select {
+		case ch <- m:
+		default:
+			c.logger.Warn("Dropping message: subscriber is not keeping up", logging.Peer(m.From))
+		}
+	}
+}
+
+// loadHistory reads the most recent messages of a history file.
+func loadHistory(path string) ([]Message, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening chat history '%s': %w", path, err)
+	}
+	defer f.Close()
+
+	var history []Message
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64<<10), 2*maxMessageSize)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var m Message
+		if err := json.Unmarshal([]byte(line), &m); err != nil {
+			// A line cut short by a crash is skipped.
+			continue
+		}
+		history = append(history, m)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading chat history '%s': %w", path, err)
+	}
+	if len(history) > historySize {
+		history = history[len(history)-historySize:]
+	}
+	return history, nil
+}
@@ -0,0 +1,101 @@
+package chat
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/saurabhSPatel/p2p-file-sharing/config"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/logging"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/network"
+)
+
+// newTestChat creates a host and a chat on its own GossipSub router.
+func newTestChat(t *testing.T, ctx context.Context, dataDir string) (host.Host, *Chat) {
+	t.Helper()
+	cfg := config.Default()
+	cfg.SharedDir = t.TempDir()
+	h, err := network.SetupHost(ctx, cfg, logging.Discard())
+	if err != nil {
+		t.Fatalf("Failed to setup host: %v", err)
+	}
+	t.Cleanup(func() { h.Close() })
+	ps, err := pubsub.NewGossipSub(ctx, h)
+	if err != nil {
+		t.Fatalf("Failed to setup pubsub: %v", err)
+	}
+	c, err := NewChat(ctx, h, ps, dataDir, logging.Discard())
+	if err != nil {
+		t.Fatalf("NewChat() error = %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return h, c
+}
+
+func TestChat(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	dataDir := t.TempDir()
+	h1, c1 := newTestChat(t, ctx, dataDir)
+	h2, c2 := newTestChat(t, ctx, t.TempDir())
+	if err := h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}); err != nil {
+		t.Fatalf("Failed to connect hosts: %v", err)
+	}
+	messages := c2.Messages(ctx)
+
+	if err := c1.Send(ctx, h2.ID(), "sending you report.pdf"); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	select {
+	case m := <-messages:
+		if m.From != h1.ID() || m.Text != "sending you report.pdf" || m.Conversation(h2.ID()) != h1.ID().String() {
+			t.Errorf("received %+v, want the direct message from %s", m, h1.ID())
+		}
+	case <-ctx.Done():
+		t.Fatalf("Timed out waiting for the direct message")
+	}
+
+	// Group messages only reach a peer once the pubsub streams to it are open, so
+	// the message is sent until it arrives.
+	if err := c2.Join("team"); err != nil {
+		t.Fatalf("Join() error = %v", err)
+	}
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for received := false; !received; {
+		if err := c1.SendGroup(ctx, "team", "hello team"); err != nil {
+			t.Fatalf("SendGroup() error = %v", err)
+		}
+		select {
+		case m := <-messages:
+			if m.From != h1.ID() || m.Group != "team" || m.Text != "hello team" {
+				t.Fatalf("received %+v, want the group message", m)
+			}
+			received = true
+		case <-ticker.C:
+		case <-ctx.Done():
+			t.Fatalf("Timed out waiting for the group message")
+		}
+	}
+
+	if got := c2.History(h1.ID().String()); len(got) != 1 || got[0].Text != "sending you report.pdf" {
+		t.Errorf("History() of the direct conversation = %+v", got)
+	}
+	if got := c2.History("#team"); len(got) == 0 || got[0].Text != "hello team" {
+		t.Errorf("History() of the group = %+v", got)
+	}
+
+	// The sender's history is reloaded on restart.
+	sent := len(c1.History(""))
+	if err := c1.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	_, reloaded := newTestChat(t, ctx, dataDir)
+	if got := reloaded.History(""); len(got) != sent || got[0].To != h2.ID() {
+		t.Errorf("History() after restart = %+v, want the %d sent messages", got, sent)
+	}
+}
@@ -3,44 +3,126 @@ package cli
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
 
-	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/chat"
 	"github.com/saurabhSPatel/p2p-file-sharing/internal/discovery"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/feed"
 	"github.com/saurabhSPatel/p2p-file-sharing/internal/file"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/index"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/logging"
 	"github.com/saurabhSPatel/p2p-file-sharing/internal/network"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/outbox"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/seal"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/syncer"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// commands lists the commands understood by the CLI.
+const commands = "list, search, duplicates, peers, status, sync, unsync, download, upload, outbox, encrypt, decrypt, feed, subscribe, unsubscribe, msg, history, exit"
+
 // CLI represents the command-line interface for file sharing.
 type CLI struct {
-	host        host.Host
+	host        *network.Node
 	discovery   *discovery.Discovery
+	index       *index.Index
+	syncer      *syncer.Syncer
+	feed        *feed.Feed
+	chat        *chat.Chat
+	outbox      *outbox.Outbox
 	sharedDir   string
 	downloadDir string
+	policy      file.Policy
+	timeout     time.Duration
+	out         io.Writer
+	logger      *slog.Logger
 	ctx         context.Context
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
 }
 
 // NewCLI initializes a new CLI instance.
-func NewCLI(h host.Host, d *discovery.Discovery, sharedDir string, downloadDir string, ctx context.Context) *CLI {
-	return &CLI{host: h, discovery: d, sharedDir: sharedDir, downloadDir: downloadDir, ctx: ctx}
+// The policy selects the attributes restored on downloaded files, and each download
+// or upload is cancelled after timeout unless it is 0. Command output is written to
+// out, while diagnostics go to logger.
+func NewCLI(h *network.Node, d *discovery.Discovery, idx *index.Index, s *syncer.Syncer, f *feed.Feed, ch *chat.Chat, o *outbox.Outbox, sharedDir string, downloadDir string, policy file.Policy, timeout time.Duration, out io.Writer, logger *slog.Logger, ctx context.Context) *CLI {
+	return &CLI{host: h, discovery: d, index: idx, syncer: s, feed: f, chat: ch, outbox: o, sharedDir: sharedDir, downloadDir: downloadDir, policy: policy, timeout: timeout, out: out, logger: logger, ctx: ctx}
+}
+
+// Interrupt cancels the running download or upload, reporting whether there was one.
+func (c *CLI) Interrupt() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cancel == nil {
+		return false
+	}
+	c.cancel()
+	return true
+}
+
+// transfer derives the context of a download or upload, which ends with the node,
+// after the transfer timeout, or when the transfer is interrupted. The returned
+// function must be called once the transfer is over.
+func (c *CLI) transfer() (context.Context, context.CancelFunc) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if c.timeout > 0 {
+		ctx, cancel = context.WithTimeout(c.ctx, c.timeout)
+	} else {
+		ctx, cancel = context.WithCancel(c.ctx)
+	}
+	c.mu.Lock()
+	c.cancel = cancel
+	c.mu.Unlock()
+	return ctx, func() {
+		c.mu.Lock()
+		c.cancel = nil
+		c.mu.Unlock()
+		cancel()
+	}
+}
+
+// reportCancel tells the user why a transfer stopped early, if it did.
+func (c *CLI) reportCancel(ctx context.Context) {
+	switch {
+	case c.ctx.Err() != nil:
+		// The node is shutting down.
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		c.printf("Transfer timed out after %s\n", c.timeout)
+	case ctx.Err() != nil:
+		c.println("Transfer cancelled")
+	}
 }
 
 // Run starts the CLI to listen for user commands.
 func (c *CLI) Run() {
 	reader := bufio.NewReader(os.Stdin)
-	fmt.Println("Welcome to the P2P File Sharing CLI!")
-	fmt.Println("Available commands: list, download, upload, quit")
+	c.println("Welcome to the P2P File Sharing CLI!")
+	c.println("Available commands:", commands)
+	go c.showNewFiles()
+	go c.showMessages()
 	for {
 		select {
 		case <-c.ctx.Done():
-			log.Println("Shutting down CLI...")
+			c.logger.Info("Shutting down CLI")
 			return
 		default:
-			fmt.Print("> ")
+			fmt.Fprint(c.out, "> ")
 			input, _ := reader.ReadString('\n')
 			input = strings.TrimSpace(input)
 			parts := strings.Fields(input)
@@ -52,22 +134,95 @@ func (c *CLI) Run() {
 			switch parts[0] {
 			case "list":
 				c.listFiles()
+			case "search":
+				if len(parts) < 2 {
+					c.println("Usage: search <query>")
+					continue
+				}
+				c.searchFiles(parts[1])
+			case "duplicates":
+				c.listDuplicates()
+			case "peers":
+				c.listPeers()
+			case "status":
+				c.showStatus()
+			case "sync":
+				if len(parts) == 1 {
+					c.listSyncs()
+					continue
+				}
+				if len(parts) < 3 {
+					c.println("Usage: sync [<peer-id> <mirror|two-way>]")
+					continue
+				}
+				c.startSync(parts[1], parts[2])
+			case "unsync":
+				if len(parts) < 2 {
+					c.println("Usage: unsync <peer-id>")
+					continue
+				}
+				c.stopSync(parts[1])
 			case "download":
 				if len(parts) < 2 {
-					log.Println("Usage: download <filename>")
+					c.println("Usage: download <filename>")
 					continue
 				}
 				c.downloadFile(parts[1])
 			case "upload":
 				if len(parts) < 2 {
-					log.Println("Usage: upload <filename>")
+					c.println("Usage: upload <filename> [<peer-id>]")
+					continue
+				}
+				if len(parts) > 2 {
+					c.queueUpload(parts[1], parts[2])
 					continue
 				}
 				c.uploadFile(parts[1])
+			case "outbox":
+				c.listOutbox()
+			case "encrypt":
+				if len(parts) < 3 {
+					c.println("Usage: encrypt <path> <peer-id>...")
+					continue
+				}
+				c.encryptFile(parts[1], parts[2:])
+			case "decrypt":
+				if len(parts) < 2 {
+					c.println("Usage: decrypt <filename>" + seal.Extension)
+					continue
+				}
+				c.decryptFile(parts[1])
+			case "feed":
+				c.listAnnouncements()
+			case "subscribe":
+				if len(parts) < 2 {
+					c.println("Subscribed topics:", strings.Join(c.feed.Topics(), ", "))
+					c.println("Announcing on:", c.feed.AnnounceTopic())
+					continue
+				}
+				c.subscribe(parts[1])
+			case "unsubscribe":
+				if len(parts) < 2 {
+					c.println("Usage: unsubscribe <topic>")
+					continue
+				}
+				c.unsubscribe(parts[1])
+			case "msg":
+				if len(parts) < 3 {
+					c.println("Usage: msg <peer-id|#group> <text>")
+					continue
+				}
+				c.sendMessage(parts[1], strings.Join(parts[2:], " "))
+			case "history":
+				conversation := ""
+				if len(parts) > 1 {
+					conversation = parts[1]
+				}
+				c.showHistory(conversation)
 			case "exit":
 				return
 			default:
-				log.Println("Unknown command. Available commands: list, download, upload, exit")
+				c.println("Unknown command. Available commands:", commands)
 			}
 		}
 	}
@@ -75,98 +230,567 @@ func (c *CLI) Run() {
 
 // listFiles displays all files available in the shared directory.
 func (c *CLI) listFiles() {
-	files, err := file.ListFiles(c.sharedDir)
-	if err != nil {
-		log.Printf("Error listing files in directory '%s': %v\n", c.sharedDir, err)
+	files := c.index.Entries()
+	if len(files) == 0 {
+		c.println("No files available.")
 		return
 	}
+	c.println("Available files:")
+	for _, f := range files {
+		c.printf("%s  %d bytes\n", f.Path, f.Size)
+	}
+}
+
+// searchFiles displays the shared files whose path contains the query.
+func (c *CLI) searchFiles(query string) {
+	files := c.index.Search(query)
 	if len(files) == 0 {
-		log.Println("No files available.")
+		c.printf("No files matching '%s'.\n", query)
 		return
 	}
-	log.Println("Available files:")
+	c.println("Matching files:")
 	for _, f := range files {
-		log.Println(f)
+		c.printf("%s  %d bytes\n", f.Path, f.Size)
+	}
+}
+
+// listDuplicates displays the shared files that have identical content.
+func (c *CLI) listDuplicates() {
+	groups := c.index.Duplicates()
+	if len(groups) == 0 {
+		c.println("No duplicate files.")
+		return
+	}
+	for _, group := range groups {
+		c.printf("%d copies of %d bytes:\n", len(group), group[0].Size)
+		for _, f := range group {
+			c.printf("  %s\n", f.Path)
+		}
+	}
+}
+
+// listPeers displays the connected peers with their latency and transfer statistics.
+func (c *CLI) listPeers() {
+	peers := network.RankPeers(c.host, c.discovery.Peers())
+	if len(peers) == 0 {
+		c.println("No peers connected.")
+		return
+	}
+	c.println("Connected peers:")
+	for _, pi := range peers {
+		stats := network.Stats(c.host, pi.ID)
+		c.printf("%s  rtt=%s  throughput=%.1f KiB/s  transfers=%d ok/%d failed  bytes=%d (%d on the wire)  score=%d\n",
+			pi.ID, stats.Latency.Round(time.Millisecond), stats.Throughput/1024,
+			stats.Successes, stats.Failures, stats.LogicalBytes, stats.WireBytes, stats.Score())
+	}
+}
+
+// showStatus displays the node's reachability and the addresses peers can dial.
+func (c *CLI) showStatus() {
+	c.println("Peer ID:", c.host.ID())
+	c.println("Reachability:", network.Reachability(c.host))
+	if fingerprint, ok := c.host.PrivateNetwork(); ok {
+		c.println("Private network, swarm key fingerprint:", fingerprint)
+	}
+	c.println("Listen addresses:")
+	groups := network.AddrsByTransport(c.host.Addrs())
+	for _, name := range network.TransportNames(groups) {
+		c.printf("  %s:\n", name)
+		for _, addr := range groups[name] {
+			c.printf("    %s/p2p/%s\n", addr, c.host.ID())
+		}
+	}
+	if rejections := c.host.ResourceRejections(); len(rejections) > 0 {
+		c.println("Resource limit rejections:")
+		reasons := make([]string, 0, len(rejections))
+		for reason := range rejections {
+			reasons = append(reasons, string(reason))
+		}
+		sort.Strings(reasons)
+		for _, reason := range reasons {
+			c.printf("  %s: %d\n", reason, rejections[network.ResourceRejection(reason)])
+		}
+	}
+	relayAddrs := network.RelayAddrs(c.host)
+	if len(relayAddrs) == 0 {
+		c.println("No relay reservations.")
+		return
+	}
+	c.println("Relay addresses:")
+	for _, addr := range relayAddrs {
+		c.println(" ", addr)
+	}
+}
+
+// listSyncs displays the peers whose shared folders are synced.
+func (c *CLI) listSyncs() {
+	subs := c.syncer.Subscriptions()
+	if len(subs) == 0 {
+		c.println("Not syncing with any peer.")
+		return
+	}
+	c.println("Syncing with:")
+	for p, mode := range subs {
+		c.printf("%s  %s\n", p, mode)
 	}
 }
 
+// startSync subscribes to a peer's shared folder.
+func (c *CLI) startSync(peerID string, modeName string) {
+	p, err := peer.Decode(peerID)
+	if err != nil {
+		c.printf("Invalid peer ID '%s': %v\n", peerID, err)
+		return
+	}
+	mode, err := syncer.ParseMode(modeName)
+	if err != nil {
+		c.println(err)
+		return
+	}
+	if err := c.syncer.Subscribe(p, mode); err != nil {
+		c.printf("Error starting sync with peer %s: %v\n", p, err)
+		return
+	}
+	c.printf("Started %s sync with peer %s\n", mode, p)
+}
+
+// stopSync unsubscribes from a peer's shared folder.
+func (c *CLI) stopSync(peerID string) {
+	p, err := peer.Decode(peerID)
+	if err != nil {
+		c.printf("Invalid peer ID '%s': %v\n", peerID, err)
+		return
+	}
+	if err := c.syncer.Unsubscribe(p); err != nil {
+		c.printf("Error stopping sync with peer %s: %v\n", p, err)
+		return
+	}
+	c.printf("Stopped sync with peer %s\n", p)
+}
+
 // downloadFile retrieves a file from a peer and saves it to the download directory.
 func (c *CLI) downloadFile(filename string) {
-	ctx, cancel := context.WithTimeout(c.ctx, 30*time.Second)
+	ctx, cancel := c.transfer()
 	defer cancel()
+	ctx, span := tracing.Start(ctx, "cli.download", trace.WithAttributes(tracing.File(filename)))
+	defer span.End()
 
-	peerChan, err := c.discovery.DiscoverPeers(ctx)
-	if err != nil {
-		log.Printf("Error discovering peers: %v\n", err)
+	peers := c.rankedPeers(ctx)
+	if len(peers) == 0 {
+		c.println("No peers supporting the file-sharing protocol are connected")
 		return
 	}
 
-	for peer := range peerChan {
-		stream, err := c.host.NewStream(context.Background(), peer.ID)
+	// An existing download is updated by fetching only the blocks that changed.
+	savePath := c.downloadDir + "/" + filename
+	for _, peer := range peers {
+		start := time.Now()
+		stats, err := c.host.FetchFileDelta(ctx, peer.ID, filename, savePath, c.policy)
+		if errors.Is(err, network.ErrFileUnavailable) {
+			// The name may refer to a directory instead.
+			if c.downloadTree(ctx, peer.ID, filename) {
+				return
+			}
+		} else {
+			c.host.RecordTransfer(peer.ID, network.Received, stats.Matched+stats.Literal, time.Since(start), err)
+		}
 		if err != nil {
-			log.Printf("Error creating stream with peer %s: %v\n", peer.ID, err)
+			c.logger.Warn("Error downloading file", logging.Peer(peer.ID), "name", filename, "error", err)
+			if ctx.Err() != nil {
+				c.reportCancel(ctx)
+				return
+			}
 			continue
 		}
 
-		if _, err := stream.Write([]byte(filename + "\n")); err != nil {
-			log.Printf("Error requesting file: %v\n", err)
-			continue
+		c.printf("File %s downloaded successfully to %s: %d bytes reused, %d bytes fetched\n",
+			filename, savePath, stats.Matched, stats.Literal)
+		return
+	}
+
+	c.println("File not found on any peer")
+}
+
+// rankedPeers returns the connected peers supporting the file-sharing protocol,
+// most preferred first.
+func (c *CLI) rankedPeers(ctx context.Context) []peer.AddrInfo {
+	_, span := tracing.Start(ctx, "discovery.rank_peers")
+	defer span.End()
+
+	peers := network.RankPeers(c.host, c.discovery.CompatiblePeers())
+	span.SetAttributes(attribute.Int("p2pfs.peers", len(peers)))
+	return peers
+}
+
+// downloadTree retrieves a directory tree from a peer, reporting whether the peer had it.
+func (c *CLI) downloadTree(ctx context.Context, p peer.ID, name string) bool {
+	start := time.Now()
+	stats, err := c.host.FetchTree(ctx, p, name, c.downloadDir, c.policy)
+	if errors.Is(err, network.ErrFileUnavailable) {
+		return false
+	}
+	c.host.RecordTransfer(p, network.Received, stats.Bytes, time.Since(start), err)
+	if err != nil {
+		c.logger.Warn("Error downloading directory", logging.Peer(p), "name", name, "error", err)
+		if ctx.Err() != nil {
+			c.reportCancel(ctx)
+			return true
 		}
+		return false
+	}
+	c.printf("Directory %s downloaded successfully to %s: %d files, %d directories, %d bytes\n",
+		name, filepath.Join(c.downloadDir, name), stats.Files, stats.Dirs, stats.Bytes)
+	return true
+}
+
+// uploadFile sends a file, or a whole directory tree, to a discovered peer.
+func (c *CLI) uploadFile(filename string) {
+	ctx, cancel := c.transfer()
+	defer cancel()
+	ctx, span := tracing.Start(ctx, "cli.upload", trace.WithAttributes(tracing.File(filename)))
+	defer span.End()
+
+	filePath := c.sharedDir + "/" + filename
+	if info, err := os.Stat(filePath); err == nil && info.IsDir() {
+		c.uploadDir(ctx, filename, filePath)
+		return
+	}
+	data, err := file.ReadFile(filePath)
+	if err != nil {
+		c.printf("Error reading file '%s': %v\n", filePath, err)
+		return
+	}
+	md, err := file.ReadMetadata(filePath)
+	if err != nil {
+		c.printf("Error reading attributes of '%s': %v\n", filePath, err)
+		return
+	}
+
+	peers := c.rankedPeers(ctx)
+	if len(peers) == 0 {
+		c.println("No peers available to upload the file")
+		return
+	}
 
-		receivedFilename, data, err := network.ReceiveFile(stream)
+	for _, peer := range peers {
+		stats, err := c.host.SendFileDelta(ctx, peer.ID, filename, data, md)
 		if err != nil {
-			log.Printf("Error receiving file: %v\n", err)
+			c.logger.Warn("Error sending file", logging.Peer(peer.ID), "name", filename, "error", err)
+			if ctx.Err() != nil {
+				c.reportCancel(ctx)
+				return
+			}
 			continue
 		}
+		c.printf("File %s uploaded successfully to peer %s: %d bytes reused, %d bytes sent\n",
+			filename, peer.ID, stats.Matched, stats.Literal)
+		return
+	}
 
-		if err := stream.Close(); err != nil {
-			log.Printf("Error closing stream: %v\n", err)
-		}
+	c.println("No peers available to upload the file")
+}
 
-		if receivedFilename != filename {
-			log.Printf("Received unexpected file: %s\n", receivedFilename)
-			continue
-		}
+// uploadDir sends a directory tree to a discovered peer as a single transfer.
+func (c *CLI) uploadDir(ctx context.Context, name string, dir string) {
+	peers := c.rankedPeers(ctx)
+	if len(peers) == 0 {
+		c.println("No peers available to upload the directory")
+		return
+	}
 
-		savePath := c.downloadDir + "/" + filename
-		if err := file.WriteFile(savePath, data); err != nil {
-			log.Printf("Error saving file to '%s': %v\n", savePath, err)
+	// Uploads land in the peer's download directory under the directory's own name.
+	name = filepath.Base(filepath.Clean(name))
+	for _, peer := range peers {
+		stats, err := c.host.SendTree(ctx, peer.ID, name, dir)
+		if err != nil {
+			c.logger.Warn("Error sending directory", logging.Peer(peer.ID), "name", name, "error", err)
+			if ctx.Err() != nil {
+				c.reportCancel(ctx)
+				return
+			}
 			continue
 		}
-
-		log.Printf("File %s downloaded successfully to %s\n", filename, savePath)
+		c.printf("Directory %s uploaded successfully to peer %s: %d files, %d directories, %d bytes\n",
+			name, peer.ID, stats.Files, stats.Dirs, stats.Bytes)
 		return
 	}
 
-	log.Println("File not found on any peer")
+	c.println("No peers available to upload the directory")
 }
 
-// uploadFile sends a file to a discovered peer.
-func (c *CLI) uploadFile(filename string) {
+// queueUpload queues a file for a peer in the outbox, which delivers it as soon as
+// the peer is reachable, including after a restart.
+func (c *CLI) queueUpload(filename string, peerID string) {
+	p, err := peer.Decode(peerID)
+	if err != nil {
+		c.printf("Invalid peer ID '%s': %v\n", peerID, err)
+		return
+	}
 	filePath := c.sharedDir + "/" + filename
+	if info, err := os.Stat(filePath); err == nil && info.IsDir() {
+		c.println("Only files can be queued for a peer")
+		return
+	}
 	data, err := file.ReadFile(filePath)
 	if err != nil {
-		log.Printf("Error reading file '%s': %v\n", filePath, err)
+		c.printf("Error reading file '%s': %v\n", filePath, err)
+		return
+	}
+	md, err := file.ReadMetadata(filePath)
+	if err != nil {
+		c.printf("Error reading attributes of '%s': %v\n", filePath, err)
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
+	item, err := c.outbox.Enqueue(p, filename, data, md)
+	if err != nil {
+		c.printf("Error queueing '%s': %v\n", filename, err)
+		return
+	}
+	c.printf("File %s queued for peer %s as %s\n", filename, p, item.ID)
+}
 
-	peerChan, err := c.discovery.DiscoverPeers(ctx)
+// listOutbox displays the uploads waiting for their peer.
+func (c *CLI) listOutbox() {
+	items := c.outbox.Items()
+	if len(items) == 0 {
+		c.println("No uploads are queued")
+		return
+	}
+	c.println("Queued uploads:")
+	for _, item := range items {
+		status := "pending"
+		if item.Attempts > 0 {
+			status = fmt.Sprintf("%d attempts, next in %s, last error: %s", item.Attempts,
+				time.Until(item.NextAttempt).Round(time.Second), item.LastError)
+		}
+		c.printf("- %s: %s (%d bytes) to peer %s, %s\n", item.ID, item.Name, item.Size, item.Peer, status)
+	}
+}
+
+// encryptFile seals a local file for the given peers and shares the result under
+// its base name. Only those peers can decrypt it, wherever the sealed copy ends up.
+// The file must lie outside the shared directory, or its plaintext would be shared
+// along with the sealed copy.
+func (c *CLI) encryptFile(filename string, peerIDs []string) {
+	var recipients []crypto.PubKey
+	for _, s := range peerIDs {
+		p, err := peer.Decode(s)
+		if err != nil {
+			c.printf("Invalid peer ID '%s': %v\n", s, err)
+			return
+		}
+		pub := c.host.Peerstore().PubKey(p)
+		if pub == nil {
+			c.printf("Public key of peer %s is unknown\n", p)
+			return
+		}
+		recipients = append(recipients, pub)
+	}
+
+	shared, err := c.inSharedDir(filename)
+	if err != nil {
+		c.printf("Error encrypting '%s': %v\n", filename, err)
+		return
+	}
+	if shared {
+		c.printf("'%s' is in the shared directory, where peers can download it unencrypted; move it out of %s first\n", filename, c.sharedDir)
+		return
+	}
+	f, err := os.Open(filename)
 	if err != nil {
-		log.Printf("Error discovering peers: %v\n", err)
+		c.printf("Error reading file '%s': %v\n", filename, err)
 		return
 	}
+	defer f.Close()
 
-	for peer := range peerChan {
-		if err := network.SendFile(c.ctx, c.host, peer.ID, filename, data); err != nil {
-			log.Printf("Error sending file to peer %s: %v\n", peer.ID, err)
-			continue
+	// The sealed copy is written next to its destination and only appears there
+	// once complete.
+	name := filepath.Base(filename) + seal.Extension
+	dest := filepath.Join(c.sharedDir, name)
+	out, err := file.CreateAtomic(dest)
+	if err != nil {
+		c.printf("Error saving '%s': %v\n", dest, err)
+		return
+	}
+	defer out.Discard()
+	if err := seal.Encrypt(out, f, recipients); err != nil {
+		c.printf("Error encrypting '%s': %v\n", filename, err)
+		return
+	}
+	if err := out.Commit(file.Metadata{}, file.Policy{}); err != nil {
+		c.printf("Error saving '%s': %v\n", dest, err)
+		return
+	}
+	c.printf("File %s encrypted for %d peers and shared as %s\n", filename, len(recipients), name)
+}
+
+// inSharedDir reports whether a local path lies inside the shared directory,
+// following symbolic links.
+func (c *CLI) inSharedDir(path string) (bool, error) {
+	dir, err := filepath.EvalSymlinks(c.sharedDir)
+	if err != nil {
+		return false, err
+	}
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return false, err
+	}
+	if dir, err = filepath.Abs(dir); err != nil {
+		return false, err
+	}
+	if target, err = filepath.Abs(target); err != nil {
+		return false, err
+	}
+	rel, err := filepath.Rel(dir, target)
+	return err == nil && filepath.IsLocal(rel), nil
+}
+
+// decryptFile opens a sealed file in the download directory with this node's
+// identity key and saves the content without the sealed extension.
+func (c *CLI) decryptFile(filename string) {
+	if !strings.HasSuffix(filename, seal.Extension) {
+		c.printf("'%s' is not a sealed file; its name must end in %s\n", filename, seal.Extension)
+		return
+	}
+	src, err := file.LocalPath(c.downloadDir, filename)
+	if err != nil {
+		c.printf("Error decrypting '%s': %v\n", filename, err)
+		return
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		c.printf("Error reading file '%s': %v\n", src, err)
+		return
+	}
+	defer f.Close()
+	// Content that fails to authenticate is discarded with the temporary file.
+	dest := strings.TrimSuffix(src, seal.Extension)
+	out, err := file.CreateAtomic(dest)
+	if err != nil {
+		c.printf("Error saving '%s': %v\n", dest, err)
+		return
+	}
+	defer out.Discard()
+	if err := seal.Decrypt(out, f, c.host.Peerstore().PrivKey(c.host.ID())); err != nil {
+		c.printf("Error decrypting '%s': %v\n", filename, err)
+		return
+	}
+	if err := out.Commit(file.Metadata{}, file.Policy{}); err != nil {
+		c.printf("Error saving '%s': %v\n", dest, err)
+		return
+	}
+	c.printf("File %s decrypted to %s\n", filename, dest)
+}
+
+// showNewFiles prints the files announced by other nodes as they arrive.
+func (c *CLI) showNewFiles() {
+	for a := range c.feed.Announcements(c.ctx) {
+		c.printf("New file on '%s': %s  %d bytes  from %s\n", a.Topic, printable(a.Name), a.Size, a.Owner)
+	}
+}
+
+// listAnnouncements displays the most recently announced files.
+func (c *CLI) listAnnouncements() {
+	recent := c.feed.Recent()
+	if len(recent) == 0 {
+		c.println("No new files announced.")
+		return
+	}
+	c.println("Recently announced files:")
+	for _, a := range recent {
+		c.printf("[%s] %s  %d bytes  from %s\n", a.Topic, printable(a.Name), a.Size, a.Owner)
+	}
+}
+
+// subscribe follows the file announcements of a team topic.
+func (c *CLI) subscribe(topic string) {
+	if err := c.feed.Subscribe(topic); err != nil {
+		c.printf("Error subscribing to '%s': %v\n", topic, err)
+		return
+	}
+	c.printf("Subscribed to '%s'\n", topic)
+}
+
+// unsubscribe stops following a team topic.
+func (c *CLI) unsubscribe(topic string) {
+	if err := c.feed.Unsubscribe(topic); err != nil {
+		c.printf("Error unsubscribing from '%s': %v\n", topic, err)
+		return
+	}
+	c.printf("Unsubscribed from '%s'\n", topic)
+}
+
+// showMessages prints the messages from other peers as they arrive.
+func (c *CLI) showMessages() {
+	for m := range c.chat.Messages(c.ctx) {
+		c.printMessage(m)
+	}
+}
+
+// sendMessage sends a direct message to a peer, or to a group named as "#<group>".
+// Like a transfer, it is bounded by the transfer timeout and can be interrupted,
+// and its stream by the node's stream timeouts.
+func (c *CLI) sendMessage(to string, text string) {
+	ctx, cancel := c.transfer()
+	defer cancel()
+	defer c.reportCancel(ctx)
+
+	if group, ok := strings.CutPrefix(to, "#"); ok {
+		if err := c.chat.SendGroup(ctx, group, text); err != nil {
+			c.printf("Error sending message: %v\n", err)
 		}
-		log.Printf("File %s uploaded successfully to peer %s\n", filename, peer.ID)
 		return
 	}
+	p, err := peer.Decode(to)
+	if err != nil {
+		c.printf("Invalid peer ID '%s': %v\n", to, err)
+		return
+	}
+	if err := c.chat.Send(ctx, p, text); err != nil {
+		c.printf("Error sending message to peer %s: %v\n", p, err)
+	}
+}
+
+// showHistory displays the messages of a conversation, or of all conversations.
+func (c *CLI) showHistory(conversation string) {
+	messages := c.chat.History(conversation)
+	if len(messages) == 0 {
+		c.println("No messages.")
+		return
+	}
+	for _, m := range messages {
+		c.printMessage(m)
+	}
+}
+
+// printMessage displays a message with its conversation and sender.
+func (c *CLI) printMessage(m chat.Message) {
+	self := c.host.ID()
+	from := m.From.String()
+	if m.From == self {
+		from = "me"
+	}
+	c.printf("%s [%s] %s: %s\n", m.Time.Format(time.TimeOnly), printable(m.Conversation(self)), from, printable(m.Text))
+}
+
+// printable drops the control characters from text received from other nodes,
+// so a peer cannot move the cursor, clear the screen or forge lines of output.
+func printable(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// printf writes user-facing output; diagnostics go to the logger instead.
+func (c *CLI) printf(format string, args ...any) {
+	fmt.Fprintf(c.out, format, args...)
+}
 
-	log.Println("No peers available to upload the file")
+// println writes a line of user-facing output.
+func (c *CLI) println(args ...any) {
+	fmt.Fprintln(c.out, args...)
 }
@@ -0,0 +1,422 @@
+// Package delta implements rsync-style delta encoding. The receiver describes the
+// copy of a file it already has with a Signature of block checksums, and the sender
+// encodes its version as references to matching blocks plus the literal bytes in
+// between, so only the changed parts cross the wire.
+package delta
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+const (
+	// MinBlockSize and MaxBlockSize bound the block size picked by BlockSize.
+	MinBlockSize = 2 << 10
+	MaxBlockSize = 1 << 20
+	// maxLiteral is the largest run of literal bytes in a single operation.
+	maxLiteral = 64 << 10
+)
+
+// Operation codes of an encoded delta.
+const (
+	opCopy    byte = 'C'
+	opLiteral byte = 'L'
+	opEnd     byte = 'E'
+)
+
+// ErrInvalidDelta is returned for a malformed signature or delta.
+var ErrInvalidDelta = errors.New("invalid delta")
+
+// ErrSignatureTooLarge is returned for a signature with more blocks than could
+// match the file it is read for.
+var ErrSignatureTooLarge = errors.New("signature too large")
+
+// Block holds the checksums of one block of the receiver's copy.
+type Block struct {
+	// Weak is the rolling checksum, which the sender can compute cheaply at every offset.
+	Weak uint32
+	// Strong is a truncated SHA-256 confirming a weak match.
+	Strong [16]byte
+}
+
+// Signature describes the full blocks of a file. A trailing partial block is left
+// out and is always sent as literal bytes.
+type Signature struct {
+	BlockSize int
+	Blocks    []Block
+}
+
+// Stats counts the bytes of a delta that were copied from the receiver's copy and
+// the literal bytes that were sent.
+type Stats struct {
+	Matched int64
+	Literal int64
+}
+
+// BlockSize picks a block size for a file of the given size: the square root of the
+// size, which balances the signature size against the granularity of matches.
+func BlockSize(size int64) int {
+	bs := int(math.Sqrt(float64(size)))
+	return min(max(bs, MinBlockSize), MaxBlockSize)
+}
+
+// NewSignature computes the signature of the content read from r.
+func NewSignature(r io.Reader, blockSize int) (Signature, error) {
+	if blockSize <= 0 {
+		return Signature{}, fmt.Errorf("block size must be positive")
+	}
+	sig := Signature{BlockSize: blockSize}
+	buf := make([]byte, blockSize)
+	for {
+		if _, err := io.ReadFull(r, buf); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return sig, nil
+			}
+			return Signature{}, fmt.Errorf("error reading block %d: %w", len(sig.Blocks), err)
+		}
+		sig.Blocks = append(sig.Blocks, Block{Weak: weakSum(buf), Strong: strongSum(buf)})
+	}
+}
+
+// WriteSignature writes a signature in its binary form.
+func WriteSignature(w io.Writer, sig Signature) error {
+	writer := bufio.NewWriter(w)
+	var buf [20]byte
+	binary.BigEndian.PutUint32(buf[:4], uint32(sig.BlockSize))
+	binary.BigEndian.PutUint32(buf[4:8], uint32(len(sig.Blocks)))
+	if _, err := writer.Write(buf[:8]); err != nil {
+		return fmt.Errorf("error writing signature: %w", err)
+	}
+	for _, b := range sig.Blocks {
+		binary.BigEndian.PutUint32(buf[:4], b.Weak)
+		copy(buf[4:], b.Strong[:])
+		if _, err := writer.Write(buf[:]); err != nil {
+			return fmt.Errorf("error writing signature: %w", err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("error writing signature: %w", err)
+	}
+	return nil
+}
+
+// ReadSignature reads a signature written by WriteSignature, to encode a file of
+// the given size against it. The file can match at most size/BlockSize+1 blocks. A
+// signature with more blocks is skipped without holding its blocks in memory, and
+// an empty signature is returned along with ErrSignatureTooLarge, so the caller
+// can still send the whole file.
+func ReadSignature(r io.Reader, size int64) (Signature, error) {
+	var buf [20]byte
+	if _, err := io.ReadFull(r, buf[:8]); err != nil {
+		return Signature{}, fmt.Errorf("error reading signature: %w", err)
+	}
+	blockSize := binary.BigEndian.Uint32(buf[:4])
+	count := binary.BigEndian.Uint32(buf[4:8])
+	if blockSize == 0 || blockSize > MaxBlockSize {
+		return Signature{}, fmt.Errorf("%w: signature of %d blocks of %d bytes", ErrInvalidDelta, count, blockSize)
+	}
+	sig := Signature{BlockSize: int(blockSize)}
+	if int64(count) > max(size, 0)/int64(blockSize)+1 {
+		if _, err := io.CopyN(io.Discard, r, int64(count)*int64(len(buf))); err != nil {
+			return Signature{}, fmt.Errorf("error reading signature: %w", err)
+		}
+		return sig, fmt.Errorf("%w: %d blocks of %d bytes for a %d byte file", ErrSignatureTooLarge, count, blockSize, size)
+	}
+	sig.Blocks = make([]Block, 0, count)
+	for i := uint32(0); i < count; i++ {
+		if _, err := io.ReadFull(r, buf[:]); err != nil {
+			return Signature{}, fmt.Errorf("error reading signature: %w", err)
+		}
+		b := Block{Weak: binary.BigEndian.Uint32(buf[:4])}
+		copy(b.Strong[:], buf[4:])
+		sig.Blocks = append(sig.Blocks, b)
+	}
+	return sig, nil
+}
+
+// Encode writes the file read from r to w as a delta against the file described by
+// sig. Only the current block and the pending literal bytes, at most maxLiteral of
+// them, are held in memory.
+func Encode(w io.Writer, sig Signature, r io.Reader) (Stats, error) {
+	e := &encoder{w: bufio.NewWriter(w), copyStart: -1}
+	bs := sig.BlockSize
+	blocks := make(map[uint32][]int, len(sig.Blocks))
+	for i, b := range sig.Blocks {
+		blocks[b.Weak] = append(blocks[b.Weak], i)
+	}
+
+	// buf holds the pending literal bytes, buf[:pos], followed by the bytes read
+	// ahead, starting with the window being matched.
+	var buf []byte
+	pos := 0
+	chunk := make([]byte, max(bs, 32<<10))
+	eof := false
+	// fill reads until n bytes follow pos or the file ends.
+	fill := func(n int) error {
+		for !eof && len(buf)-pos < n {
+			m, err := r.Read(chunk)
+			buf = append(buf, chunk[:m]...)
+			if err == io.EOF {
+				eof = true
+			} else if err != nil {
+				return fmt.Errorf("error reading file: %w", err)
+			}
+		}
+		return nil
+	}
+	// flush writes the pending literal bytes and drops them from buf.
+	flush := func() error {
+		if err := e.literal(buf[:pos]); err != nil {
+			return err
+		}
+		buf = append(buf[:0], buf[pos:]...)
+		pos = 0
+		return nil
+	}
+
+	if len(sig.Blocks) > 0 {
+		var rs rolling
+		rolled := false
+		for {
+			if err := fill(bs + 1); err != nil {
+				return e.stats, err
+			}
+			if len(buf)-pos < bs {
+				break
+			}
+			window := buf[pos : pos+bs]
+			if !rolled {
+				rs.init(window)
+				rolled = true
+			}
+			if block, ok := match(sig, blocks[rs.sum()], window); ok {
+				if err := flush(); err != nil {
+					return e.stats, err
+				}
+				if err := e.copy(block, bs); err != nil {
+					return e.stats, err
+				}
+				buf = append(buf[:0], buf[bs:]...)
+				rolled = false
+				continue
+			}
+			if len(buf)-pos == bs {
+				break
+			}
+			rs.roll(buf[pos], buf[pos+bs], bs)
+			pos++
+			if pos >= maxLiteral {
+				if err := flush(); err != nil {
+					return e.stats, err
+				}
+			}
+		}
+	}
+	// The rest of the file is sent as literal bytes.
+	for {
+		pos = 0
+		if err := fill(maxLiteral); err != nil {
+			return e.stats, err
+		}
+		if len(buf) == 0 {
+			break
+		}
+		pos = min(len(buf), maxLiteral)
+		if err := flush(); err != nil {
+			return e.stats, err
+		}
+	}
+	if err := e.end(); err != nil {
+		return e.stats, err
+	}
+	return e.stats, nil
+}
+
+// match returns the block among candidates whose strong checksum matches window.
+func match(sig Signature, candidates []int, window []byte) (int, bool) {
+	if len(candidates) == 0 {
+		return 0, false
+	}
+	strong := strongSum(window)
+	for _, i := range candidates {
+		if sig.Blocks[i].Strong == strong {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// encoder writes delta operations, merging runs of consecutive blocks into a
+// single copy.
+type encoder struct {
+	w         *bufio.Writer
+	stats     Stats
+	copyStart int
+	copyCount int
+}
+
+func (e *encoder) copy(block, blockSize int) error {
+	e.stats.Matched += int64(blockSize)
+	if e.copyStart >= 0 && block == e.copyStart+e.copyCount {
+		e.copyCount++
+		return nil
+	}
+	if err := e.flushCopy(); err != nil {
+		return err
+	}
+	e.copyStart, e.copyCount = block, 1
+	return nil
+}
+
+func (e *encoder) flushCopy() error {
+	if e.copyStart < 0 {
+		return nil
+	}
+	buf := []byte{opCopy}
+	buf = binary.AppendUvarint(buf, uint64(e.copyStart))
+	buf = binary.AppendUvarint(buf, uint64(e.copyCount))
+	e.copyStart, e.copyCount = -1, 0
+	if _, err := e.w.Write(buf); err != nil {
+		return fmt.Errorf("error writing delta: %w", err)
+	}
+	return nil
+}
+
+func (e *encoder) literal(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if err := e.flushCopy(); err != nil {
+		return err
+	}
+	for len(data) > 0 {
+		n := min(len(data), maxLiteral)
+		buf := binary.AppendUvarint([]byte{opLiteral}, uint64(n))
+		if _, err := e.w.Write(buf); err != nil {
+			return fmt.Errorf("error writing delta: %w", err)
+		}
+		if _, err := e.w.Write(data[:n]); err != nil {
+			return fmt.Errorf("error writing delta: %w", err)
+		}
+		e.stats.Literal += int64(n)
+		data = data[n:]
+	}
+	return nil
+}
+
+func (e *encoder) end() error {
+	if err := e.flushCopy(); err != nil {
+		return err
+	}
+	if err := e.w.WriteByte(opEnd); err != nil {
+		return fmt.Errorf("error writing delta: %w", err)
+	}
+	if err := e.w.Flush(); err != nil {
+		return fmt.Errorf("error writing delta: %w", err)
+	}
+	return nil
+}
+
+// Apply reads a delta from r and writes the file it encodes to w, reading copied
+// blocks from basis, the file sig was computed from.
+func Apply(w io.Writer, basis io.ReaderAt, sig Signature, r io.Reader) (Stats, error) {
+	var stats Stats
+	blockSize, blocks := sig.BlockSize, uint64(len(sig.Blocks))
+	reader := bufio.NewReader(r)
+	buf := make([]byte, max(blockSize, maxLiteral))
+	for {
+		op, err := reader.ReadByte()
+		if err != nil {
+			return stats, fmt.Errorf("error reading delta: %w", err)
+		}
+		switch op {
+		case opCopy:
+			start, err := binary.ReadUvarint(reader)
+			if err != nil {
+				return stats, fmt.Errorf("error reading delta: %w", err)
+			}
+			count, err := binary.ReadUvarint(reader)
+			if err != nil {
+				return stats, fmt.Errorf("error reading delta: %w", err)
+			}
+			if start > blocks || count > blocks-start {
+				return stats, fmt.Errorf("%w: copy of %d blocks at block %d", ErrInvalidDelta, count, start)
+			}
+			for i := start; i < start+count; i++ {
+				block := buf[:blockSize]
+				if n, err := basis.ReadAt(block, int64(i)*int64(blockSize)); n < blockSize {
+					return stats, fmt.Errorf("error reading block %d: %w", i, err)
+				}
+				if _, err := w.Write(block); err != nil {
+					return stats, fmt.Errorf("error writing file: %w", err)
+				}
+				stats.Matched += int64(blockSize)
+			}
+		case opLiteral:
+			n, err := binary.ReadUvarint(reader)
+			if err != nil {
+				return stats, fmt.Errorf("error reading delta: %w", err)
+			}
+			if n > maxLiteral {
+				return stats, fmt.Errorf("%w: literal of %d bytes", ErrInvalidDelta, n)
+			}
+			literal := buf[:n]
+			if _, err := io.ReadFull(reader, literal); err != nil {
+				return stats, fmt.Errorf("error reading delta: %w", err)
+			}
+			if _, err := w.Write(literal); err != nil {
+				return stats, fmt.Errorf("error writing file: %w", err)
+			}
+			stats.Literal += int64(n)
+		case opEnd:
+			return stats, nil
+		default:
+			return stats, fmt.Errorf("%w: unknown operation %q", ErrInvalidDelta, op)
+		}
+	}
+}
+
+// rolling is the rsync rolling checksum of a window, which can be moved forward
+// one byte at a time.
+type rolling struct {
+	a, b uint32
+}
+
+func (r *rolling) init(window []byte) {
+	r.a, r.b = 0, 0
+	n := uint32(len(window))
+	for i, c := range window {
+		r.a += uint32(c)
+		r.b += (n - uint32(i)) * uint32(c)
+	}
+}
+
+// roll moves a window of size n forward by dropping out and appending in.
+func (r *rolling) roll(out, in byte, n int) {
+	r.a += uint32(in) - uint32(out)
+	r.b += r.a - uint32(n)*uint32(out)
+}
+
+func (r *rolling) sum() uint32 {
+	return r.a&0xffff | r.b<<16
+}
+
+// weakSum computes the rolling checksum of a block.
+func weakSum(block []byte) uint32 {
+	var r rolling
+	r.init(block)
+	return r.sum()
+}
+
+// strongSum computes the truncated SHA-256 of a block.
+func strongSum(block []byte) [16]byte {
+	sum := sha256.Sum256(block)
+	var strong [16]byte
+	copy(strong[:], sum[:])
+	return strong
+}
@@ -0,0 +1,140 @@
+package delta
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+	"testing/iotest"
+)
+
+func TestEncode_Apply(t *testing.T) {
+	const blockSize = 64
+	base := make([]byte, 64*blockSize+10)
+	rand.New(rand.NewSource(1)).Read(base)
+	edit := func(f func([]byte) []byte) []byte {
+		return f(append([]byte(nil), base...))
+	}
+
+	// noise spans several literal operations.
+	noise := make([]byte, 3*maxLiteral+7)
+	rand.New(rand.NewSource(2)).Read(noise)
+
+	tests := []struct {
+		name        string
+		basis       []byte
+		data        []byte
+		wantLiteral int64
+	}{
+		{name: "unchanged", basis: base, data: base, wantLiteral: 10},
+		{name: "modified block", basis: base, data: edit(func(b []byte) []byte { b[100] ^= 0xff; return b }), wantLiteral: blockSize + 10},
+		{name: "inserted bytes", basis: base, data: edit(func(b []byte) []byte {
+			return append(b[:1000:1000], append([]byte("inserted"), b[1000:]...)...)
+		}), wantLiteral: 2*blockSize + 10},
+		{name: "prepended bytes", basis: base, data: append([]byte("header"), base...), wantLiteral: 16},
+		// A signature with more blocks than the file could match is dropped.
+		{name: "truncated", basis: base, data: base[:20*blockSize], wantLiteral: 20 * blockSize},
+		{name: "no basis", basis: nil, data: base, wantLiteral: int64(len(base))},
+		{name: "empty file", basis: base, data: nil, wantLiteral: 0},
+		{name: "long literal run", basis: base, data: append(noise, base...), wantLiteral: int64(len(noise)) + 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sig, err := NewSignature(bytes.NewReader(tt.basis), blockSize)
+			if err != nil {
+				t.Fatalf("NewSignature() error = %v", err)
+			}
+			var sigBuf bytes.Buffer
+			if err := WriteSignature(&sigBuf, sig); err != nil {
+				t.Fatalf("WriteSignature() error = %v", err)
+			}
+			sig, err = ReadSignature(&sigBuf, int64(len(tt.data)))
+			if err != nil && !errors.Is(err, ErrSignatureTooLarge) {
+				t.Fatalf("ReadSignature() error = %v", err)
+			}
+
+			var delta bytes.Buffer
+			// The file is read in small pieces to exercise the read-ahead.
+			stats, err := Encode(&delta, sig, iotest.HalfReader(bytes.NewReader(tt.data)))
+			if err != nil {
+				t.Fatalf("Encode() error = %v", err)
+			}
+			if stats.Literal > tt.wantLiteral || stats.Matched+stats.Literal != int64(len(tt.data)) {
+				t.Errorf("Encode() stats = %+v, want at most %d literal bytes of %d", stats, tt.wantLiteral, len(tt.data))
+			}
+
+			var out bytes.Buffer
+			applied, err := Apply(&out, bytes.NewReader(tt.basis), sig, &delta)
+			if err != nil {
+				t.Fatalf("Apply() error = %v", err)
+			}
+			if !bytes.Equal(out.Bytes(), tt.data) {
+				t.Errorf("Apply() produced %d bytes that differ from the %d byte file", out.Len(), len(tt.data))
+			}
+			if applied != stats {
+				t.Errorf("Apply() stats = %+v, want %+v", applied, stats)
+			}
+		})
+	}
+}
+
+func TestReadSignature_TooLarge(t *testing.T) {
+	sig, err := NewSignature(bytes.NewReader(make([]byte, 10*MinBlockSize)), MinBlockSize)
+	if err != nil {
+		t.Fatalf("NewSignature() error = %v", err)
+	}
+	var buf bytes.Buffer
+	if err := WriteSignature(&buf, sig); err != nil {
+		t.Fatalf("WriteSignature() error = %v", err)
+	}
+	buf.WriteString("rest")
+
+	got, err := ReadSignature(&buf, 2*MinBlockSize)
+	if !errors.Is(err, ErrSignatureTooLarge) {
+		t.Fatalf("ReadSignature() error = %v, want %v", err, ErrSignatureTooLarge)
+	}
+	if got.BlockSize != MinBlockSize || len(got.Blocks) != 0 {
+		t.Errorf("ReadSignature() = %d blocks of %d bytes, want an empty signature", len(got.Blocks), got.BlockSize)
+	}
+	if buf.String() != "rest" {
+		t.Errorf("ReadSignature() left %q unread, want the data after the signature", buf.String())
+	}
+}
+
+func TestApply_Invalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		delta []byte
+	}{
+		{name: "unknown operation", delta: []byte("X")},
+		{name: "truncated literal", delta: []byte{opLiteral, 10, 'a'}},
+		{name: "block beyond basis", delta: []byte{opCopy, 5, 1, opEnd}},
+		{name: "block beyond signature", delta: []byte{opCopy, 1, 1, opEnd}},
+		{name: "missing end", delta: []byte{opLiteral, 1, 'a'}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The signature covers the first of the basis' two blocks.
+			sig := Signature{BlockSize: 4, Blocks: make([]Block, 1)}
+			if _, err := Apply(&bytes.Buffer{}, bytes.NewReader(make([]byte, 8)), sig, bytes.NewReader(tt.delta)); err == nil {
+				t.Errorf("Apply() succeeded for an invalid delta")
+			}
+		})
+	}
+}
+
+func TestBlockSize(t *testing.T) {
+	tests := []struct {
+		size int64
+		want int
+	}{
+		{size: 0, want: MinBlockSize},
+		{size: 100 << 20, want: 10240},
+		{size: 1 << 50, want: MaxBlockSize},
+	}
+	for _, tt := range tests {
+		if got := BlockSize(tt.size); got != tt.want {
+			t.Errorf("BlockSize(%d) = %d, want %d", tt.size, got, tt.want)
+		}
+	}
+}
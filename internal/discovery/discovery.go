@@ -2,62 +2,340 @@ package discovery
 
 import (
 	"context"
-	"log"
-	"time"
+	"fmt"
+	"log/slog"
+	"sync"
 
+	"github.com/libp2p/go-libp2p/core/event"
 	"github.com/libp2p/go-libp2p/core/host"
+	corenet "github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
 	"github.com/libp2p/go-libp2p/p2p/discovery/mdns"
+	"github.com/libp2p/go-libp2p/p2p/host/eventbus"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/logging"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/metrics"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/network"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/tracing"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// eventBufferSize is the number of events buffered for each subscriber
+// before further events are dropped.
+const eventBufferSize = 32
+
+// EventType identifies the kind of change reported by a PeerEvent.
+type EventType int
+
+const (
+	// PeerConnected is emitted when the first connection to a peer is established.
+	PeerConnected EventType = iota
+	// PeerDisconnected is emitted when the last connection to a peer is closed.
+	PeerDisconnected
+	// PeerIdentified is emitted once the identify protocol completes for a peer.
+	PeerIdentified
+	// PeerProtocolsUpdated is emitted when a peer adds or removes protocols.
+	PeerProtocolsUpdated
+)
+
+// String returns a human-readable name for the event type.
+func (t EventType) String() string {
+	switch t {
+	case PeerConnected:
+		return "connected"
+	case PeerDisconnected:
+		return "disconnected"
+	case PeerIdentified:
+		return "identified"
+	case PeerProtocolsUpdated:
+		return "protocols-updated"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(t))
+	}
+}
+
+// PeerEvent describes a change in the state of a peer.
+type PeerEvent struct {
+	Type      EventType
+	Peer      peer.AddrInfo
+	Protocols []protocol.ID
+}
+
+// Capabilities describes the optional features advertised by a peer.
+type Capabilities struct {
+	Compression bool
+}
+
 // Discovery manages peer discovery in the network.
 type Discovery struct {
-	host host.Host
+	host   host.Host
+	logger *slog.Logger
+	mdns   mdns.Service
+	sub    event.Subscription
+	// ctx is cancelled by Close, abandoning pending connection attempts.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu          sync.Mutex
+	peers       map[peer.ID]bool // connected peers, true once identified
+	subscribers map[chan PeerEvent]struct{}
 }
 
-// NewDiscovery creates a new instance of Discovery.
-func NewDiscovery(h host.Host) *Discovery {
-	return &Discovery{host: h}
+// NewDiscovery creates a new instance of Discovery, which logs to logger.
+func NewDiscovery(h host.Host, logger *slog.Logger) *Discovery {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Discovery{
+		host:        h,
+		logger:      logger,
+		ctx:         ctx,
+		cancel:      cancel,
+		peers:       make(map[peer.ID]bool),
+		subscribers: make(map[chan PeerEvent]struct{}),
+	}
 }
 
-// SetupDiscovery initializes the mDNS discovery service.
+// SetupDiscovery subscribes to the host's event bus and initializes the mDNS discovery service.
 func (d *Discovery) SetupDiscovery() error {
-	service := mdns.NewMdnsService(d.host, "p2p-file-sharing", d)
-	return service.Start()
+	sub, err := d.host.EventBus().Subscribe([]interface{}{
+		new(event.EvtPeerConnectednessChanged),
+		new(event.EvtPeerIdentificationCompleted),
+		new(event.EvtPeerProtocolsUpdated),
+	}, eventbus.Name("p2p-file-sharing-discovery"))
+	if err != nil {
+		return fmt.Errorf("error subscribing to peer events: %w", err)
+	}
+	d.sub = sub
+
+	// Seed with peers connected before the subscription was created.
+	d.mu.Lock()
+	for _, p := range d.host.Network().Peers() {
+		d.peers[p] = false
+	}
+	d.mu.Unlock()
+
+	go d.handleEvents()
+
+	d.mdns = mdns.NewMdnsService(d.host, "p2p-file-sharing", d)
+	return d.mdns.Start()
+}
+
+// Close stops the mDNS service and the event subscription, and abandons pending
+// connection attempts.
+func (d *Discovery) Close() error {
+	d.cancel()
+	if d.mdns != nil {
+		if err := d.mdns.Close(); err != nil {
+			return fmt.Errorf("error closing mdns service: %w", err)
+		}
+	}
+	if d.sub != nil {
+		if err := d.sub.Close(); err != nil {
+			return fmt.Errorf("error closing event subscription: %w", err)
+		}
+	}
+	return nil
+}
+
+// Peers returns a snapshot of the currently connected peers.
+func (d *Discovery) Peers() []peer.AddrInfo {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	peers := make([]peer.AddrInfo, 0, len(d.peers))
+	for p := range d.peers {
+		peers = append(peers, d.host.Peerstore().PeerInfo(p))
+	}
+	return peers
+}
+
+// CompatiblePeers returns a snapshot of the connected peers that speak a
+// compatible version of the file-sharing protocol.
+func (d *Discovery) CompatiblePeers() []peer.AddrInfo {
+	var peers []peer.AddrInfo
+	for _, pi := range d.Peers() {
+		protocols, err := d.host.Peerstore().GetProtocols(pi.ID)
+		if err != nil {
+			d.logger.Warn("Error reading peer protocols", logging.Peer(pi.ID), "error", err)
+			continue
+		}
+		if supportsFileSharing(protocols) {
+			peers = append(peers, pi)
+		}
+	}
+	return peers
+}
+
+// Capabilities returns the optional features advertised by a peer through identify.
+func (d *Discovery) Capabilities(p peer.ID) (Capabilities, error) {
+	supported, err := d.host.Peerstore().SupportsProtocols(p, network.CompressionCapability)
+	if err != nil {
+		return Capabilities{}, fmt.Errorf("error reading protocols of peer %s: %w", p, err)
+	}
+
+	var caps Capabilities
+	for _, id := range supported {
+		switch id {
+		case network.CompressionCapability:
+			caps.Compression = true
+		}
+	}
+	return caps, nil
+}
+
+// supportsFileSharing reports whether any of the protocols is a compatible file-sharing version.
+func supportsFileSharing(protocols []protocol.ID) bool {
+	for _, id := range protocols {
+		if network.MatchProtocol(id) {
+			return true
+		}
+	}
+	return false
 }
 
-// DiscoverPeers returns a channel for discovering peers.
+// Events returns a channel of peer events. The channel is closed when ctx is done.
+func (d *Discovery) Events(ctx context.Context) <-chan PeerEvent {
+	ch := make(chan PeerEvent, eventBufferSize)
+
+	d.mu.Lock()
+	d.subscribers[ch] = struct{}{}
+	d.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		d.mu.Lock()
+		delete(d.subscribers, ch)
+		close(ch)
+		d.mu.Unlock()
+	}()
+
+	return ch
+}
+
+// DiscoverPeers returns a channel that yields every compatible peer once, followed by
+// peers as they are identified as compatible. The channel is closed when ctx is done.
 func (d *Discovery) DiscoverPeers(ctx context.Context) (<-chan peer.AddrInfo, error) {
+	// Subscribe before taking the snapshot so no peer is missed in between.
+	events := d.Events(ctx)
+	snapshot := d.CompatiblePeers()
+
 	peerChan := make(chan peer.AddrInfo)
-	go d.findPeers(ctx, peerChan)
+	go func() {
+		defer close(peerChan)
+
+		seen := make(map[peer.ID]struct{})
+		send := func(pi peer.AddrInfo) bool {
+			if _, ok := seen[pi.ID]; ok {
+				return true
+			}
+			seen[pi.ID] = struct{}{}
+			select {
+			case peerChan <- pi:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		for _, pi := range snapshot {
+			if !send(pi) {
+				return
+			}
+		}
+		for ev := range events {
+			if ev.Type != PeerIdentified && ev.Type != PeerProtocolsUpdated {
+				continue
+			}
+			if !supportsFileSharing(ev.Protocols) {
+				continue
+			}
+			if !send(ev.Peer) {
+				return
+			}
+		}
+	}()
 	return peerChan, nil
 }
 
-// findPeers periodically discovers peers and sends them to the channel.
-func (d *Discovery) findPeers(ctx context.Context, peerChan chan<- peer.AddrInfo) {
-	ticker := time.NewTicker(time.Second * 5)
-	defer ticker.Stop()
+// handleEvents translates event bus notifications into deduplicated peer events.
+func (d *Discovery) handleEvents() {
+	for e := range d.sub.Out() {
+		switch ev := e.(type) {
+		case event.EvtPeerConnectednessChanged:
+			d.handleConnectedness(ev)
+		case event.EvtPeerIdentificationCompleted:
+			d.mu.Lock()
+			identified, connected := d.peers[ev.Peer]
+			if connected && !identified {
+				d.peers[ev.Peer] = true
+			}
+			d.mu.Unlock()
+			if connected && !identified {
+				d.publish(PeerEvent{Type: PeerIdentified, Peer: d.host.Peerstore().PeerInfo(ev.Peer), Protocols: ev.Protocols})
+			}
+		case event.EvtPeerProtocolsUpdated:
+			if len(ev.Added) == 0 && len(ev.Removed) == 0 {
+				continue
+			}
+			protocols, err := d.host.Peerstore().GetProtocols(ev.Peer)
+			if err != nil {
+				d.logger.Warn("Error reading peer protocols", logging.Peer(ev.Peer), "error", err)
+				continue
+			}
+			d.publish(PeerEvent{Type: PeerProtocolsUpdated, Peer: d.host.Peerstore().PeerInfo(ev.Peer), Protocols: protocols})
+		}
+		metrics.DiscoveredPeers.Set(float64(len(d.CompatiblePeers())))
+	}
+}
+
+// handleConnectedness records connection state changes, ignoring repeated notifications.
+// Peers connected only through a relay count as connected.
+func (d *Discovery) handleConnectedness(ev event.EvtPeerConnectednessChanged) {
+	connected := ev.Connectedness == corenet.Connected || ev.Connectedness == corenet.Limited
+	d.mu.Lock()
+	_, known := d.peers[ev.Peer]
+	var typ EventType
+	switch {
+	case connected && !known:
+		d.peers[ev.Peer] = false
+		typ = PeerConnected
+	case !connected && known:
+		delete(d.peers, ev.Peer)
+		typ = PeerDisconnected
+	default:
+		d.mu.Unlock()
+		return
+	}
+	d.mu.Unlock()
 
-	for {
+	d.publish(PeerEvent{Type: typ, Peer: d.host.Peerstore().PeerInfo(ev.Peer)})
+}
+
+// publish delivers an event to all subscribers without blocking.
+func (d *Discovery) publish(ev PeerEvent) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for ch := range d.subscribers {
 		select {
-		case <-ctx.Done():
-			return
-		case <-ticker.C:
-			peers := d.host.Network().Peers()
-			for _, p := range peers {
-				select {
-				case peerChan <- d.host.Peerstore().PeerInfo(p):
-				case <-ctx.Done():
-					return
-				}
-			}
+		case ch <- ev:
+		default:
+			d.logger.Warn("Dropping peer event: subscriber is not keeping up", logging.Peer(ev.Peer.ID), "event", ev.Type)
 		}
 	}
 }
 
 // HandlePeerFound connects to a newly discovered peer.
 func (d *Discovery) HandlePeerFound(pi peer.AddrInfo) {
-	if err := d.host.Connect(context.Background(), pi); err != nil {
-		log.Printf("Error connecting to peer %s: %v", pi.ID, err)
+	if pi.ID == d.host.ID() || d.host.Network().Connectedness(pi.ID) == corenet.Connected {
+		return
+	}
+	ctx, span := tracing.Start(d.ctx, "discovery.peer_found", trace.WithAttributes(tracing.Peer(pi.ID)))
+	err := d.host.Connect(ctx, pi)
+	tracing.End(span, err)
+	if err != nil {
+		metrics.Errors.WithLabelValues("dial").Inc()
+		d.logger.Warn("Error connecting to discovered peer", logging.Peer(pi.ID), "error", err)
+		return
 	}
+	d.logger.Debug("Connected to discovered peer", logging.Peer(pi.ID))
 }
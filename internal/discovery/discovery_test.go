@@ -2,10 +2,15 @@ package discovery
 
 import (
 	"context"
+	"github.com/libp2p/go-libp2p"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/saurabhSPatel/p2p-file-sharing/config"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/logging"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/network"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestDiscovery_DiscoverPeers(t *testing.T) {
@@ -92,46 +97,228 @@ func TestDiscovery_SetupDiscovery(t *testing.T) {
 	}
 }
 
-func TestDiscovery_findPeers(t *testing.T) {
-	type fields struct {
-		host host.Host
-	}
+func TestNewDiscovery(t *testing.T) {
 	type args struct {
-		ctx      context.Context
-		peerChan chan<- peer.AddrInfo
+		h host.Host
 	}
 	tests := []struct {
-		name   string
-		fields fields
-		args   args
+		name string
+		args args
+		want *Discovery
 	}{
 		// TODO: Add test cases.
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			d := &Discovery{
-				host: tt.fields.host,
+			if got := NewDiscovery(tt.args.h, logging.Discard()); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("NewDiscovery() = %v, want %v", got, tt.want)
 			}
-			d.findPeers(tt.args.ctx, tt.args.peerChan)
 		})
 	}
 }
 
-func TestNewDiscovery(t *testing.T) {
-	type args struct {
-		h host.Host
+// newTestHost creates a host that is closed when the test finishes.
+func newTestHost(t *testing.T, ctx context.Context) host.Host {
+	t.Helper()
+	h, err := network.SetupHost(ctx, config.Default(), logging.Discard())
+	if err != nil {
+		t.Fatalf("Failed to setup host: %v", err)
+	}
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+// waitForEvent reads events until one of the given type for the given peer arrives.
+func waitForEvent(t *testing.T, events <-chan PeerEvent, typ EventType, id peer.ID) PeerEvent {
+	t.Helper()
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				t.Fatalf("Event channel closed while waiting for %s event", typ)
+			}
+			if ev.Type == typ && ev.Peer.ID == id {
+				return ev
+			}
+		case <-timeout:
+			t.Fatalf("Timed out waiting for %s event for peer %s", typ, id)
+		}
+	}
+}
+
+func TestDiscovery_Events(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	host1 := newTestHost(t, ctx)
+	host2 := newTestHost(t, ctx)
+
+	d := NewDiscovery(host1, logging.Discard())
+	if err := d.SetupDiscovery(); err != nil {
+		t.Fatalf("Failed to setup discovery: %v", err)
+	}
+	defer d.Close()
+
+	events := d.Events(ctx)
+
+	if err := host1.Connect(ctx, peer.AddrInfo{ID: host2.ID(), Addrs: host2.Addrs()}); err != nil {
+		t.Fatalf("Failed to connect host1 to host2: %v", err)
 	}
+	waitForEvent(t, events, PeerConnected, host2.ID())
+	ev := waitForEvent(t, events, PeerIdentified, host2.ID())
+	if len(ev.Protocols) == 0 {
+		t.Errorf("Expected identified event to carry protocols")
+	}
+
+	found := false
+	for _, pi := range d.Peers() {
+		if pi.ID == host2.ID() {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected Peers() to contain %s", host2.ID())
+	}
+
+	if err := host1.Network().ClosePeer(host2.ID()); err != nil {
+		t.Fatalf("Failed to close connection: %v", err)
+	}
+	waitForEvent(t, events, PeerDisconnected, host2.ID())
+
+	// The event channel must be closed once the context is canceled.
+	cancel()
+	for range events {
+	}
+}
+
+func TestDiscovery_DiscoverPeersDedup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	host1 := newTestHost(t, ctx)
+	host2 := newTestHost(t, ctx)
+	host3 := newTestHost(t, ctx)
+
+	d := NewDiscovery(host1, logging.Discard())
+	if err := d.SetupDiscovery(); err != nil {
+		t.Fatalf("Failed to setup discovery: %v", err)
+	}
+	defer d.Close()
+
+	if err := host1.Connect(ctx, peer.AddrInfo{ID: host2.ID(), Addrs: host2.Addrs()}); err != nil {
+		t.Fatalf("Failed to connect host1 to host2: %v", err)
+	}
+
+	peerChan, err := d.DiscoverPeers(ctx)
+	if err != nil {
+		t.Fatalf("DiscoverPeers() error = %v", err)
+	}
+
+	if err := host1.Connect(ctx, peer.AddrInfo{ID: host3.ID(), Addrs: host3.Addrs()}); err != nil {
+		t.Fatalf("Failed to connect host1 to host3: %v", err)
+	}
+
+	seen := make(map[peer.ID]int)
+	timeout := time.After(10 * time.Second)
+	for seen[host2.ID()] == 0 || seen[host3.ID()] == 0 {
+		select {
+		case pi := <-peerChan:
+			seen[pi.ID]++
+		case <-timeout:
+			t.Fatalf("Timed out waiting for peers, got %v", seen)
+		}
+	}
+
+	// Reconnecting an already reported peer must not yield it again.
+	if err := host1.Network().ClosePeer(host2.ID()); err != nil {
+		t.Fatalf("Failed to close connection: %v", err)
+	}
+	if err := host1.Connect(ctx, peer.AddrInfo{ID: host2.ID(), Addrs: host2.Addrs()}); err != nil {
+		t.Fatalf("Failed to reconnect host1 to host2: %v", err)
+	}
+	select {
+	case pi := <-peerChan:
+		seen[pi.ID]++
+	case <-time.After(time.Second):
+	}
+
+	for id, n := range seen {
+		if n != 1 {
+			t.Errorf("Peer %s reported %d times, want 1", id, n)
+		}
+	}
+
+	cancel()
+	for range peerChan {
+	}
+}
+
+func TestDiscovery_CompatiblePeers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	host1 := newTestHost(t, ctx)
+	host2 := newTestHost(t, ctx)
+
+	// host3 is a plain libp2p host that does not speak the file-sharing protocol.
+	host3, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatalf("Failed to create host3: %v", err)
+	}
+	defer host3.Close()
+
+	// host2, like every file-sharing node, advertises compression support.
+	d := NewDiscovery(host1, logging.Discard())
+	if err := d.SetupDiscovery(); err != nil {
+		t.Fatalf("Failed to setup discovery: %v", err)
+	}
+	defer d.Close()
+
+	events := d.Events(ctx)
+	for _, h := range []host.Host{host2, host3} {
+		if err := host1.Connect(ctx, peer.AddrInfo{ID: h.ID(), Addrs: h.Addrs()}); err != nil {
+			t.Fatalf("Failed to connect to %s: %v", h.ID(), err)
+		}
+	}
+	waitForEvent(t, events, PeerIdentified, host2.ID())
+	waitForEvent(t, events, PeerIdentified, host3.ID())
+
+	var compatible []peer.ID
+	for _, pi := range d.CompatiblePeers() {
+		compatible = append(compatible, pi.ID)
+	}
+	for _, id := range compatible {
+		if id == host3.ID() {
+			t.Errorf("CompatiblePeers() contains %s, which does not speak %s", host3.ID(), network.ProtocolID)
+		}
+	}
+	found := false
+	for _, id := range compatible {
+		if id == host2.ID() {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("CompatiblePeers() = %v, want it to contain %s", compatible, host2.ID())
+	}
+
 	tests := []struct {
 		name string
-		args args
-		want *Discovery
+		peer peer.ID
+		want Capabilities
 	}{
-		// TODO: Add test cases.
+		{name: "advertised compression", peer: host2.ID(), want: Capabilities{Compression: true}},
+		{name: "no capabilities", peer: host3.ID(), want: Capabilities{}},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := NewDiscovery(tt.args.h); !reflect.DeepEqual(got, tt.want) {
-				t.Errorf("NewDiscovery() = %v, want %v", got, tt.want)
+			got, err := d.Capabilities(tt.peer)
+			if err != nil {
+				t.Fatalf("Capabilities() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Capabilities() = %+v, want %+v", got, tt.want)
 			}
 		})
 	}
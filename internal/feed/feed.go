@@ -0,0 +1,243 @@
+// Package feed announces newly shared files to other nodes over GossipSub topics.
+package feed
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/file"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/index"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/logging"
+)
+
+const (
+	// DefaultTopic is the channel every node announces to and follows.
+	DefaultTopic = "all"
+	// topicPrefix keeps announcement topics apart from other uses of pubsub.
+	topicPrefix = "/p2p-file-sharing/announce/"
+	// recentSize is the number of received announcements kept for Recent.
+	recentSize = 100
+	// announcementBufferSize is the capacity of each Announcements channel.
+	announcementBufferSize = 64
+)
+
+// Announcement describes a file a node added to its shared directory.
+type Announcement struct {
+	// Topic is the channel the announcement was received on.
+	Topic string  `json:"-"`
+	Name  string  `json:"name"`
+	Hash  string  `json:"hash"`
+	Size  int64   `json:"size"`
+	Owner peer.ID `json:"owner"`
+}
+
+// Feed publishes announcements of the local node's files and collects those of
+// other nodes on the topics it follows.
+type Feed struct {
+	host   host.Host
+	ps     *pubsub.PubSub
+	ctx    context.Context
+	logger *slog.Logger
+	// announce is the topic the local node's files are announced on.
+	announce string
+
+	mu sync.Mutex
+	// topics holds every joined topic; pubsub does not allow joining a topic twice,
+	// so topics stay joined after their subscription is cancelled.
+	topics      map[string]*pubsub.Topic
+	subs        map[string]*pubsub.Subscription
+	recent      []Announcement
+	subscribers map[chan Announcement]struct{}
+}
+
+// NewFeed creates a feed on the given pubsub router that announces local files on
+// the announce topic. It follows the default topic and the announce topic.
+// Invalid announcements are logged to logger.
+func NewFeed(ctx context.Context, h host.Host, ps *pubsub.PubSub, announce string, logger *slog.Logger) (*Feed, error) {
+	f := &Feed{
+		host:        h,
+		ps:          ps,
+		ctx:         ctx,
+		logger:      logger,
+		announce:    announce,
+		topics:      make(map[string]*pubsub.Topic),
+		subs:        make(map[string]*pubsub.Subscription),
+		subscribers: make(map[chan Announcement]struct{}),
+	}
+	for _, name := range []string{DefaultTopic, announce} {
+		if err := f.Subscribe(name); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// Subscribe follows a topic, collecting the announcements of other nodes.
+func (f *Feed) Subscribe(name string) error {
+	if name == "" {
+		return fmt.Errorf("topic name must not be empty")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.subs[name]; ok {
+		return nil
+	}
+	topic, ok := f.topics[name]
+	if !ok {
+		var err error
+		topic, err = f.ps.Join(topicPrefix + name)
+		if err != nil {
+			return fmt.Errorf("error joining topic '%s': %w", name, err)
+		}
+		f.topics[name] = topic
+	}
+	sub, err := topic.Subscribe()
+	if err != nil {
+		return fmt.Errorf("error subscribing to topic '%s': %w", name, err)
+	}
+	f.subs[name] = sub
+	go f.read(name, sub)
+	return nil
+}
+
+// Unsubscribe stops following a topic. The default and announce topics cannot be left.
+func (f *Feed) Unsubscribe(name string) error {
+	if name == DefaultTopic || name == f.announce {
+		return fmt.Errorf("the '%s' topic cannot be left", name)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sub, ok := f.subs[name]
+	if !ok {
+		return fmt.Errorf("not subscribed to topic '%s'", name)
+	}
+	sub.Cancel()
+	delete(f.subs, name)
+	return nil
+}
+
+// Topics returns the followed topics in alphabetical order.
+func (f *Feed) Topics() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	names := make([]string, 0, len(f.subs))
+	for name := range f.subs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// AnnounceTopic returns the topic local files are announced on.
+func (f *Feed) AnnounceTopic() string {
+	return f.announce
+}
+
+// Announce publishes a shared file on the announce topic.
+func (f *Feed) Announce(ctx context.Context, e file.Entry) error {
+	data, err := json.Marshal(Announcement{Name: e.Path, Hash: e.Hash, Size: e.Size, Owner: f.host.ID()})
+	if err != nil {
+		return fmt.Errorf("error encoding announcement: %w", err)
+	}
+
+	f.mu.Lock()
+	topic := f.topics[f.announce]
+	f.mu.Unlock()
+
+	if err := topic.Publish(ctx, data); err != nil {
+		return fmt.Errorf("error announcing '%s': %w", e.Path, err)
+	}
+	return nil
+}
+
+// AnnounceIndex announces the files added to the index until ctx is done.
+func (f *Feed) AnnounceIndex(ctx context.Context, idx *index.Index) {
+	for ev := range idx.Events(ctx) {
+		if ev.Type != index.FileAdded {
+			continue
+		}
+		if err := f.Announce(ctx, ev.Entry); err != nil {
+			f.logger.Warn("Error announcing file", "name", ev.Entry.Path, "error", err)
+		}
+	}
+}
+
+// Announcements returns a channel of the announcements received from other nodes.
+// The channel is closed when ctx is done.
+func (f *Feed) Announcements(ctx context.Context) <-chan Announcement {
+	ch := make(chan Announcement, announcementBufferSize)
+
+	f.mu.Lock()
+	f.subscribers[ch] = struct{}{}
+	f.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		f.mu.Lock()
+		delete(f.subscribers, ch)
+		close(ch)
+		f.mu.Unlock()
+	}()
+
+	return ch
+}
+
+// Recent returns the most recently received announcements, oldest first.
+func (f *Feed) Recent() []Announcement {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Announcement(nil), f.recent...)
+}
+
+// read delivers the announcements of a subscription until it is cancelled.
+func (f *Feed) read(name string, sub *pubsub.Subscription) {
+	for {
+		msg, err := sub.Next(f.ctx)
+		if err != nil {
+			return
+		}
+		if msg.GetFrom() == f.host.ID() {
+			continue
+		}
+		var a Announcement
+		if err := json.Unmarshal(msg.Data, &a); err != nil || a.Name == "" {
+			f.logger.Warn("Ignoring invalid announcement", logging.Peer(msg.GetFrom()), "topic", name)
+			continue
+		}
+		// Messages are signed by their author, who may only announce its own files.
+		if a.Owner != msg.GetFrom() {
+			f.logger.Warn("Ignoring announcement on behalf of another peer", logging.Peer(msg.GetFrom()), "topic", name, "owner", a.Owner)
+			continue
+		}
+		a.Topic = name
+		f.publish(a)
+	}
+}
+
+// publish records an announcement and sends it to every subscriber that keeps up.
+func (f *Feed) publish(a Announcement) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.recent = append(f.recent, a)
+	if len(f.recent) > recentSize {
+		f.recent = f.recent[len(f.recent)-recentSize:]
+	}
+	for ch := range f.subscribers {
+		select {
+		case ch <- a:
+		default:
+			f.logger.Warn("Dropping announcement: subscriber is not keeping up", logging.Peer(a.Owner), "name", a.Name)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package feed
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/saurabhSPatel/p2p-file-sharing/config"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/file"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/logging"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/network"
+)
+
+// newTestFeed creates a host and a feed on its own GossipSub router.
+func newTestFeed(t *testing.T, ctx context.Context, announce string) (host.Host, *Feed) {
+	t.Helper()
+	cfg := config.Default()
+	cfg.SharedDir = t.TempDir()
+	h, err := network.SetupHost(ctx, cfg, logging.Discard())
+	if err != nil {
+		t.Fatalf("Failed to setup host: %v", err)
+	}
+	t.Cleanup(func() { h.Close() })
+	ps, err := pubsub.NewGossipSub(ctx, h)
+	if err != nil {
+		t.Fatalf("Failed to setup pubsub: %v", err)
+	}
+	f, err := NewFeed(ctx, h, ps, announce, logging.Discard())
+	if err != nil {
+		t.Fatalf("NewFeed() error = %v", err)
+	}
+	return h, f
+}
+
+// waitForPeer waits until p has joined the topic as seen by f.
+func waitForPeer(t *testing.T, f *Feed, name string, p peer.ID) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		f.mu.Lock()
+		peers := f.topics[name].ListPeers()
+		f.mu.Unlock()
+		for _, id := range peers {
+			if id == p {
+				return
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("peer %s did not join topic '%s'", p, name)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestFeed_Announce(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	h1, f1 := newTestFeed(t, ctx, "team")
+	h2, f2 := newTestFeed(t, ctx, DefaultTopic)
+	if err := h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}); err != nil {
+		t.Fatalf("Failed to connect hosts: %v", err)
+	}
+	if got := f1.Topics(); len(got) != 2 || got[0] != DefaultTopic || got[1] != "team" {
+		t.Errorf("Topics() = %v, want [%s team]", got, DefaultTopic)
+	}
+	if err := f2.Subscribe("team"); err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	if got := f2.Topics(); len(got) != 2 || got[0] != DefaultTopic || got[1] != "team" {
+		t.Errorf("Topics() = %v, want [%s team]", got, DefaultTopic)
+	}
+	for _, topic := range []string{DefaultTopic, "team"} {
+		waitForPeer(t, f1, topic, h2.ID())
+		waitForPeer(t, f2, topic, h1.ID())
+	}
+
+	feed := f2.Announcements(ctx)
+	entry := file.Entry{Path: "docs/report.pdf", Size: 42, Hash: "abc"}
+	// Messages only reach a peer once the pubsub streams to it are open, so the
+	// file is announced until it arrives.
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	var got Announcement
+	for got.Name == "" {
+		if err := f1.Announce(ctx, entry); err != nil {
+			t.Fatalf("Announce() error = %v", err)
+		}
+		select {
+		case got = <-feed:
+		case <-ticker.C:
+		case <-ctx.Done():
+			t.Fatalf("Timed out waiting for the announcement")
+		}
+	}
+	want := Announcement{Topic: "team", Name: entry.Path, Hash: entry.Hash, Size: entry.Size, Owner: h1.ID()}
+	if got != want {
+		t.Errorf("announcement = %+v, want %+v", got, want)
+	}
+	// Announcements on other topics would arrive along with the one on the
+	// announce topic.
+	timeout := time.After(time.Second)
+	for done := false; !done; {
+		select {
+		case a := <-feed:
+			if a.Topic != "team" {
+				t.Errorf("announcement on '%s', want only '%s'", a.Topic, "team")
+			}
+		case <-timeout:
+			done = true
+		}
+	}
+	if recent := f2.Recent(); len(recent) == 0 {
+		t.Errorf("Recent() = %v, want the announcements", recent)
+	}
+	if len(f1.Recent()) != 0 {
+		t.Errorf("Recent() of the announcing node = %v, want none", f1.Recent())
+	}
+
+	if err := f2.Unsubscribe(DefaultTopic); err == nil {
+		t.Errorf("Unsubscribe() of the default topic succeeded")
+	}
+	if err := f1.Unsubscribe("team"); err == nil {
+		t.Errorf("Unsubscribe() of the announce topic succeeded")
+	}
+	if err := f2.Unsubscribe("team"); err != nil {
+		t.Errorf("Unsubscribe() error = %v", err)
+	}
+	if err := f2.Subscribe("team"); err != nil {
+		t.Errorf("Subscribe() again error = %v", err)
+	}
+}
@@ -1,9 +1,15 @@
 package file
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"time"
 )
 
 // ReadFile reads a file and returns its contents as a byte slice.
@@ -45,3 +51,170 @@ func ListFiles(dir string) ([]string, error) {
 
 	return files, nil
 }
+
+// TempPrefix marks partially written files and directories, which are skipped by Scan.
+const TempPrefix = ".p2pfs-tmp-"
+
+// Entry describes a file in a shared directory.
+type Entry struct {
+	// Path is relative to the shared directory and uses forward slashes.
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	// Hash is the hex-encoded SHA-256 of the file content.
+	Hash string `json:"hash"`
+}
+
+// Hash returns the hex-encoded SHA-256 of a file's content.
+func Hash(path string) (string, error) {
+	cleanPath := filepath.Clean(path)
+	f, err := os.Open(cleanPath)
+	if err != nil {
+		return "", fmt.Errorf("error opening file '%s': %w", cleanPath, err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("error hashing file '%s': %w", cleanPath, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Scan lists the files in dir with their size, modification time and hash.
+func Scan(dir string) ([]Entry, error) {
+	cleanDir := filepath.Clean(dir)
+	paths, err := ListFiles(cleanDir)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]Entry, 0, len(paths))
+	for _, path := range paths {
+		rel, err := filepath.Rel(cleanDir, path)
+		if err != nil {
+			return nil, fmt.Errorf("error resolving path '%s': %w", path, err)
+		}
+		rel = filepath.ToSlash(rel)
+		if IsTemp(rel) {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("error accessing file '%s': %w", path, err)
+		}
+		hash, err := Hash(path)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, Entry{
+			Path:    rel,
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+			Hash:    hash,
+		})
+	}
+	return entries, nil
+}
+
+// DirSize returns the total size of the files under dir, or 0 if dir does not exist.
+func DirSize(dir string) (int64, error) {
+	var total int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		total += info.Size()
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error measuring directory '%s': %w", dir, err)
+	}
+	return total, nil
+}
+
+// LocalPath resolves a slash-separated relative path inside dir, rejecting paths
+// that would escape it.
+func LocalPath(dir, rel string) (string, error) {
+	local := filepath.FromSlash(rel)
+	if !filepath.IsLocal(local) {
+		return "", fmt.Errorf("path '%s' escapes directory '%s'", rel, dir)
+	}
+	return filepath.Join(dir, local), nil
+}
+
+// WriteFileAtomic writes data to a temporary file next to path and renames it into
+// place, so readers never observe a partially written file. The modification time
+// is set to modTime unless it is zero.
+func WriteFileAtomic(path string, data []byte, modTime time.Time) error {
+	return SaveFile(path, data, Metadata{ModTime: modTime}, Policy{ModTime: true})
+}
+
+// SaveFile atomically writes data like WriteFileAtomic and restores the attributes
+// in md that the policy allows. Files are created with mode 0644 unless the mode is
+// restored.
+func SaveFile(path string, data []byte, md Metadata, policy Policy) error {
+	f, err := CreateAtomic(path)
+	if err != nil {
+		return err
+	}
+	defer f.Discard()
+
+	if _, err := f.Write(data); err != nil {
+		return fmt.Errorf("error writing to file '%s': %w", f.path, err)
+	}
+	return f.Commit(md, policy)
+}
+
+// AtomicFile is a file written next to the path it replaces, which only appears
+// at that path once it is committed.
+type AtomicFile struct {
+	*os.File
+	path string
+}
+
+// CreateAtomic creates a temporary file next to path, creating the directory if
+// needed. The caller writes to it and either commits it or discards it.
+func CreateAtomic(path string) (*AtomicFile, error) {
+	cleanPath := filepath.Clean(path)
+	if err := os.MkdirAll(filepath.Dir(cleanPath), os.ModePerm); err != nil {
+		return nil, fmt.Errorf("error creating directory for '%s': %w", cleanPath, err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(cleanPath), TempPrefix+"*")
+	if err != nil {
+		return nil, fmt.Errorf("error creating temporary file for '%s': %w", cleanPath, err)
+	}
+	return &AtomicFile{File: tmp, path: cleanPath}, nil
+}
+
+// Commit closes the file, restores the attributes in md that the policy allows
+// and renames it into place. Files get mode 0644 unless the mode is restored.
+func (f *AtomicFile) Commit(md Metadata, policy Policy) error {
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error writing to file '%s': %w", f.path, err)
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return fmt.Errorf("error setting permissions of '%s': %w", f.path, err)
+	}
+	if err := ApplyMetadata(f.Name(), md, policy); err != nil {
+		return fmt.Errorf("error restoring attributes of '%s': %w", f.path, err)
+	}
+	if err := os.Rename(f.Name(), f.path); err != nil {
+		return fmt.Errorf("error writing to file '%s': %w", f.path, err)
+	}
+	return nil
+}
+
+// Discard closes and removes the file unless it was committed. It is safe to
+// defer right after CreateAtomic.
+func (f *AtomicFile) Discard() {
+	_ = f.Close()
+	_ = os.Remove(f.Name())
+}
@@ -1,8 +1,11 @@
 package file
 
 import (
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestListFiles(t *testing.T) {
@@ -77,3 +80,73 @@ func TestWriteFile(t *testing.T) {
 		})
 	}
 }
+
+func TestScan(t *testing.T) {
+	dir := t.TempDir()
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := WriteFileAtomic(filepath.Join(dir, "sub", "a.txt"), []byte("hello"), modTime); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, TempPrefix+"partial"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := Scan(dir)
+	if err != nil {
+		t.Fatalf("Scan() error = %v", err)
+	}
+	want := []Entry{{
+		Path:    "sub/a.txt",
+		Size:    5,
+		ModTime: modTime,
+		Hash:    "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+	}}
+	if len(got) != 1 || got[0].Path != want[0].Path || got[0].Size != want[0].Size ||
+		!got[0].ModTime.Equal(want[0].ModTime) || got[0].Hash != want[0].Hash {
+		t.Errorf("Scan() got = %v, want %v", got, want)
+	}
+}
+
+func TestDirSize(t *testing.T) {
+	dir := t.TempDir()
+	if err := WriteFile(filepath.Join(dir, "a.txt"), []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFileAtomic(filepath.Join(dir, "sub", "b.txt"), []byte("world!"), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := DirSize(dir); err != nil || got != 11 {
+		t.Errorf("DirSize() = %d, %v; want 11", got, err)
+	}
+	if got, err := DirSize(filepath.Join(dir, "missing")); err != nil || got != 0 {
+		t.Errorf("DirSize() of a missing directory = %d, %v; want 0", got, err)
+	}
+}
+
+func TestLocalPath(t *testing.T) {
+	tests := []struct {
+		name    string
+		rel     string
+		want    string
+		wantErr bool
+	}{
+		{name: "file", rel: "a.txt", want: filepath.Join("shared", "a.txt")},
+		{name: "nested", rel: "sub/a.txt", want: filepath.Join("shared", "sub", "a.txt")},
+		{name: "parent", rel: "../a.txt", wantErr: true},
+		{name: "absolute", rel: "/etc/passwd", wantErr: true},
+		{name: "empty", rel: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := LocalPath("shared", tt.rel)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("LocalPath() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("LocalPath() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package file
+
+import (
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// xattrNamespace is the only extended attribute namespace transferred. The others
+// hold security labels, capabilities and ACLs, which a peer must not control.
+const xattrNamespace = "user."
+
+// transferableXattr reports whether an extended attribute may be sent or restored.
+func transferableXattr(name string) bool {
+	return strings.HasPrefix(name, xattrNamespace)
+}
+
+// Metadata holds the file attributes carried along with a file's content.
+type Metadata struct {
+	// Mode holds the permission bits.
+	Mode    fs.FileMode `json:"mode,omitempty"`
+	ModTime time.Time   `json:"mod_time"`
+	// Xattrs holds the extended attributes by name.
+	Xattrs map[string][]byte `json:"xattrs,omitempty"`
+}
+
+// Policy selects which attributes of a received file are restored.
+type Policy struct {
+	Mode    bool
+	ModTime bool
+	Xattrs  bool
+}
+
+// ReadMetadata returns the permission bits, modification time and user extended
+// attributes of a file. Extended attributes are left empty on file systems
+// that do not support them.
+func ReadMetadata(path string) (Metadata, error) {
+	cleanPath := filepath.Clean(path)
+	info, err := os.Stat(cleanPath)
+	if err != nil {
+		return Metadata{}, fmt.Errorf("error accessing file '%s': %w", cleanPath, err)
+	}
+	xattrs, err := listXattrs(cleanPath)
+	if err != nil {
+		return Metadata{}, fmt.Errorf("error reading extended attributes of '%s': %w", cleanPath, err)
+	}
+	return Metadata{Mode: info.Mode().Perm(), ModTime: info.ModTime(), Xattrs: xattrs}, nil
+}
+
+// ApplyMetadata restores the attributes in md that the policy allows. Zero values
+// in md are left alone, and extended attributes outside the user namespace are
+// dropped.
+func ApplyMetadata(path string, md Metadata, policy Policy) error {
+	cleanPath := filepath.Clean(path)
+	if policy.Xattrs {
+		for name, value := range md.Xattrs {
+			if !transferableXattr(name) {
+				slog.Debug("Dropping extended attribute outside the user namespace", "path", cleanPath, "name", name)
+				continue
+			}
+			if err := setXattr(cleanPath, name, value); err != nil {
+				return fmt.Errorf("error setting extended attribute '%s': %w", name, err)
+			}
+		}
+	}
+	if policy.Mode && md.Mode != 0 {
+		if err := os.Chmod(cleanPath, md.Mode.Perm()); err != nil {
+			return fmt.Errorf("error setting permissions: %w", err)
+		}
+	}
+	if policy.ModTime && !md.ModTime.IsZero() {
+		if err := os.Chtimes(cleanPath, md.ModTime, md.ModTime); err != nil {
+			return fmt.Errorf("error setting modification time: %w", err)
+		}
+	}
+	return nil
+}
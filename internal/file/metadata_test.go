@@ -0,0 +1,80 @@
+package file
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSaveFile(t *testing.T) {
+	modTime := time.Date(2023, 7, 8, 9, 10, 11, 0, time.UTC)
+	md := Metadata{Mode: 0755, ModTime: modTime}
+
+	tests := []struct {
+		name        string
+		policy      Policy
+		wantMode    os.FileMode
+		wantModTime bool
+	}{
+		{name: "restore all", policy: Policy{Mode: true, ModTime: true}, wantMode: 0755, wantModTime: true},
+		{name: "mode only", policy: Policy{Mode: true}, wantMode: 0755},
+		{name: "mtime only", policy: Policy{ModTime: true}, wantMode: 0644, wantModTime: true},
+		{name: "restore nothing", policy: Policy{}, wantMode: 0644},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "run.sh")
+			if err := SaveFile(path, []byte("#!/bin/sh"), md, tt.policy); err != nil {
+				t.Fatalf("SaveFile() error = %v", err)
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Perm() != tt.wantMode {
+				t.Errorf("mode = %v, want %v", info.Mode().Perm(), tt.wantMode)
+			}
+			if got := info.ModTime().Equal(modTime); got != tt.wantModTime {
+				t.Errorf("mtime = %v, restored %v, want restored %v", info.ModTime(), got, tt.wantModTime)
+			}
+		})
+	}
+}
+
+func TestReadMetadata_Xattrs(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	if err := os.WriteFile(src, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := setXattr(src, "user.origin", []byte("peer")); err != nil {
+		if errors.Is(err, errors.ErrUnsupported) {
+			t.Skipf("Extended attributes are not supported: %v", err)
+		}
+		t.Fatal(err)
+	}
+
+	md, err := ReadMetadata(src)
+	if err != nil {
+		t.Fatalf("ReadMetadata() error = %v", err)
+	}
+	if got := string(md.Xattrs["user.origin"]); got != "peer" {
+		t.Fatalf("ReadMetadata() xattr = %q, want %q", got, "peer")
+	}
+
+	for _, restore := range []bool{true, false} {
+		dest := filepath.Join(dir, "dest")
+		if err := SaveFile(dest, []byte("data"), md, Policy{Xattrs: restore}); err != nil {
+			t.Fatalf("SaveFile() error = %v", err)
+		}
+		got, err := ReadMetadata(dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := got.Xattrs["user.origin"]; ok != restore {
+			t.Errorf("Xattrs policy %v: xattr restored = %v", restore, ok)
+		}
+	}
+}
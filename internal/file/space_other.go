@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package file
+
+import "errors"
+
+// FreeSpace fails on platforms where free disk space cannot be determined.
+func FreeSpace(dir string) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,15 @@
+//go:build linux || darwin
+
+package file
+
+import "golang.org/x/sys/unix"
+
+// FreeSpace returns the disk space available to unprivileged users on the file
+// system holding dir.
+func FreeSpace(dir string) (int64, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
@@ -0,0 +1,276 @@
+package file
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// xattrRecordPrefix is the PAX record prefix used for extended attributes.
+const xattrRecordPrefix = "SCHILY.xattr."
+
+// ErrFileTooLarge is returned by ExtractTree for a file over the limit it was given.
+var ErrFileTooLarge = errors.New("file exceeds the size limit")
+
+// TreeLimits bounds the files ExtractTree writes.
+type TreeLimits struct {
+	// MaxFileSize caps the size of each file; 0 is unlimited.
+	MaxFileSize int64
+	// Reserve, if set, is called with the size of each file before it is written,
+	// and an error from it aborts the extraction.
+	Reserve func(size int64) error
+}
+
+// TreeStats summarizes a directory tree transfer.
+type TreeStats struct {
+	Files int
+	Dirs  int
+	Bytes int64
+}
+
+// IsTemp reports whether a slash-separated relative path is, or lies inside, a
+// partially written file or directory.
+func IsTemp(rel string) bool {
+	for _, part := range strings.Split(rel, "/") {
+		if strings.HasPrefix(part, TempPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteTree writes the directory tree rooted at dir to w as a tar archive. Paths are
+// relative to dir, and empty directories, permissions and modification times are
+// kept. Symbolic links and other special files are skipped.
+func WriteTree(w io.Writer, dir string) (TreeStats, error) {
+	var stats TreeStats
+	cleanDir := filepath.Clean(dir)
+	tw := tar.NewWriter(w)
+
+	err := filepath.WalkDir(cleanDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return fmt.Errorf("error accessing file '%s': %w", path, err)
+		}
+		if strings.HasPrefix(d.Name(), TempPrefix) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.IsDir() && !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return fmt.Errorf("error accessing file '%s': %w", path, err)
+		}
+		rel, err := filepath.Rel(cleanDir, path)
+		if err != nil {
+			return fmt.Errorf("error resolving path '%s': %w", path, err)
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return fmt.Errorf("error describing file '%s': %w", path, err)
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if d.IsDir() {
+			hdr.Name += "/"
+		}
+		// PAX headers keep sub-second modification times and extended attributes.
+		hdr.Format = tar.FormatPAX
+		hdr.Uname, hdr.Gname = "", ""
+		xattrs, err := listXattrs(path)
+		if err != nil {
+			return fmt.Errorf("error reading extended attributes of '%s': %w", path, err)
+		}
+		for name, value := range xattrs {
+			if hdr.PAXRecords == nil {
+				hdr.PAXRecords = make(map[string]string)
+			}
+			hdr.PAXRecords[xattrRecordPrefix+name] = string(value)
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("error writing header for '%s': %w", path, err)
+		}
+
+		if d.IsDir() {
+			if rel != "." {
+				stats.Dirs++
+			}
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("error opening file '%s': %w", path, err)
+		}
+		defer f.Close()
+		n, err := io.Copy(tw, f)
+		if err != nil {
+			return fmt.Errorf("error writing file '%s': %w", path, err)
+		}
+		stats.Files++
+		stats.Bytes += n
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+	if err := tw.Close(); err != nil {
+		return stats, fmt.Errorf("error finishing archive: %w", err)
+	}
+	return stats, nil
+}
+
+// ExtractTree reads a tar archive written by WriteTree and creates the tree at dest,
+// restoring the attributes the policy allows. The tree is extracted next to dest and
+// renamed into place, replacing any existing copy, so dest holds either the old tree
+// or the complete new one. Files are checked against limits by the size their entry
+// announces, which the archive reader holds them to.
+func ExtractTree(r io.Reader, dest string, policy Policy, limits TreeLimits) (TreeStats, error) {
+	var stats TreeStats
+	cleanDest := filepath.Clean(dest)
+	parent := filepath.Dir(cleanDest)
+	if err := os.MkdirAll(parent, os.ModePerm); err != nil {
+		return stats, fmt.Errorf("error creating directory '%s': %w", parent, err)
+	}
+	tmp, err := os.MkdirTemp(parent, TempPrefix+"*")
+	if err != nil {
+		return stats, fmt.Errorf("error creating temporary directory for '%s': %w", cleanDest, err)
+	}
+	defer os.RemoveAll(tmp)
+
+	// Directory attributes are applied last, deepest first, since creating
+	// their contents would change them.
+	type dirAttrs struct {
+		path string
+		md   Metadata
+	}
+	var dirs []dirAttrs
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return stats, fmt.Errorf("error reading archive: %w", err)
+		}
+
+		name := filepath.FromSlash(strings.TrimSuffix(hdr.Name, "/"))
+		if !filepath.IsLocal(name) {
+			return stats, fmt.Errorf("archive entry '%s' escapes directory '%s'", hdr.Name, cleanDest)
+		}
+		target := filepath.Join(tmp, name)
+		md := headerMetadata(hdr)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return stats, fmt.Errorf("error creating directory '%s': %w", hdr.Name, err)
+			}
+			dirs = append(dirs, dirAttrs{path: target, md: md})
+			if name != "." {
+				stats.Dirs++
+			}
+		case tar.TypeReg:
+			if limits.MaxFileSize > 0 && hdr.Size > limits.MaxFileSize {
+				return stats, fmt.Errorf("error extracting '%s': %w: %d bytes, files are limited to %d", hdr.Name, ErrFileTooLarge, hdr.Size, limits.MaxFileSize)
+			}
+			if limits.Reserve != nil {
+				if err := limits.Reserve(hdr.Size); err != nil {
+					return stats, fmt.Errorf("error extracting '%s': %w", hdr.Name, err)
+				}
+			}
+			n, err := extractFile(tr, target, md, policy)
+			if err != nil {
+				return stats, fmt.Errorf("error extracting '%s': %w", hdr.Name, err)
+			}
+			stats.Files++
+			stats.Bytes += n
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chmod(dirs[i].path, 0755); err != nil {
+			return stats, fmt.Errorf("error setting permissions of '%s': %w", dirs[i].path, err)
+		}
+		if err := ApplyMetadata(dirs[i].path, dirs[i].md, policy); err != nil {
+			return stats, fmt.Errorf("error restoring attributes of '%s': %w", dirs[i].path, err)
+		}
+	}
+	if err := replaceTree(tmp, cleanDest); err != nil {
+		return stats, err
+	}
+	return stats, nil
+}
+
+// replaceTree renames the tree at src to dest. An existing dest is moved aside
+// first and restored if the rename fails, then removed.
+func replaceTree(src, dest string) error {
+	if _, err := os.Lstat(dest); errors.Is(err, fs.ErrNotExist) {
+		if err := os.Rename(src, dest); err != nil {
+			return fmt.Errorf("error moving tree into '%s': %w", dest, err)
+		}
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error accessing '%s': %w", dest, err)
+	}
+
+	old, err := os.MkdirTemp(filepath.Dir(dest), TempPrefix+"*")
+	if err != nil {
+		return fmt.Errorf("error creating temporary directory for '%s': %w", dest, err)
+	}
+	defer os.RemoveAll(old)
+	aside := filepath.Join(old, filepath.Base(dest))
+	if err := os.Rename(dest, aside); err != nil {
+		return fmt.Errorf("error replacing '%s': %w", dest, err)
+	}
+	if err := os.Rename(src, dest); err != nil {
+		if rerr := os.Rename(aside, dest); rerr != nil {
+			return fmt.Errorf("error moving tree into '%s': %w (the previous copy is lost: %v)", dest, err, rerr)
+		}
+		return fmt.Errorf("error moving tree into '%s': %w", dest, err)
+	}
+	return nil
+}
+
+// extractFile writes one regular file of an archive.
+func extractFile(r io.Reader, path string, md Metadata, policy Policy) (int64, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return 0, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		return n, err
+	}
+	if err := f.Close(); err != nil {
+		return n, err
+	}
+	return n, ApplyMetadata(path, md, policy)
+}
+
+// headerMetadata extracts the attributes of an archive entry.
+func headerMetadata(hdr *tar.Header) Metadata {
+	md := Metadata{Mode: fs.FileMode(hdr.Mode).Perm(), ModTime: hdr.ModTime}
+	for key, value := range hdr.PAXRecords {
+		if name, ok := strings.CutPrefix(key, xattrRecordPrefix); ok {
+			if md.Xattrs == nil {
+				md.Xattrs = make(map[string][]byte)
+			}
+			md.Xattrs[name] = []byte(value)
+		}
+	}
+	return md
+}
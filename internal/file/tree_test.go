@@ -0,0 +1,145 @@
+package file
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWriteTree_ExtractTree(t *testing.T) {
+	src := t.TempDir()
+	modTime := time.Date(2024, 5, 6, 7, 8, 9, 123456000, time.UTC)
+	files := []struct {
+		path string
+		data string
+		mode fs.FileMode
+	}{
+		{path: "a.txt", data: "a", mode: 0644},
+		{path: "bin/run.sh", data: "#!/bin/sh", mode: 0755},
+		{path: "deep/er/b.txt", data: "b", mode: 0600},
+	}
+	for _, f := range files {
+		path := filepath.Join(src, filepath.FromSlash(f.path))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(f.data), f.mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(src, "empty"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filepath.Join(src, "empty"), modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	sent, err := WriteTree(&buf, src)
+	if err != nil {
+		t.Fatalf("WriteTree() error = %v", err)
+	}
+	dest := filepath.Join(t.TempDir(), "copy")
+	received, err := ExtractTree(&buf, dest, Policy{Mode: true, ModTime: true}, TreeLimits{})
+	if err != nil {
+		t.Fatalf("ExtractTree() error = %v", err)
+	}
+	want := TreeStats{Files: 3, Dirs: 4, Bytes: 11}
+	if sent != want || received != want {
+		t.Errorf("stats = %+v sent, %+v received, want %+v", sent, received, want)
+	}
+
+	for _, f := range files {
+		path := filepath.Join(dest, filepath.FromSlash(f.path))
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("Stat() error = %v", err)
+		}
+		data, _ := os.ReadFile(path)
+		if string(data) != f.data || info.Mode().Perm() != f.mode || !info.ModTime().Equal(modTime) {
+			t.Errorf("%s: got %q %v %v, want %q %v %v", f.path, data, info.Mode().Perm(), info.ModTime(), f.data, f.mode, modTime)
+		}
+	}
+	info, err := os.Stat(filepath.Join(dest, "empty"))
+	if err != nil || !info.IsDir() || info.Mode().Perm() != 0750 || !info.ModTime().Equal(modTime) {
+		t.Errorf("empty directory not preserved: %v, %v", info, err)
+	}
+
+	// Extracting again replaces the existing tree rather than merging into it.
+	if err := os.Remove(filepath.Join(src, "a.txt")); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if _, err := WriteTree(&buf, src); err != nil {
+		t.Fatalf("WriteTree() error = %v", err)
+	}
+	if _, err := ExtractTree(&buf, dest, Policy{}, TreeLimits{}); err != nil {
+		t.Fatalf("ExtractTree() over an existing tree error = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "a.txt")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("replaced tree kept a.txt: %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dest, "bin", "run.sh")); err != nil || string(data) != "#!/bin/sh" {
+		t.Errorf("replaced tree bin/run.sh = %q, %v", data, err)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(dest)); len(entries) != 1 {
+		t.Errorf("ExtractTree() left %v behind", entries)
+	}
+}
+
+func TestExtractTree_Invalid(t *testing.T) {
+	archive := func(name string, truncate bool) *bytes.Buffer {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: 4, Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if truncate {
+			return &buf
+		}
+		if _, err := tw.Write([]byte("data")); err != nil {
+			t.Fatal(err)
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return &buf
+	}
+
+	errReserve := errors.New("no space")
+	tests := []struct {
+		name    string
+		archive *bytes.Buffer
+		limits  TreeLimits
+		wantErr error
+	}{
+		{name: "escaping path", archive: archive("../evil.txt", false)},
+		{name: "truncated file", archive: archive("a.txt", true)},
+		{name: "file too large", archive: archive("a.txt", false), limits: TreeLimits{MaxFileSize: 3}, wantErr: ErrFileTooLarge},
+		{name: "reservation refused", archive: archive("a.txt", false), limits: TreeLimits{Reserve: func(int64) error { return errReserve }}, wantErr: errReserve},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parent := t.TempDir()
+			_, err := ExtractTree(tt.archive, filepath.Join(parent, "dest"), Policy{}, tt.limits)
+			if err == nil {
+				t.Fatalf("ExtractTree() succeeded, want error")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ExtractTree() error = %v, want %v", err, tt.wantErr)
+			}
+			// Nothing, not even the temporary directory, is left behind.
+			if entries, _ := os.ReadDir(parent); len(entries) != 0 {
+				t.Errorf("ExtractTree() left %v behind", entries)
+			}
+		})
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux && !darwin
+
+package file
+
+import "errors"
+
+// listXattrs reports no extended attributes on platforms without support.
+func listXattrs(path string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+// setXattr fails on platforms without extended attribute support.
+func setXattr(path, name string, value []byte) error {
+	return errors.ErrUnsupported
+}
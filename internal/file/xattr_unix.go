@@ -0,0 +1,52 @@
+//go:build linux || darwin
+
+package file
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+
+	"golang.org/x/sys/unix"
+)
+
+// listXattrs reads the user extended attributes of a file.
+func listXattrs(path string) (map[string][]byte, error) {
+	size, err := unix.Listxattr(path, nil)
+	if errors.Is(err, unix.ENOTSUP) {
+		return nil, nil
+	}
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Listxattr(path, buf); err != nil {
+		return nil, err
+	}
+
+	xattrs := make(map[string][]byte)
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		if !transferableXattr(string(name)) {
+			slog.Debug("Skipping extended attribute outside the user namespace", "path", path, "name", string(name))
+			continue
+		}
+		n, err := unix.Getxattr(path, string(name), nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, n)
+		if n, err = unix.Getxattr(path, string(name), value); err != nil {
+			return nil, err
+		}
+		xattrs[string(name)] = value[:n]
+	}
+	return xattrs, nil
+}
+
+// setXattr sets an extended attribute of a file.
+func setXattr(path, name string, value []byte) error {
+	return unix.Setxattr(path, name, value, 0)
+}
@@ -0,0 +1,40 @@
+//go:build linux || darwin
+
+package file
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestApplyMetadata_XattrNamespaces(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run.sh")
+	if err := os.WriteFile(path, []byte("#!/bin/sh"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	md := Metadata{Xattrs: map[string][]byte{
+		"user.origin": []byte("peer"),
+		// A file capability granting every permitted capability.
+		"security.capability": {0, 0, 0, 2, 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0},
+		"trusted.note":        []byte("x"),
+	}}
+	if err := ApplyMetadata(path, md, Policy{Xattrs: true}); err != nil {
+		if errors.Is(err, unix.ENOTSUP) {
+			t.Skipf("Extended attributes are not supported: %v", err)
+		}
+		t.Fatalf("ApplyMetadata() error = %v", err)
+	}
+
+	if _, err := unix.Getxattr(path, "user.origin", nil); err != nil {
+		t.Errorf("user.origin was not applied: %v", err)
+	}
+	for _, name := range []string{"security.capability", "trusted.note"} {
+		if _, err := unix.Getxattr(path, name, nil); err == nil {
+			t.Errorf("%s was applied", name)
+		}
+	}
+}
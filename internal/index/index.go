@@ -0,0 +1,474 @@
+package index
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/file"
+	bolt "go.etcd.io/bbolt"
+)
+
+// indexFile is the name of the database in the data directory holding the index.
+const indexFile = "index.db"
+
+// filesBucket maps relative paths to their JSON-encoded records.
+var filesBucket = []byte("files")
+
+// eventBufferSize is the number of events buffered for each subscriber
+// before further events are dropped.
+const eventBufferSize = 64
+
+// EventType identifies the kind of change reported by an Event.
+type EventType string
+
+const (
+	// FileAdded is emitted when a file appears in the shared directory.
+	FileAdded EventType = "added"
+	// FileModified is emitted when the content of a file changes.
+	FileModified EventType = "modified"
+	// FileRemoved is emitted when a file is deleted or moved out of the shared directory.
+	FileRemoved EventType = "removed"
+	// FileRenamed is emitted when a file is moved within the shared directory.
+	FileRenamed EventType = "renamed"
+)
+
+// Event describes a change in the shared directory. For removals Entry holds the
+// last indexed state of the file; for renames OldPath holds its previous path.
+type Event struct {
+	Type    EventType  `json:"type"`
+	Entry   file.Entry `json:"entry"`
+	OldPath string     `json:"old_path,omitempty"`
+}
+
+// record is the indexed state of a file. The inode is only meaningful locally and
+// lets a moved file keep its hash without being read again.
+type record struct {
+	file.Entry
+	Inode uint64 `json:"inode,omitempty"`
+}
+
+// Index keeps the size, modification time, inode and hash of every file in the
+// shared directory up to date by watching it for changes. It is persisted in a
+// bbolt database and cached in memory.
+type Index struct {
+	dir      string
+	db       *bolt.DB
+	debounce time.Duration
+	logger   *slog.Logger
+
+	mu          sync.Mutex
+	entries     map[string]record
+	watcher     *fsnotify.Watcher
+	subscribers map[chan Event]struct{}
+}
+
+// NewIndex opens the index of sharedDir persisted in dataDir. Changes are applied
+// once no further change has been seen for the debounce duration. Errors while
+// watching the directory are logged to logger.
+func NewIndex(sharedDir, dataDir string, debounce time.Duration, logger *slog.Logger) (*Index, error) {
+	path := filepath.Join(dataDir, indexFile)
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("error opening index '%s': %w", path, err)
+	}
+
+	idx := &Index{
+		dir:         filepath.Clean(sharedDir),
+		db:          db,
+		debounce:    debounce,
+		logger:      logger,
+		entries:     make(map[string]record),
+		subscribers: make(map[chan Event]struct{}),
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(filesBucket)
+		if err != nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var r record
+			if err := json.Unmarshal(v, &r); err != nil {
+				return fmt.Errorf("invalid record for '%s': %w", k, err)
+			}
+			idx.entries[r.Path] = r
+			return nil
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error loading index '%s': %w", path, err)
+	}
+	return idx, nil
+}
+
+// Close closes the index database.
+func (idx *Index) Close() error {
+	if err := idx.db.Close(); err != nil {
+		return fmt.Errorf("error closing index: %w", err)
+	}
+	return nil
+}
+
+// Start watches the shared directory, reconciles the index with its contents and
+// keeps it up to date until ctx is done.
+func (idx *Index) Start(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("error creating watcher: %w", err)
+	}
+	idx.mu.Lock()
+	idx.watcher = watcher
+	idx.mu.Unlock()
+
+	// Watch before reconciling so no change is missed in between.
+	if err := idx.Refresh("."); err != nil {
+		watcher.Close()
+		return err
+	}
+	go idx.watch(ctx)
+	return nil
+}
+
+// Entries returns a snapshot of the indexed files sorted by path.
+func (idx *Index) Entries() []file.Entry {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	entries := make([]file.Entry, 0, len(idx.entries))
+	for _, r := range idx.entries {
+		entries = append(entries, r.Entry)
+	}
+	sortEntries(entries)
+	return entries
+}
+
+// Search returns the indexed files whose path contains query, ignoring case.
+func (idx *Index) Search(query string) []file.Entry {
+	query = strings.ToLower(query)
+
+	var entries []file.Entry
+	for _, e := range idx.Entries() {
+		if strings.Contains(strings.ToLower(e.Path), query) {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// Lookup returns an indexed file with the given content hash.
+func (idx *Index) Lookup(hash string) (file.Entry, bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	for _, r := range idx.entries {
+		if r.Hash == hash {
+			return r.Entry, true
+		}
+	}
+	return file.Entry{}, false
+}
+
+// Duplicates returns the groups of indexed files that have the same content.
+func (idx *Index) Duplicates() [][]file.Entry {
+	byHash := make(map[string][]file.Entry)
+	for _, e := range idx.Entries() {
+		byHash[e.Hash] = append(byHash[e.Hash], e)
+	}
+
+	var groups [][]file.Entry
+	for _, entries := range byHash {
+		if len(entries) > 1 {
+			groups = append(groups, entries)
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i][0].Path < groups[j][0].Path })
+	return groups
+}
+
+// Events returns a channel of changes to the index. The channel is closed when ctx is done.
+func (idx *Index) Events(ctx context.Context) <-chan Event {
+	ch := make(chan Event, eventBufferSize)
+
+	idx.mu.Lock()
+	idx.subscribers[ch] = struct{}{}
+	idx.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		idx.mu.Lock()
+		delete(idx.subscribers, ch)
+		close(ch)
+		idx.mu.Unlock()
+	}()
+
+	return ch
+}
+
+// Refresh reconciles the index with the files under the given slash-separated
+// paths, which may name files or directories, and publishes the changes. Files are
+// only read again when their size or modification time changed.
+func (idx *Index) Refresh(paths ...string) error {
+	idx.mu.Lock()
+	events, err := idx.refreshLocked(paths)
+	idx.mu.Unlock()
+
+	for _, ev := range events {
+		idx.publish(ev)
+	}
+	return err
+}
+
+// refreshLocked compares the index entries under paths with the files on disk and
+// saves the differences.
+func (idx *Index) refreshLocked(paths []string) ([]Event, error) {
+	onDisk := make(map[string]fs.FileInfo)
+	for _, rel := range paths {
+		if err := idx.scanLocked(rel, onDisk); err != nil {
+			return nil, err
+		}
+	}
+
+	var added, modified, removed []file.Entry
+	updated := make(map[string]record)
+	moved := make(map[uint64]record)
+	for p, r := range idx.entries {
+		if _, ok := onDisk[p]; ok || !withinAny(p, paths) {
+			continue
+		}
+		delete(idx.entries, p)
+		removed = append(removed, r.Entry)
+		if r.Inode != 0 {
+			moved[r.Inode] = r
+		}
+	}
+
+	for p, info := range onDisk {
+		old, known := idx.entries[p]
+		r := record{
+			Entry: file.Entry{Path: p, Size: info.Size(), ModTime: info.ModTime()},
+			Inode: inode(info),
+		}
+		switch prev, ok := moved[r.Inode]; {
+		case known && sameFile(old, r):
+			if old.Inode != r.Inode {
+				r.Hash = old.Hash
+				idx.entries[p] = r
+				updated[p] = r
+			}
+			continue
+		case !known && ok && r.Inode != 0 && sameFile(prev, r):
+			r.Hash = prev.Hash
+		default:
+			hash, err := file.Hash(filepath.Join(idx.dir, filepath.FromSlash(p)))
+			if err != nil {
+				// The file changed again while being hashed; the next event refreshes it.
+				idx.logger.Debug("Error indexing file", "name", p, "error", err)
+				continue
+			}
+			r.Hash = hash
+		}
+
+		idx.entries[p] = r
+		updated[p] = r
+		switch {
+		case !known:
+			added = append(added, r.Entry)
+		case old.Hash != r.Hash:
+			modified = append(modified, r.Entry)
+		}
+	}
+
+	events := pairRenames(added, removed)
+	for _, e := range modified {
+		events = append(events, Event{Type: FileModified, Entry: e})
+	}
+	if len(updated) == 0 && len(removed) == 0 {
+		return events, nil
+	}
+	return events, idx.saveLocked(updated, removed)
+}
+
+// scanLocked adds the regular files under rel to onDisk and watches its directories.
+func (idx *Index) scanLocked(rel string, onDisk map[string]fs.FileInfo) error {
+	root := filepath.Join(idx.dir, filepath.FromSlash(rel))
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if strings.HasPrefix(d.Name(), file.TempPrefix) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			if idx.watcher != nil {
+				if err := idx.watcher.Add(path); err != nil {
+					return fmt.Errorf("error watching directory '%s': %w", path, err)
+				}
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		onDisk[idx.relPath(path)] = info
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error scanning '%s': %w", root, err)
+	}
+	return nil
+}
+
+// watch collects filesystem events and refreshes the changed paths once they settle.
+func (idx *Index) watch(ctx context.Context) {
+	defer idx.watcher.Close()
+
+	timer := time.NewTimer(idx.debounce)
+	timer.Stop()
+	pending := make(map[string]struct{})
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev, ok := <-idx.watcher.Events:
+			if !ok {
+				return
+			}
+			rel := idx.relPath(ev.Name)
+			if file.IsTemp(rel) {
+				continue
+			}
+			pending[rel] = struct{}{}
+			timer.Reset(idx.debounce)
+		case err, ok := <-idx.watcher.Errors:
+			if !ok {
+				return
+			}
+			idx.logger.Error("Error watching shared directory", "error", err)
+		case <-timer.C:
+			paths := make([]string, 0, len(pending))
+			for p := range pending {
+				paths = append(paths, p)
+			}
+			pending = make(map[string]struct{})
+			if err := idx.Refresh(paths...); err != nil {
+				idx.logger.Error("Error updating index", "error", err)
+			}
+		}
+	}
+}
+
+// publish delivers an event to all subscribers without blocking.
+func (idx *Index) publish(ev Event) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	for ch := range idx.subscribers {
+		select {
+		case ch <- ev:
+		default:
+			idx.logger.Warn("Dropping event: subscriber is not keeping up", "type", ev.Type, "name", ev.Entry.Path)
+		}
+	}
+}
+
+// saveLocked writes the updated records and deletes the removed ones.
+func (idx *Index) saveLocked(updated map[string]record, removed []file.Entry) error {
+	err := idx.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(filesBucket)
+		for _, e := range removed {
+			if err := b.Delete([]byte(e.Path)); err != nil {
+				return err
+			}
+		}
+		for p, r := range updated {
+			data, err := json.Marshal(r)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(p), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error saving index: %w", err)
+	}
+	return nil
+}
+
+// relPath converts a path inside the shared directory to a slash-separated relative path.
+func (idx *Index) relPath(path string) string {
+	rel, err := filepath.Rel(idx.dir, path)
+	if err != nil {
+		return filepath.ToSlash(path)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// withinAny reports whether the relative path p is one of dirs or lies inside one.
+func withinAny(p string, dirs []string) bool {
+	for _, dir := range dirs {
+		if dir == "." || p == dir || strings.HasPrefix(p, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// sameFile reports whether a file is unchanged since it was indexed.
+func sameFile(indexed, current record) bool {
+	return indexed.Size == current.Size && indexed.ModTime.Equal(current.ModTime)
+}
+
+// sortEntries sorts entries by path.
+func sortEntries(entries []file.Entry) {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+}
+
+// pairRenames turns a removal and an addition of the same content into a rename.
+func pairRenames(added, removed []file.Entry) []Event {
+	var events []Event
+	byHash := make(map[string][]file.Entry)
+	for _, e := range removed {
+		byHash[e.Hash] = append(byHash[e.Hash], e)
+	}
+	for _, e := range added {
+		if olds := byHash[e.Hash]; len(olds) > 0 {
+			byHash[e.Hash] = olds[1:]
+			events = append(events, Event{Type: FileRenamed, Entry: e, OldPath: olds[0].Path})
+			continue
+		}
+		events = append(events, Event{Type: FileAdded, Entry: e})
+	}
+	for _, olds := range byHash {
+		for _, e := range olds {
+			events = append(events, Event{Type: FileRemoved, Entry: e})
+		}
+	}
+	return events
+}
@@ -0,0 +1,202 @@
+package index
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/file"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/logging"
+)
+
+// waitForEvent reads events until one of the given type arrives.
+func waitForEvent(t *testing.T, events <-chan Event, typ EventType) Event {
+	t.Helper()
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				t.Fatalf("Event channel closed while waiting for %s event", typ)
+			}
+			if ev.Type == typ {
+				return ev
+			}
+		case <-timeout:
+			t.Fatalf("Timed out waiting for %s event", typ)
+		}
+	}
+}
+
+func TestIndex_Watch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "existing.txt"), []byte("existing"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	idx, err := NewIndex(dir, t.TempDir(), 50*time.Millisecond, logging.Discard())
+	if err != nil {
+		t.Fatalf("NewIndex() error = %v", err)
+	}
+	defer idx.Close()
+	if err := idx.Start(ctx); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	if got := idx.Entries(); len(got) != 1 || got[0].Path != "existing.txt" {
+		t.Fatalf("Entries() = %+v, want existing.txt", got)
+	}
+	events := idx.Events(ctx)
+
+	// Writes in a new subdirectory are picked up once the subdirectory is watched.
+	if err := os.MkdirAll(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "sub", "a.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if ev := waitForEvent(t, events, FileAdded); ev.Entry.Path != "sub/a.txt" || ev.Entry.Size != 5 {
+		t.Errorf("added event = %+v, want sub/a.txt", ev)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "sub", "a.txt"), []byte("hello, world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if ev := waitForEvent(t, events, FileModified); ev.Entry.Path != "sub/a.txt" || ev.Entry.Size != 12 {
+		t.Errorf("modified event = %+v, want sub/a.txt", ev)
+	}
+
+	if err := os.Rename(filepath.Join(dir, "sub", "a.txt"), filepath.Join(dir, "b.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if ev := waitForEvent(t, events, FileRenamed); ev.Entry.Path != "b.txt" || ev.OldPath != "sub/a.txt" {
+		t.Errorf("renamed event = %+v, want sub/a.txt -> b.txt", ev)
+	}
+
+	if err := os.Remove(filepath.Join(dir, "existing.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if ev := waitForEvent(t, events, FileRemoved); ev.Entry.Path != "existing.txt" {
+		t.Errorf("removed event = %+v, want existing.txt", ev)
+	}
+	if got := idx.Entries(); len(got) != 1 || got[0].Path != "b.txt" {
+		t.Errorf("Entries() = %+v, want b.txt", got)
+	}
+}
+
+func TestIndex_Reconcile(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir := t.TempDir()
+	dataDir := t.TempDir()
+	write := func(name, content string) {
+		t.Helper()
+		if err := file.WriteFileAtomic(filepath.Join(dir, name), []byte(content), time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("kept.txt", "kept")
+	write("removed.txt", "removed")
+
+	idx, err := NewIndex(dir, dataDir, time.Hour, logging.Discard())
+	if err != nil {
+		t.Fatalf("NewIndex() error = %v", err)
+	}
+	if err := idx.Refresh("."); err != nil {
+		t.Fatalf("Refresh() error = %v", err)
+	}
+
+	if err := idx.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	// Changes made while the node is down are found when the saved index is reloaded.
+	if err := os.Remove(filepath.Join(dir, "removed.txt")); err != nil {
+		t.Fatal(err)
+	}
+	write("added.txt", "added")
+
+	idx, err = NewIndex(dir, dataDir, time.Hour, logging.Discard())
+	if err != nil {
+		t.Fatalf("NewIndex() error = %v", err)
+	}
+	defer idx.Close()
+	if got := idx.Entries(); len(got) != 2 {
+		t.Fatalf("Entries() after reload = %+v, want the 2 saved files", got)
+	}
+	events := idx.Events(ctx)
+	if err := idx.Start(ctx); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+
+	got := map[EventType]string{}
+	for i := 0; i < 2; i++ {
+		select {
+		case ev := <-events:
+			got[ev.Type] = ev.Entry.Path
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for reconcile events, got %v", got)
+		}
+	}
+	want := map[EventType]string{FileAdded: "added.txt", FileRemoved: "removed.txt"}
+	if len(got) != len(want) || got[FileAdded] != want[FileAdded] || got[FileRemoved] != want[FileRemoved] {
+		t.Errorf("reconcile events = %v, want %v", got, want)
+	}
+}
+
+func TestIndex_Queries(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"docs/Report.txt": "report",
+		"docs/copy.txt":   "report",
+		"notes.md":        "notes",
+	} {
+		if err := file.WriteFileAtomic(filepath.Join(dir, name), []byte(content), time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	idx, err := NewIndex(dir, t.TempDir(), time.Hour, logging.Discard())
+	if err != nil {
+		t.Fatalf("NewIndex() error = %v", err)
+	}
+	defer idx.Close()
+	if err := idx.Refresh("."); err != nil {
+		t.Fatalf("Refresh() error = %v", err)
+	}
+
+	paths := func(entries []file.Entry) []string {
+		var out []string
+		for _, e := range entries {
+			out = append(out, e.Path)
+		}
+		return out
+	}
+	if got, want := paths(idx.Search("REPORT")), []string{"docs/Report.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Search() = %v, want %v", got, want)
+	}
+	groups := idx.Duplicates()
+	if len(groups) != 1 || !reflect.DeepEqual(paths(groups[0]), []string{"docs/Report.txt", "docs/copy.txt"}) {
+		t.Errorf("Duplicates() = %v, want the two reports", groups)
+	}
+	notes := idx.Search("notes")[0]
+	if got, ok := idx.Lookup(notes.Hash); !ok || got.Path != "notes.md" {
+		t.Errorf("Lookup() = %v, %v, want notes.md", got, ok)
+	}
+
+	// A moved file keeps its inode and is reported as renamed.
+	events := idx.Events(context.Background())
+	if err := os.Rename(filepath.Join(dir, "notes.md"), filepath.Join(dir, "docs", "notes.md")); err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.Refresh("notes.md", "docs/notes.md"); err != nil {
+		t.Fatalf("Refresh() error = %v", err)
+	}
+	if ev := waitForEvent(t, events, FileRenamed); ev.OldPath != "notes.md" || ev.Entry.Hash != notes.Hash {
+		t.Errorf("renamed event = %+v, want notes.md -> docs/notes.md", ev)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package index
+
+import "io/fs"
+
+// inode returns 0 on platforms without inode numbers, which disables
+// detecting moved files without rehashing them.
+func inode(info fs.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,58 @@
+// Package logging builds the node's structured diagnostic logger and the
+// attributes the packages attach to their records.
+package logging
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/saurabhSPatel/p2p-file-sharing/config"
+)
+
+// Keys of the attributes shared across packages.
+const (
+	// PeerKey identifies the remote peer a record is about.
+	PeerKey = "peer"
+	// TransferKey identifies a file transfer. Uploads carry it in their header, so
+	// both peers log the same ID.
+	TransferKey = "transfer"
+)
+
+// New creates a logger writing to w at the configured level, as text lines or as
+// JSON objects.
+func New(w io.Writer, cfg config.LogConfig) (*slog.Logger, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.Level)); err != nil {
+		return nil, err
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	if cfg.Format == "json" {
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	}
+	return slog.New(slog.NewTextHandler(w, opts)), nil
+}
+
+// Discard returns a logger that drops every record.
+func Discard() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.LevelError + 1}))
+}
+
+// Peer returns the attribute identifying a remote peer.
+func Peer(p peer.ID) slog.Attr {
+	return slog.String(PeerKey, p.String())
+}
+
+// Transfer returns the attribute identifying a transfer.
+func Transfer(id string) slog.Attr {
+	return slog.String(TransferKey, id)
+}
+
+// NewTransferID returns a random identifier for a transfer.
+func NewTransferID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,63 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/saurabhSPatel/p2p-file-sharing/config"
+)
+
+func TestNew(t *testing.T) {
+	p, err := peer.Decode("12D3KooWGzxzKZYveHXtpG6AsrUJBcWxHBFS2HsEoGTxrMLvKXtf")
+	if err != nil {
+		t.Fatalf("Failed to decode peer ID: %v", err)
+	}
+
+	var buf bytes.Buffer
+	logger, err := New(&buf, config.LogConfig{Level: "info", Format: "json"})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	logger.Debug("Dropped")
+	logger.Info("Received file", Peer(p), Transfer("0123456789abcdef"))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("New() logged %d records, want 1: %q", len(lines), buf.String())
+	}
+	var record map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatalf("Record is not JSON: %v", err)
+	}
+	if record["msg"] != "Received file" || record[PeerKey] != p.String() || record[TransferKey] != "0123456789abcdef" {
+		t.Errorf("New() record = %v", record)
+	}
+}
+
+func TestNew_Text(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, config.LogConfig{Level: "debug", Format: "text"})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	logger.Debug("Connected", Transfer("42"))
+	if got := buf.String(); !strings.Contains(got, "level=DEBUG") || !strings.Contains(got, "transfer=42") {
+		t.Errorf("New() record = %q", got)
+	}
+}
+
+func TestNew_UnknownLevel(t *testing.T) {
+	if _, err := New(&bytes.Buffer{}, config.LogConfig{Level: "verbose"}); err == nil {
+		t.Error("New() error = nil, want an error for an unknown level")
+	}
+}
+
+func TestNewTransferID(t *testing.T) {
+	a, b := NewTransferID(), NewTransferID()
+	if len(a) != 16 || a == b {
+		t.Errorf("NewTransferID() = %q, %q, want distinct 16-character IDs", a, b)
+	}
+}
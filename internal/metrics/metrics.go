@@ -0,0 +1,101 @@
+// Package metrics exports the node's activity in the Prometheus format, along with
+// the metrics libp2p registers itself.
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// namespace prefixes the names of the node's metrics.
+const namespace = "p2pfs"
+
+var (
+	// Transfers counts file transfers by direction ("sent" or "received") and
+	// result ("ok" or "error").
+	Transfers = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "transfers_total",
+		Help:      "File transfers by direction and result.",
+	}, []string{"direction", "result"})
+	// TransferDuration observes how long transfers take, by direction.
+	TransferDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "transfer_duration_seconds",
+		Help:      "Duration of file transfers by direction.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 4, 10),
+	}, []string{"direction"})
+	// StreamBytes counts the bytes sent and received on streams, by peer.
+	StreamBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "stream_bytes_total",
+		Help:      "Bytes sent and received on streams by direction and peer.",
+	}, []string{"direction", "peer"})
+	// ActiveStreams is the number of open streams, by protocol.
+	ActiveStreams = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_streams",
+		Help:      "Open streams by protocol.",
+	}, []string{"protocol"})
+	// DiscoveredPeers is the number of connected peers identified as supporting
+	// the file-sharing protocol.
+	DiscoveredPeers = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "discovered_peers",
+		Help:      "Connected peers supporting the file-sharing protocol.",
+	})
+	// PingRTT observes the round-trip times measured to connected peers.
+	PingRTT = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "ping_rtt_seconds",
+		Help:      "Round-trip times of pings to connected peers.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 12),
+	})
+	// Errors counts failed transfers and pings, and the rejections sent to peers,
+	// by type.
+	Errors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "errors_total",
+		Help:      "Errors by type.",
+	}, []string{"type"})
+	// ResourceRejections counts the refusals of the resource manager, by the scope
+	// whose limit was reached.
+	ResourceRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "resource_rejections_total",
+		Help:      "Connections, streams and memory reservations refused by the resource manager, by scope.",
+	}, []string{"scope"})
+)
+
+// Serve serves the metrics at /metrics on addr until ctx is done. It returns once
+// the listener is open; the server runs in the background and logs its failure to
+// logger.
+func Serve(ctx context.Context, addr string, logger *slog.Logger) (net.Addr, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("error listening for metrics on '%s': %w", addr, err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("Error serving metrics", "error", err)
+		}
+	}()
+	return ln.Addr(), nil
+}
@@ -0,0 +1,46 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/logging"
+)
+
+func TestServe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	addr, err := Serve(ctx, "127.0.0.1:0", logging.Discard())
+	if err != nil {
+		t.Fatalf("Serve() error = %v", err)
+	}
+	Transfers.WithLabelValues("sent", "ok").Inc()
+	Errors.WithLabelValues("timeout").Inc()
+
+	resp, err := http.Get("http://" + addr.String() + "/metrics")
+	if err != nil {
+		t.Fatalf("GET /metrics error = %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read metrics: %v", err)
+	}
+	for _, want := range []string{
+		`p2pfs_transfers_total{direction="sent",result="ok"} 1`,
+		`p2pfs_errors_total{type="timeout"} 1`,
+		"go_goroutines",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("metrics do not contain %q", want)
+		}
+	}
+
+	if _, err := Serve(ctx, addr.String(), logging.Discard()); err == nil {
+		t.Errorf("Serve() on a used address succeeded")
+	}
+}
@@ -0,0 +1,137 @@
+package network
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+// AckStatus is the receiver's verdict on an uploaded file.
+type AckStatus string
+
+const (
+	// AckAccepted means the receiver is ready for the file's content. It only
+	// precedes the content of delta uploads, which are acknowledged again once stored.
+	AckAccepted AckStatus = "accepted"
+	// AckStored means the file was written to the receiver's download directory.
+	AckStored AckStatus = "stored"
+	// AckForbidden means the receiver does not accept uploads from the sender.
+	AckForbidden AckStatus = "forbidden"
+	// AckInvalid means the file's name or encoding was not acceptable.
+	AckInvalid AckStatus = "invalid"
+	// AckHashMismatch means the received content does not match the sender's hash.
+	AckHashMismatch AckStatus = "hash_mismatch"
+	// AckTooLarge means the file exceeds the receiver's maximum file size.
+	AckTooLarge AckStatus = "too_large"
+	// AckQuotaExceeded means storing the file would exceed the receiver's quota for
+	// the sender or for its download directory.
+	AckQuotaExceeded AckStatus = "quota_exceeded"
+	// AckDiskFull means the receiver ran out of disk space, or would keep less free
+	// space than it is configured to.
+	AckDiskFull AckStatus = "disk_full"
+	// AckBusy means the receiver lacks the memory or streams to accept the file
+	// now. The upload may succeed later.
+	AckBusy AckStatus = "busy"
+	// AckFailed means the receiver failed to store the file for another reason.
+	AckFailed AckStatus = "failed"
+)
+
+// Errors returned by uploads that the receiver did not store, one per AckStatus.
+// They are wrapped with the receiver's explanation.
+var (
+	ErrForbidden     = errors.New("peer does not accept uploads from this node")
+	ErrInvalidFile   = errors.New("peer rejected the file as invalid")
+	ErrHashMismatch  = errors.New("file was corrupted in transit")
+	ErrTooLarge      = errors.New("file exceeds the peer's maximum file size")
+	ErrQuotaExceeded = errors.New("peer's upload quota is exhausted")
+	ErrDiskFull      = errors.New("peer is out of disk space")
+	ErrBusy          = errors.New("peer is too busy to accept the file")
+	ErrNotStored     = errors.New("peer failed to store the file")
+	// ErrNoAck means the stream ended without a verdict, for example because the
+	// receiver crashed. The file may or may not have been stored.
+	ErrNoAck = errors.New("peer did not acknowledge the file")
+)
+
+// ackErrors maps each rejection to its error.
+var ackErrors = map[AckStatus]error{
+	AckForbidden:     ErrForbidden,
+	AckInvalid:       ErrInvalidFile,
+	AckHashMismatch:  ErrHashMismatch,
+	AckTooLarge:      ErrTooLarge,
+	AckQuotaExceeded: ErrQuotaExceeded,
+	AckDiskFull:      ErrDiskFull,
+	AckBusy:          ErrBusy,
+	AckFailed:        ErrNotStored,
+}
+
+// Ack is sent by the receiver of an upload, as a single line of JSON, once the
+// file is stored or rejected.
+type Ack struct {
+	Status AckStatus `json:"status"`
+	// Message explains a rejection.
+	Message string `json:"message,omitempty"`
+}
+
+// Err returns nil for a stored or accepted file and the error matching the status
+// otherwise.
+func (a Ack) Err() error {
+	if a.Status == AckStored || a.Status == AckAccepted {
+		return nil
+	}
+	err, ok := ackErrors[a.Status]
+	if !ok {
+		err = ErrNotStored
+	}
+	if a.Message == "" {
+		return err
+	}
+	return fmt.Errorf("%w: %s", err, a.Message)
+}
+
+// nack builds the rejection for an error that prevented storing a file.
+func nack(status AckStatus, err error) Ack {
+	switch {
+	case errors.Is(err, syscall.ENOSPC):
+		status = AckDiskFull
+	case errors.Is(err, network.ErrResourceLimitExceeded):
+		status = AckBusy
+	}
+	return Ack{Status: status, Message: err.Error()}
+}
+
+// writeAck sends an ack to the uploader.
+func writeAck(w io.Writer, ack Ack) error {
+	line, err := json.Marshal(ack)
+	if err != nil {
+		return fmt.Errorf("error encoding ack: %w", err)
+	}
+	if _, err := w.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("error writing ack: %w", err)
+	}
+	return nil
+}
+
+// readAck waits for the receiver's ack and returns nil if it has the wanted status,
+// or the error matching the receiver's rejection.
+func readAck(r *bufio.Reader, want AckStatus) error {
+	line, err := readLine(r)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrNoAck, err)
+	}
+	var ack Ack
+	if err := json.Unmarshal(line, &ack); err != nil {
+		return fmt.Errorf("%w: %v", ErrNoAck, err)
+	}
+	if ack.Status == want {
+		return nil
+	}
+	if err := ack.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("%w: unexpected status '%s'", ErrNoAck, ack.Status)
+}
@@ -0,0 +1,143 @@
+package network
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Compression algorithms named in the transfer header.
+const (
+	CompressionNone = "none"
+	CompressionZstd = "zstd"
+	CompressionGzip = "gzip"
+)
+
+const (
+	// compressionSampleSize is how much of a file is test-compressed to decide
+	// whether compressing the whole file is worthwhile.
+	compressionSampleSize = 64 << 10
+	// minCompressSize is the size below which compression is not worth its overhead.
+	minCompressSize = 512
+	// maxCompressionRatio is the compressed to original sample size ratio above
+	// which a file is considered incompressible.
+	maxCompressionRatio = 0.9
+	// zstdWindowSize is the window files are compressed with, and the largest
+	// window a received stream may ask the decoder for.
+	zstdWindowSize = 8 << 20
+)
+
+// compressedExtensions lists file types whose content is already compressed.
+var compressedExtensions = map[string]bool{
+	".gz": true, ".tgz": true, ".zst": true, ".xz": true, ".bz2": true, ".lz4": true,
+	".zip": true, ".7z": true, ".rar": true, ".jar": true, ".apk": true,
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true, ".heic": true,
+	".mp3": true, ".aac": true, ".ogg": true, ".flac": true, ".opus": true,
+	".mp4": true, ".mkv": true, ".webm": true, ".mov": true, ".avi": true,
+	".docx": true, ".xlsx": true, ".pptx": true, ".odt": true, ".epub": true,
+	".p2penc": true,
+}
+
+// compressionFor picks the algorithm for sending a file to a peer: none unless the
+// peer advertises compression support and a sample of the file compresses well.
+func (n *Node) compressionFor(p peer.ID, name string, data []byte) string {
+	if n.compression == "" || n.compression == CompressionNone {
+		return ""
+	}
+	if supported, err := n.Peerstore().SupportsProtocols(p, CompressionCapability); err != nil || len(supported) == 0 {
+		return ""
+	}
+	if compressedExtensions[strings.ToLower(path.Ext(name))] || !compressible(data) {
+		return ""
+	}
+	return n.compression
+}
+
+// compressible reports whether a sample of data shrinks enough to be worth compressing.
+func compressible(data []byte) bool {
+	if len(data) < minCompressSize {
+		return false
+	}
+	sample := data[:min(len(data), compressionSampleSize)]
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return false
+	}
+	defer enc.Close()
+	compressed := enc.EncodeAll(sample, nil)
+	return float64(len(compressed)) < maxCompressionRatio*float64(len(sample))
+}
+
+// compressWriter returns a writer that compresses into w with the given algorithm.
+// Closing it flushes the compressed stream but does not close w.
+func compressWriter(w io.Writer, algorithm string) (io.WriteCloser, error) {
+	switch algorithm {
+	case "":
+		return nopWriteCloser{w}, nil
+	case CompressionZstd:
+		return zstd.NewWriter(w, zstd.WithWindowSize(zstdWindowSize))
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	default:
+		return nil, fmt.Errorf("unsupported compression '%s'", algorithm)
+	}
+}
+
+// decompressReader returns a reader that decompresses r while it is read. The zstd
+// decoder is bounded to one goroutine and a window of zstdWindowSize, so a peer
+// cannot make a single stream take more.
+func decompressReader(r io.Reader, algorithm string) (io.ReadCloser, error) {
+	switch algorithm {
+	case "":
+		return io.NopCloser(r), nil
+	case CompressionZstd:
+		dec, err := zstd.NewReader(r,
+			zstd.WithDecoderMaxWindow(zstdWindowSize),
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderLowmem(true))
+		if err != nil {
+			return nil, err
+		}
+		return dec.IOReadCloser(), nil
+	case CompressionGzip:
+		return gzip.NewReader(r)
+	default:
+		return nil, fmt.Errorf("unsupported compression '%s'", algorithm)
+	}
+}
+
+// nopWriteCloser adds a no-op Close method to a writer.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,429 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/delta"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/file"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/logging"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/tracing"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// DeltaUploadProtocolID uploads a file into the peer's download directory,
+	// sending only the blocks that differ from the peer's existing copy.
+	DeltaUploadProtocolID = protocolPrefix + "delta-upload/2.0.0"
+	// DeltaFetchProtocolID serves a file from the shared directory as a delta
+	// against the requester's existing copy.
+	DeltaFetchProtocolID = protocolPrefix + "delta-fetch/2.0.0"
+)
+
+// Both delta protocols exchange the receiver's block signature, followed by a
+// header and the delta of the sender's file, compressed as the header says. The
+// header carries the file's hash so the receiver can verify the rebuilt file.
+//
+// upload: sender writes the header, receiver answers with an AckAccepted and its
+// signature or with a rejection, sender writes the delta and the receiver answers
+// with an AckStored once the file is stored, or with a rejection.
+// fetch: requester writes a header naming the file and its signature, server
+// writes the header of the file and the delta.
+
+// SendFileDelta uploads a file to a peer, which stores it in its download
+// directory. If the peer already has a copy, only the changed blocks are sent.
+// Like SendFile, it returns the error matching the peer's rejection, if any.
+func (n *Node) SendFileDelta(ctx context.Context, peerID peer.ID, name string, data []byte, md file.Metadata) (delta.Stats, error) {
+	start := time.Now()
+	hdr := Header{
+		Name:        name,
+		Metadata:    md,
+		Compression: n.compressionFor(peerID, name, data),
+		Hash:        hashData(data),
+		Size:        int64(len(data)),
+		Transfer:    logging.NewTransferID(),
+	}
+	ctx, span := startTransfer(ctx, spanSend, trace.SpanKindClient, peerID, hdr)
+	hdr.Trace = tracing.Inject(ctx)
+	stats, wire, err := n.sendFileDelta(ctx, peerID, hdr, data)
+	tracing.End(span, err)
+	n.RecordTransfer(peerID, Sent, int64(len(data)), time.Since(start), err)
+	if err == nil {
+		n.RecordBytes(peerID, int64(len(data)), wire)
+	}
+	return stats, err
+}
+
+// sendFileDelta runs the upload side of the delta protocol and returns the number
+// of bytes written to the stream.
+func (n *Node) sendFileDelta(ctx context.Context, peerID peer.ID, hdr Header, data []byte) (delta.Stats, int64, error) {
+	stream, err := n.NewStream(ctx, peerID, DeltaUploadProtocolID)
+	if err != nil {
+		return delta.Stats{}, 0, fmt.Errorf("error creating new stream: %w", err)
+	}
+	defer stream.Close()
+
+	counter := &countingWriter{w: stream}
+	if err := writeHeader(counter, hdr); err != nil {
+		return delta.Stats{}, counter.n, err
+	}
+	reader := bufio.NewReader(stream)
+	if err := readAck(reader, AckAccepted); err != nil {
+		return delta.Stats{}, counter.n, err
+	}
+	// A signature larger than the file can match is dropped, and the whole file sent.
+	sig, err := delta.ReadSignature(reader, hdr.Size)
+	if err != nil && !errors.Is(err, delta.ErrSignatureTooLarge) {
+		return delta.Stats{}, counter.n, fmt.Errorf("error reading signature of '%s': %w", hdr.Name, err)
+	}
+	stats, err := writeDelta(counter, hdr.Compression, sig, bytes.NewReader(data))
+	if err != nil {
+		_ = stream.Reset()
+		return stats, counter.n, err
+	}
+	if err := stream.CloseWrite(); err != nil {
+		return stats, counter.n, fmt.Errorf("error closing stream: %w", err)
+	}
+	if err := readAck(reader, AckStored); err != nil {
+		return stats, counter.n, err
+	}
+
+	n.logger.Info("File stored by peer", logging.Peer(peerID), logging.Transfer(hdr.Transfer),
+		"name", hdr.Name, "matched", stats.Matched, "literal", stats.Literal, "wire_bytes", counter.n)
+	return stats, counter.n, nil
+}
+
+// handleDeltaUpload stores an uploaded file in the download directory, rebuilding
+// it from the existing copy and the received delta.
+func (n *Node) handleDeltaUpload(stream network.Stream) {
+	defer stream.Close()
+	start := time.Now()
+	ack, logger := n.receiveDeltaUpload(stream, n.streamLogger(stream))
+	observeTransfer(Received, time.Since(start), ack.Err())
+	if err := writeAck(stream, ack); err != nil {
+		logger.Warn("Error acknowledging file", "error", err)
+		return
+	}
+	if ack.Status != AckStored {
+		// The rest of a rejected delta is discarded until the sender reads the ack.
+		_ = stream.CloseWrite()
+		_, _ = io.Copy(io.Discard, stream)
+	}
+}
+
+// receiveDeltaUpload runs the receiving side of a delta upload and returns the
+// final verdict for the uploader, along with logger annotated with the upload once
+// it is known.
+func (n *Node) receiveDeltaUpload(stream network.Stream, logger *slog.Logger) (ack Ack, _ *slog.Logger) {
+	remote := stream.Conn().RemotePeer()
+	recv := n.recv
+	if !recv.allows(remote) {
+		logger.Warn("Rejected upload: uploads from this peer are not allowed")
+		return Ack{Status: AckForbidden}, logger
+	}
+
+	reader := bufio.NewReader(stream)
+	hdr, err := readHeader(reader)
+	if err != nil {
+		logger.Warn("Error reading upload", "error", err)
+		return nack(AckInvalid, err), logger
+	}
+	logger = logger.With(transferAttr(hdr), "name", hdr.Name)
+	_, span := serveTransfer(spanReceive, remote, hdr)
+	defer func() { tracing.End(span, ack.Err()) }()
+	dest, err := file.LocalPath(recv.downloadDir, hdr.Name)
+	if err != nil {
+		logger.Warn("Rejected upload", "error", err)
+		return nack(AckInvalid, err), logger
+	}
+	adm, reject, ok := recv.admit(remote, hdr.Name, hdr.Size)
+	if !ok {
+		logger.Warn("Rejected upload", "status", reject.Status, "reason", reject.Message)
+		return reject, logger
+	}
+	defer adm.release()
+	// The file is rebuilt next to the existing copy, which is read as needed, so
+	// neither is held in memory.
+	basis, sig, err := openBasis(dest)
+	if err != nil {
+		logger.Warn("Error receiving upload", "error", err)
+		return nack(AckFailed, err), logger
+	}
+	if basis != nil {
+		defer basis.Close()
+	}
+	out, err := file.CreateAtomic(dest)
+	if err != nil {
+		logger.Error("Error saving file", "error", err)
+		return nack(AckFailed, err), logger
+	}
+	defer out.Discard()
+	if err := writeAck(stream, Ack{Status: AckAccepted}); err != nil {
+		logger.Warn("Error receiving upload", "error", err)
+		return nack(AckFailed, err), logger
+	}
+	if err := delta.WriteSignature(stream, sig); err != nil {
+		logger.Warn("Error receiving upload", "error", err)
+		return nack(AckFailed, err), logger
+	}
+	stats, err := applyDelta(reader, hdr, basis, sig, adm.limit, out)
+	if errors.Is(err, errLimitExceeded) {
+		logger.Warn("Rejected upload", "status", adm.reject.Status, "reason", adm.reject.Message)
+		return adm.reject, logger
+	}
+	if errors.Is(err, ErrHashMismatch) {
+		logger.Warn("Rejected upload", "status", AckHashMismatch, "error", err)
+		return Ack{Status: AckHashMismatch, Message: fmt.Sprintf("rebuilt '%s' does not match hash %s", hdr.Name, hdr.Hash)}, logger
+	}
+	if err != nil {
+		logger.Warn("Error receiving upload", "error", err)
+		return nack(AckInvalid, err), logger
+	}
+	if err := out.Commit(hdr.Metadata, recv.policy); err != nil {
+		logger.Error("Error saving file", "error", err)
+		return nack(AckFailed, err), logger
+	}
+	if err := recv.record(remote, hdr.Name); err != nil {
+		logger.Error("Error recording upload", "error", err)
+	}
+	logger.Info("Received file", "size", stats.Matched+stats.Literal, "matched", stats.Matched)
+	return Ack{Status: AckStored}, logger
+}
+
+// FetchFileDelta downloads a file from a peer's shared directory to dest, restoring
+// the attributes the policy allows. The existing copy at dest, if any, is used to
+// fetch only the blocks that changed. The file is rebuilt next to dest and renamed
+// into place once verified.
+func (n *Node) FetchFileDelta(ctx context.Context, peerID peer.ID, name string, dest string, policy file.Policy) (delta.Stats, error) {
+	ctx, span, req := startFetch(ctx, peerID, name)
+	stats, err := n.fetchFileDelta(ctx, peerID, req, dest, policy)
+	tracing.End(span, err)
+	return stats, err
+}
+
+// fetchFileDelta runs the requesting side of the delta fetch protocol.
+func (n *Node) fetchFileDelta(ctx context.Context, peerID peer.ID, req Header, dest string, policy file.Policy) (delta.Stats, error) {
+	name := req.Name
+	basis, sig, err := openBasis(dest)
+	if err != nil {
+		return delta.Stats{}, err
+	}
+	if basis != nil {
+		defer basis.Close()
+	}
+
+	stream, err := n.NewStream(ctx, peerID, DeltaFetchProtocolID)
+	if err != nil {
+		return delta.Stats{}, fmt.Errorf("error creating new stream: %w", err)
+	}
+	defer stream.Close()
+
+	if err := writeHeader(stream, req); err != nil {
+		return delta.Stats{}, fmt.Errorf("error requesting file: %w", err)
+	}
+	if err := delta.WriteSignature(stream, sig); err != nil {
+		return delta.Stats{}, fmt.Errorf("error requesting file: %w", err)
+	}
+	if err := stream.CloseWrite(); err != nil {
+		return delta.Stats{}, fmt.Errorf("error requesting file: %w", err)
+	}
+
+	counter := &countingReader{r: stream}
+	reader := bufio.NewReader(counter)
+	hdr, err := readHeader(reader)
+	if errors.Is(err, network.ErrReset) {
+		return delta.Stats{}, fmt.Errorf("%w: %s", ErrFileUnavailable, name)
+	}
+	if err != nil {
+		return delta.Stats{}, err
+	}
+	if hdr.Name != name {
+		return delta.Stats{}, fmt.Errorf("received unexpected file '%s'", hdr.Name)
+	}
+	limit, err := downloadLimit(hdr, n.maxDownload)
+	if err != nil {
+		return delta.Stats{}, err
+	}
+	out, err := file.CreateAtomic(dest)
+	if err != nil {
+		return delta.Stats{}, err
+	}
+	defer out.Discard()
+	stats, err := applyDelta(reader, hdr, basis, sig, limit, out)
+	if err != nil {
+		return stats, err
+	}
+	if err := out.Commit(hdr.Metadata, policy); err != nil {
+		return stats, err
+	}
+	size := stats.Matched + stats.Literal
+	n.RecordBytes(peerID, size, counter.n)
+	n.logger.Info("Received file", logging.Peer(peerID), transferAttr(hdr),
+		"name", name, "size", size, "matched", stats.Matched, "wire_bytes", counter.n)
+	return stats, nil
+}
+
+// handleDeltaFetch serves a file from the shared directory as a delta against the
+// requester's signature.
+func (n *Node) handleDeltaFetch(stream network.Stream, sharedDir string) {
+	defer stream.Close()
+	remote := stream.Conn().RemotePeer()
+	logger := n.streamLogger(stream)
+
+	reader := bufio.NewReader(stream)
+	req, err := readHeader(reader)
+	if err != nil {
+		logger.Warn("Error reading fetch request", "error", err)
+		_ = stream.Reset()
+		return
+	}
+	name := req.Name
+	path, err := file.LocalPath(sharedDir, name)
+	if err != nil {
+		logger.Warn("Rejected fetch request", "error", err)
+		_ = stream.Reset()
+		return
+	}
+	// The file is streamed from disk: once to hash it, since the hash precedes the
+	// delta, and once to encode it.
+	f, size, sample, err := openServed(path)
+	if err != nil {
+		// Directories and missing files are reported as unavailable.
+		_ = stream.Reset()
+		return
+	}
+	defer f.Close()
+	// The signature is bounded by the served file, which it cannot match beyond;
+	// a larger one is dropped, and the whole file sent.
+	sig, err := delta.ReadSignature(reader, size)
+	if err != nil && !errors.Is(err, delta.ErrSignatureTooLarge) {
+		logger.Warn("Error reading fetch request", "error", err)
+		_ = stream.Reset()
+		return
+	}
+	req.Transfer = transferID(req)
+	logger = logger.With(logging.Transfer(req.Transfer), "name", name)
+	_, span := serveTransfer(spanSend, remote, req)
+	span.SetAttributes(tracing.Size(size))
+	hdr := Header{Name: name, Transfer: req.Transfer, Size: size}
+	hdr.Metadata, err = file.ReadMetadata(path)
+	if err == nil {
+		hdr.Hash, err = hashReader(io.NewSectionReader(f, 0, size))
+	}
+	if err != nil {
+		tracing.End(span, err)
+		logger.Warn("Error serving file", "error", err)
+		_ = stream.Reset()
+		return
+	}
+
+	start := time.Now()
+	hdr.Compression = n.compressionFor(remote, name, sample)
+	var stats delta.Stats
+	err = writeHeader(stream, hdr)
+	if err == nil {
+		stats, err = writeDelta(stream, hdr.Compression, sig, io.NewSectionReader(f, 0, size))
+	}
+	observeTransfer(Sent, time.Since(start), err)
+	tracing.End(span, err)
+	if err != nil {
+		logger.Warn("Error serving file", "error", err)
+		_ = stream.Reset()
+		return
+	}
+	logger.Debug("Served file", "matched", stats.Matched, "literal", stats.Literal)
+}
+
+// writeDelta writes the delta of the file read from r against sig, compressed with
+// the given algorithm.
+func writeDelta(w io.Writer, compression string, sig delta.Signature, r io.Reader) (delta.Stats, error) {
+	body, err := compressWriter(w, compression)
+	if err != nil {
+		return delta.Stats{}, fmt.Errorf("error writing delta: %w", err)
+	}
+	stats, err := delta.Encode(body, sig, r)
+	if err != nil {
+		return stats, err
+	}
+	if err := body.Close(); err != nil {
+		return stats, fmt.Errorf("error writing delta: %w", err)
+	}
+	return stats, nil
+}
+
+// applyDelta rebuilds a file from basis, described by sig, and the delta read from
+// r into w, and verifies it against the hash in the header. It fails with
+// errLimitExceeded once the file exceeds limit bytes. A nil basis is an empty file.
+func applyDelta(r io.Reader, hdr Header, basis *os.File, sig delta.Signature, limit int64, w io.Writer) (delta.Stats, error) {
+	body, err := decompressReader(r, hdr.Compression)
+	if err != nil {
+		return delta.Stats{}, fmt.Errorf("error reading delta: %w", err)
+	}
+	defer body.Close()
+
+	var at io.ReaderAt = strings.NewReader("")
+	if basis != nil {
+		at = basis
+	}
+	h := sha256.New()
+	stats, err := delta.Apply(&limitWriter{w: io.MultiWriter(w, h), n: limit}, at, sig, body)
+	if err != nil {
+		return stats, err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != hdr.Hash {
+		return stats, fmt.Errorf("%w: rebuilt file '%s' has hash %s, want %s", ErrHashMismatch, hdr.Name, got, hdr.Hash)
+	}
+	return stats, nil
+}
+
+// openBasis opens the existing copy of a file and computes its signature while
+// reading it. The file is left open for the blocks the delta copies from it. A
+// missing file yields a nil file and an empty signature, so the whole file is sent.
+func openBasis(path string) (*os.File, delta.Signature, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, delta.Signature{BlockSize: delta.MinBlockSize}, nil
+	}
+	if err != nil {
+		return nil, delta.Signature{}, fmt.Errorf("error reading existing copy '%s': %w", path, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, delta.Signature{}, fmt.Errorf("error reading existing copy '%s': %w", path, err)
+	}
+	sig, err := delta.NewSignature(bufio.NewReader(f), delta.BlockSize(info.Size()))
+	if err != nil {
+		f.Close()
+		return nil, delta.Signature{}, fmt.Errorf("error reading existing copy '%s': %w", path, err)
+	}
+	return f, sig, nil
+}
+
+// hashData returns the hex-encoded SHA-256 of data, as file.Hash does for files.
+func hashData(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// hashReader returns the hex-encoded SHA-256 of the content read from r.
+func hashReader(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", fmt.Errorf("error hashing file: %w", err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,46 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+)
+
+// LoadIdentity reads the node's private key from path, generating and saving a new
+// Ed25519 key if the file does not exist. An empty path returns a nil key, which
+// makes libp2p generate an ephemeral identity.
+func LoadIdentity(path string) (crypto.PrivKey, error) {
+	if path == "" {
+		return nil, nil
+	}
+	cleanPath := filepath.Clean(path)
+
+	data, err := os.ReadFile(cleanPath)
+	if err == nil {
+		priv, err := crypto.UnmarshalPrivateKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding identity key '%s': %w", cleanPath, err)
+		}
+		return priv, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("error reading identity key '%s': %w", cleanPath, err)
+	}
+
+	priv, _, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		return nil, fmt.Errorf("error generating identity key: %w", err)
+	}
+	data, err = crypto.MarshalPrivateKey(priv)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding identity key: %w", err)
+	}
+	if err := os.WriteFile(cleanPath, data, 0600); err != nil {
+		return nil, fmt.Errorf("error writing identity key '%s': %w", cleanPath, err)
+	}
+	return priv, nil
+}
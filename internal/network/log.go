@@ -0,0 +1,28 @@
+package network
+
+import (
+	"log/slog"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/logging"
+)
+
+// streamLogger returns the node's logger, annotated with the stream's remote peer.
+func (n *Node) streamLogger(stream network.Stream) *slog.Logger {
+	return n.logger.With(logging.Peer(stream.Conn().RemotePeer()))
+}
+
+// transferAttr returns the attribute identifying the transfer a header starts,
+// with a new ID if the sender did not send one.
+func transferAttr(hdr Header) slog.Attr {
+	return logging.Transfer(transferID(hdr))
+}
+
+// transferID returns the ID of the transfer a header starts, or a new ID if the
+// sender did not send one.
+func transferID(hdr Header) string {
+	if hdr.Transfer == "" {
+		return logging.NewTransferID()
+	}
+	return hdr.Transfer
+}
@@ -0,0 +1,57 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/metrics"
+)
+
+// Direction is the way a file's content travels in a transfer.
+type Direction string
+
+const (
+	Sent     Direction = "sent"
+	Received Direction = "received"
+)
+
+// observeTransfer counts a transfer, its duration and its error in the metrics.
+func observeTransfer(dir Direction, elapsed time.Duration, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+		metrics.Errors.WithLabelValues(errorType(err)).Inc()
+	}
+	metrics.Transfers.WithLabelValues(string(dir), result).Inc()
+	metrics.TransferDuration.WithLabelValues(string(dir)).Observe(elapsed.Seconds())
+}
+
+// errorType classifies an error for the metrics: rejections by their ack status,
+// and other failures by their cause.
+func errorType(err error) string {
+	for status, ackErr := range ackErrors {
+		if errors.Is(err, ackErr) {
+			return string(status)
+		}
+	}
+	switch {
+	case errors.Is(err, ErrStreamTimeout):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "deadline"
+	case errors.Is(err, network.ErrResourceLimitExceeded):
+		return string(AckBusy)
+	case errors.Is(err, ErrNoAck):
+		return "no_ack"
+	case errors.Is(err, ErrFileUnavailable):
+		return "unavailable"
+	case errors.Is(err, network.ErrReset):
+		return "reset"
+	default:
+		return "other"
+	}
+}
@@ -0,0 +1,93 @@
+package network
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/saurabhSPatel/p2p-file-sharing/config"
+)
+
+// reachabilityWait bounds how long Reachability waits for the last reachability event.
+const reachabilityWait = 100 * time.Millisecond
+
+// natOptions translates the NAT traversal settings into libp2p options.
+func natOptions(cfg config.NATConfig) ([]libp2p.Option, error) {
+	opts := []libp2p.Option{libp2p.EnableRelay()}
+
+	if cfg.PortMapping {
+		opts = append(opts, libp2p.NATPortMap())
+	}
+	if cfg.HolePunching {
+		opts = append(opts, libp2p.EnableHolePunching())
+	}
+	if cfg.AutoNATService {
+		opts = append(opts, libp2p.EnableNATService())
+	}
+	if cfg.RelayService {
+		opts = append(opts, libp2p.EnableRelayService())
+	}
+
+	if len(cfg.StaticRelays) > 0 {
+		relays, err := parseAddrInfos(cfg.StaticRelays)
+		if err != nil {
+			return nil, fmt.Errorf("invalid static relay: %w", err)
+		}
+		opts = append(opts, libp2p.EnableAutoRelayWithStaticRelays(relays))
+	}
+
+	switch cfg.ForceReachability {
+	case "public":
+		opts = append(opts, libp2p.ForceReachabilityPublic())
+	case "private":
+		opts = append(opts, libp2p.ForceReachabilityPrivate())
+	}
+	return opts, nil
+}
+
+// parseAddrInfos parses multiaddrs ending in /p2p/<peer-id>.
+func parseAddrInfos(entries []string) ([]peer.AddrInfo, error) {
+	infos := make([]peer.AddrInfo, 0, len(entries))
+	for _, s := range entries {
+		pi, err := peer.AddrInfoFromString(s)
+		if err != nil {
+			return nil, fmt.Errorf("'%s': %w", s, err)
+		}
+		infos = append(infos, *pi)
+	}
+	return infos, nil
+}
+
+// Reachability returns the node's reachability as last determined by AutoNAT,
+// or network.ReachabilityUnknown if it has not been determined yet.
+func Reachability(h host.Host) network.Reachability {
+	sub, err := h.EventBus().Subscribe(new(event.EvtLocalReachabilityChanged))
+	if err != nil {
+		return network.ReachabilityUnknown
+	}
+	defer sub.Close()
+
+	// The reachability emitter is stateful, so a new subscriber receives the last event.
+	select {
+	case e := <-sub.Out():
+		return e.(event.EvtLocalReachabilityChanged).Reachability
+	case <-time.After(reachabilityWait):
+		return network.ReachabilityUnknown
+	}
+}
+
+// RelayAddrs returns the circuit relay addresses the node can be reached on.
+func RelayAddrs(h host.Host) []string {
+	var addrs []string
+	for _, addr := range h.Addrs() {
+		if _, err := addr.ValueForProtocol(ma.P_CIRCUIT); err == nil {
+			addrs = append(addrs, fmt.Sprintf("%s/p2p/%s", addr, h.ID()))
+		}
+	}
+	return addrs
+}
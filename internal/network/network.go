@@ -2,130 +2,544 @@ package network
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/libp2p/go-libp2p"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/pnet"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-libp2p/p2p/net/connmgr"
 	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
+	"github.com/saurabhSPatel/p2p-file-sharing/config"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/file"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/logging"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/tracing"
+	"go.opentelemetry.io/otel/trace"
 )
 
-const ProtocolID = "/p2p-file-sharing/1.0.0"
+// ProtocolID uploads a single file into the peer's download directory. The
+// receiver answers with an Ack once the file is stored or rejected.
+const ProtocolID = protocolPrefix + "3.0.0"
 
-// SetupHost initializes a libp2p host with basic configuration
-func SetupHost(ctx context.Context) (host.Host, error) {
-	h, err := libp2p.New(
-		libp2p.ListenAddrStrings("/ip4/0.0.0.0/tcp/0"),
-		libp2p.EnableRelay(),
+// protocolPrefix is shared by every version of the file-sharing protocol.
+const protocolPrefix = "/p2p-file-sharing/"
+
+// CompressionCapability is advertised through identify by hosts that decompress
+// the files they receive. Like any capability protocol, it is never used to open
+// streams.
+const CompressionCapability protocol.ID = protocolPrefix + "cap/compression/1.0.0"
+
+// capabilities returns the capability protocols a host advertises.
+func capabilities() []protocol.ID {
+	// Every host decompresses what it receives, whatever it sends with.
+	return []protocol.ID{CompressionCapability}
+}
+
+// MatchProtocol reports whether id is a file-sharing protocol version compatible
+// with ProtocolID, i.e. one with the same major version.
+func MatchProtocol(id protocol.ID) bool {
+	major, ok := protocolMajor(id)
+	if !ok {
+		return false
+	}
+	want, _ := protocolMajor(ProtocolID)
+	return major == want
+}
+
+// protocolMajor extracts the major version from a file-sharing protocol ID.
+func protocolMajor(id protocol.ID) (int, bool) {
+	version, ok := strings.CutPrefix(string(id), protocolPrefix)
+	if !ok {
+		return 0, false
+	}
+	parts := strings.Split(version, ".")
+	if len(parts) != 3 {
+		return 0, false
+	}
+	for _, part := range parts {
+		if _, err := strconv.Atoi(part); err != nil {
+			return 0, false
+		}
+	}
+	major, _ := strconv.Atoi(parts[0])
+	return major, true
+}
+
+// Node is a libp2p host created by SetupHost, along with the configuration its
+// transfers and stream handlers follow. It overrides the host's NewStream and
+// Connect to apply that configuration to the streams it opens and the peers it
+// dials.
+type Node struct {
+	host.Host
+	// ctx bounds the node's lifetime: the streams it serves are reset once it is done.
+	ctx         context.Context
+	logger      *slog.Logger
+	recv        *receiver
+	compression string
+	timeouts    config.StreamConfig
+	rejections  *rejections
+	// maxDownload caps the size of the files the node fetches; 0 is unlimited.
+	maxDownload int64
+	// psk is the swarm key of a private network, or nil.
+	psk pnet.PSK
+	// statsMu serializes read-modify-write updates of the stats stored in the peerstore.
+	statsMu sync.Mutex
+}
+
+// SetupHost initializes a libp2p host from the given configuration. The node's
+// transfers and handlers log to logger, and the streams it serves are reset once
+// ctx is done.
+func SetupHost(ctx context.Context, cfg config.Config, logger *slog.Logger) (*Node, error) {
+	priv, err := LoadIdentity(cfg.IdentityKeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	addressBook, err := parseAddrInfos(cfg.AddressBook)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address-book entry: %w", err)
+	}
+
+	recv, err := newReceiver(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	natOpts, err := natOptions(cfg.NAT)
+	if err != nil {
+		return nil, err
+	}
+
+	cm, err := connmgr.NewConnManager(
+		cfg.ConnManager.LowWater,
+		cfg.ConnManager.HighWater,
+		connmgr.WithGracePeriod(time.Duration(cfg.ConnManager.GracePeriod)),
 	)
 	if err != nil {
+		return nil, fmt.Errorf("failed to create connection manager: %w", err)
+	}
+
+	rm, rej, err := newResourceManager(cfg.Resources, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	transportOpts, err := transportOptions(cfg.Transports)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []libp2p.Option{libp2p.ConnectionManager(cm), libp2p.ResourceManager(rm)}
+	opts = append(opts, transportOpts...)
+	opts = append(opts, natOpts...)
+	if priv != nil {
+		opts = append(opts, libp2p.Identity(priv))
+	}
+
+	var psk pnet.PSK
+	if cfg.SwarmKeyPath != "" {
+		psk, err = LoadSwarmKey(cfg.SwarmKeyPath)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, libp2p.PrivateNetwork(psk))
+	}
+
+	h, err := libp2p.New(opts...)
+	if err != nil {
+		_ = rm.Close()
 		return nil, fmt.Errorf("failed to create libp2p host: %w", err)
 	}
+	n := &Node{
+		Host:        h,
+		ctx:         ctx,
+		logger:      logger,
+		recv:        recv,
+		compression: cfg.Compression,
+		timeouts:    cfg.Streams,
+		rejections:  rej,
+		maxDownload: int64(cfg.Downloads.MaxFileSize),
+		psk:         psk,
+	}
 
-	pingService := ping.NewPingService(h)
-	h.SetStreamHandler(ProtocolID, HandleStream)
+	ping.NewPingService(h)
+	h.SetStreamHandlerMatch(ProtocolID, MatchProtocol, n.WithTimeouts(n.handleUpload))
+	n.ServeFiles(cfg.SharedDir)
+	h.SetStreamHandler(TreeProtocolID, n.WithTimeouts(n.handleTree))
+	h.SetStreamHandler(DeltaUploadProtocolID, n.WithTimeouts(n.handleDeltaUpload))
+	for _, c := range capabilities() {
+		h.SetStreamHandler(c, func(stream network.Stream) { _ = stream.Reset() })
+	}
 
-	log.Println("Host created with ID:", h.ID().String())
-	for _, addr := range h.Addrs() {
-		log.Println("Listening on", addr)
+	if psk != nil {
+		logger.Info("Private network enabled", "fingerprint", SwarmKeyFingerprint(psk))
 	}
+	logger.Info("Host created", "id", h.ID(), "addrs", h.Addrs())
 
 	h.Network().Notify(&network.NotifyBundle{
 		ConnectedF: func(net network.Network, conn network.Conn) {
-			log.Printf("Connected to peer: %s\n", conn.RemotePeer().String())
-			go pingService.Ping(ctx, conn.RemotePeer())
+			logger.Debug("Connected to peer", logging.Peer(conn.RemotePeer()), "addr", conn.RemoteMultiaddr())
+			go n.pingPeer(ctx, conn.RemotePeer())
 		},
 	})
 
-	return h, nil
+	go n.pingPeers(ctx)
+	n.protectAddressBook(ctx, addressBook)
+
+	return n, nil
 }
 
-// SendFile initiates a stream to a peer and sends the file's name and content
-func SendFile(ctx context.Context, h host.Host, peerID peer.ID, filename string, data []byte) error {
+// SendFile initiates a stream to a peer and sends the file's name and content.
+// It returns once the peer stored the file, or with the error matching the peer's
+// rejection, such as ErrForbidden or ErrHashMismatch.
+func (n *Node) SendFile(ctx context.Context, peerID peer.ID, filename string, data []byte) error {
+	return n.SendFileWithMetadata(ctx, peerID, filename, data, file.Metadata{})
+}
+
+// SendFileWithMetadata sends a file along with attributes for the peer to restore.
+func (n *Node) SendFileWithMetadata(ctx context.Context, peerID peer.ID, filename string, data []byte, md file.Metadata) error {
+	start := time.Now()
+	hdr := Header{
+		Name:        filename,
+		Metadata:    md,
+		Compression: n.compressionFor(peerID, filename, data),
+		Hash:        hashData(data),
+		Size:        int64(len(data)),
+		Transfer:    logging.NewTransferID(),
+	}
+	ctx, span := startTransfer(ctx, spanSend, trace.SpanKindClient, peerID, hdr)
+	hdr.Trace = tracing.Inject(ctx)
+	wire, err := n.sendFile(ctx, peerID, hdr, data)
+	tracing.End(span, err)
+	n.RecordTransfer(peerID, Sent, int64(len(data)), time.Since(start), err)
+	if err == nil {
+		n.RecordBytes(peerID, int64(len(data)), wire)
+	}
+	return err
+}
 
-	stream, err := h.NewStream(ctx, peerID, ProtocolID)
+// sendFile writes the file to a new stream and waits for the peer's ack without
+// recording the outcome, and returns the number of bytes written to the stream.
+func (n *Node) sendFile(ctx context.Context, peerID peer.ID, hdr Header, data []byte) (int64, error) {
+	stream, err := n.NewStream(ctx, peerID, ProtocolID)
 	if err != nil {
-		return fmt.Errorf("error creating new stream: %w", err)
+		return 0, fmt.Errorf("error creating new stream: %w", err)
 	}
+	logger := n.logger.With(logging.Peer(peerID), logging.Transfer(hdr.Transfer))
 	defer func(stream network.Stream) {
 		err := stream.Close()
 		if err != nil {
-			log.Printf("error closing stream: %s", err.Error())
+			logger.Debug("Error closing stream", "error", err)
 		}
 	}(stream)
 
-	writer := bufio.NewWriter(stream)
-	// Send the filename first
-	_, err = writer.WriteString(filename + "\n")
+	// The peer may reject the file before reading all of it, so its ack is read
+	// while the file is written and a rejection aborts the upload.
+	acks := make(chan error, 1)
+	go func() {
+		err := readAck(bufio.NewReader(stream), AckStored)
+		if err != nil && !errors.Is(err, ErrNoAck) {
+			_ = stream.Reset()
+		}
+		acks <- err
+	}()
+
+	wire, err := writeFile(stream, hdr, bytes.NewReader(data))
+	if err == nil {
+		if err = stream.CloseWrite(); err != nil {
+			err = fmt.Errorf("error closing stream: %w", err)
+		}
+	}
 	if err != nil {
-		return fmt.Errorf("error writing filename: %w", err)
+		_ = stream.Reset()
+		if ackErr := <-acks; ackErr != nil && !errors.Is(ackErr, ErrNoAck) {
+			return wire, ackErr
+		}
+		return wire, err
+	}
+	if err := <-acks; err != nil {
+		return wire, err
+	}
+
+	logger.Info("File stored by peer", "name", hdr.Name, "size", len(data), "wire_bytes", wire)
+	return wire, nil
+}
+
+// Header precedes a file's content on the wire as a single line of JSON.
+type Header struct {
+	Name string `json:"name"`
+	file.Metadata
+	// Compression names the algorithm the content is compressed with; empty
+	// means it is sent as is.
+	Compression string `json:"compression,omitempty"`
+	// Hash is the hex-encoded SHA-256 of the content, sent with uploads and delta
+	// transfers so the receiver can verify the file it stored.
+	Hash string `json:"hash,omitempty"`
+	// Size is the length of the content, sent with uploads so the receiver can
+	// check its quotas before accepting the file, and with downloads so the
+	// requester can bound the content it decompresses.
+	Size int64 `json:"size,omitempty"`
+	// Transfer identifies a transfer in the logs and traces of both peers.
+	Transfer string `json:"transfer,omitempty"`
+	// Trace carries the trace context of the peer that started the transfer, so
+	// that the spans of both peers belong to one trace.
+	Trace map[string]string `json:"trace,omitempty"`
+}
+
+// writeHeader writes a transfer header as a single line of JSON.
+func writeHeader(w io.Writer, hdr Header) error {
+	line, err := json.Marshal(hdr)
+	if err != nil {
+		return fmt.Errorf("error encoding header: %w", err)
+	}
+	if _, err := w.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("error writing header: %w", err)
+	}
+	return nil
+}
+
+// maxLineSize bounds the length of the header and ack lines read from peers, so
+// that a peer cannot make a node buffer an endless line.
+const maxLineSize = 64 << 10
+
+// errLineTooLong is returned for a header or ack line longer than maxLineSize.
+var errLineTooLong = fmt.Errorf("line exceeds %d bytes", maxLineSize)
+
+// readLine reads a line of at most maxLineSize bytes, including its newline.
+func readLine(r *bufio.Reader) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(line)+len(chunk) > maxLineSize {
+			return nil, errLineTooLong
+		}
+		line = append(line, chunk...)
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return line, err
+		}
+	}
+}
+
+// readHeader reads a header written by writeHeader.
+func readHeader(r *bufio.Reader) (Header, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return Header{}, fmt.Errorf("error reading header: %w", err)
+	}
+	var hdr Header
+	if err := json.Unmarshal(line, &hdr); err != nil {
+		return Header{}, fmt.Errorf("error parsing header: %w", err)
+	}
+	return hdr, nil
+}
+
+// writeFile writes the file's header followed by the content read from r,
+// compressed as the header says, and returns the number of bytes written to w.
+func writeFile(w io.Writer, hdr Header, r io.Reader) (int64, error) {
+	counter := &countingWriter{w: w}
+	writer := bufio.NewWriter(counter)
+	// Send the header first
+	if err := writeHeader(writer, hdr); err != nil {
+		return counter.n, err
 	}
 
 	// Send the file data
-	_, err = writer.Write(data)
+	body, err := compressWriter(writer, hdr.Compression)
 	if err != nil {
-		return fmt.Errorf("error writing file data: %w", err)
+		return counter.n, fmt.Errorf("error writing file data: %w", err)
+	}
+	_, err = io.Copy(body, r)
+	if err != nil {
+		return counter.n, fmt.Errorf("error writing file data: %w", err)
+	}
+	if err := body.Close(); err != nil {
+		return counter.n, fmt.Errorf("error writing file data: %w", err)
 	}
 
 	// Flush the buffer to ensure all data is sent
 	err = writer.Flush()
 	if err != nil {
-		return fmt.Errorf("error flushing data: %w", err)
+		return counter.n, fmt.Errorf("error flushing data: %w", err)
 	}
-
-	log.Printf("File '%s' sent to peer %s\n", filename, peerID.String())
-	return nil
+	return counter.n, nil
 }
 
 // ReceiveFile handles an incoming stream and reads the file's name and content
 func ReceiveFile(stream network.Stream) (string, []byte, error) {
-	reader := bufio.NewReader(stream)
+	hdr, data, err := ReceiveFileWithHeader(stream)
+	return hdr.Name, data, err
+}
+
+// ReceiveFileWithHeader reads a file's header, including its attributes, and content.
+// The content may not exceed the size in the header.
+func ReceiveFileWithHeader(stream network.Stream) (Header, []byte, error) {
+	hdr, data, _, err := receiveFile(stream, 0)
+	return hdr, data, err
+}
+
+// receiveFile reads a file, decompressing its content while it streams in, and
+// returns the number of bytes read from r. The content may not exceed the size in
+// the header, which may not exceed maxSize unless it is 0.
+func receiveFile(r io.Reader, maxSize int64) (Header, []byte, int64, error) {
+	counter := &countingReader{r: r}
+	reader := bufio.NewReader(counter)
 
-	// Read the filename
-	filename, err := reader.ReadString('\n')
+	// Read the header
+	hdr, err := readHeader(reader)
+	if err != nil {
+		return Header{}, nil, counter.n, err
+	}
+	limit, err := downloadLimit(hdr, maxSize)
 	if err != nil {
-		return "", nil, fmt.Errorf("error reading filename: %w", err)
+		return Header{}, nil, counter.n, err
 	}
-	filename = filename[:len(filename)-1]
+	data, err := readBody(reader, hdr, limit)
+	if err != nil {
+		return Header{}, nil, counter.n, err
+	}
+	return hdr, data, counter.n, nil
+}
 
-	var data []byte
-	buf := make([]byte, 1024)
-	for {
-		n, err := reader.Read(buf)
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return "", nil, fmt.Errorf("error reading file data: %w", err)
-		}
-		data = append(data, buf[:n]...)
+// downloadLimit returns how many bytes the content of a downloaded file may take:
+// the size the serving peer announced, unless it exceeds maxSize.
+func downloadLimit(hdr Header, maxSize int64) (int64, error) {
+	if maxSize > 0 && hdr.Size > maxSize {
+		return 0, fmt.Errorf("%w: '%s' is %d bytes, downloads are limited to %d", ErrDownloadTooLarge, hdr.Name, hdr.Size, maxSize)
+	}
+	return max(hdr.Size, 0), nil
+}
+
+// readBody reads a file's content following its header, decompressing it as the
+// header says. It fails with errLimitExceeded once the content exceeds limit bytes.
+func readBody(r *bufio.Reader, hdr Header, limit int64) ([]byte, error) {
+	body, err := decompressReader(r, hdr.Compression)
+	if err != nil {
+		return nil, fmt.Errorf("error reading file data: %w", err)
+	}
+	defer body.Close()
+	data, err := readAllLimit(body, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error reading file data: %w", err)
 	}
+	return data, nil
+}
 
-	log.Printf("Received file '%s' of size %d bytes\n", filename, len(data))
-	return filename, data, nil
+// copyBody writes a file's content following its header to w, decompressing it as
+// the header says, and returns its size and hash. It fails with errLimitExceeded
+// once the content exceeds limit bytes.
+func copyBody(r *bufio.Reader, hdr Header, limit int64, w io.Writer) (int64, string, error) {
+	body, err := decompressReader(r, hdr.Compression)
+	if err != nil {
+		return 0, "", fmt.Errorf("error reading file data: %w", err)
+	}
+	defer body.Close()
+	h := sha256.New()
+	n, err := io.Copy(&limitWriter{w: io.MultiWriter(w, h), n: limit}, body)
+	if err != nil {
+		return n, "", fmt.Errorf("error reading file data: %w", err)
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
 }
 
-// HandleStream is the stream handler for incoming file transfer streams
-func HandleStream(stream network.Stream) {
+// handleUpload is the stream handler for incoming file transfer streams. It stores
+// the file in the node's download directory and answers with an Ack.
+func (n *Node) handleUpload(stream network.Stream) {
+	logger := n.streamLogger(stream)
 	defer func(stream network.Stream) {
 		err := stream.Close()
 		if err != nil {
-			log.Printf("error closing stream")
+			logger.Debug("Error closing stream", "error", err)
 		}
 	}(stream)
 
-	log.Printf("New stream opened with peer %s\n", stream.Conn().RemotePeer().String())
+	start := time.Now()
+	ack, logger := n.receiveUpload(stream, logger)
+	observeTransfer(Received, time.Since(start), ack.Err())
+	if err := writeAck(stream, ack); err != nil {
+		logger.Warn("Error acknowledging file", "error", err)
+		return
+	}
+	if ack.Status != AckStored {
+		// The rest of a rejected file is discarded until the sender reads the ack
+		// and aborts.
+		_ = stream.CloseWrite()
+		_, _ = io.Copy(io.Discard, stream)
+	}
+}
+
+// receiveUpload stores a file uploaded over the stream and returns the verdict for
+// the uploader, along with logger annotated with the upload once it is known.
+func (n *Node) receiveUpload(stream network.Stream, logger *slog.Logger) (ack Ack, _ *slog.Logger) {
+	remote := stream.Conn().RemotePeer()
+	recv := n.recv
+	if !recv.allows(remote) {
+		logger.Warn("Rejected file: uploads from this peer are not allowed")
+		return Ack{Status: AckForbidden}, logger
+	}
 
-	// Receive file
-	filename, data, err := ReceiveFile(stream)
+	reader := bufio.NewReader(stream)
+	hdr, err := readHeader(reader)
 	if err != nil {
-		log.Printf("Error receiving file: %s\n", err)
-		return
+		logger.Warn("Error receiving file", "error", err)
+		return nack(AckInvalid, err), logger
+	}
+	logger = logger.With(transferAttr(hdr), "name", hdr.Name)
+	_, span := serveTransfer(spanReceive, remote, hdr)
+	defer func() { tracing.End(span, ack.Err()) }()
+	dest, err := file.LocalPath(recv.downloadDir, hdr.Name)
+	if err != nil {
+		logger.Warn("Rejected file", "error", err)
+		return nack(AckInvalid, err), logger
+	}
+	adm, reject, ok := recv.admit(remote, hdr.Name, hdr.Size)
+	if !ok {
+		logger.Warn("Rejected file", "status", reject.Status, "reason", reject.Message)
+		return reject, logger
+	}
+	defer adm.release()
+	// The file is written next to its destination and renamed into place once
+	// verified, so it is never held in memory.
+	out, err := file.CreateAtomic(dest)
+	if err != nil {
+		logger.Error("Error saving file", "error", err)
+		return nack(AckFailed, err), logger
+	}
+	defer out.Discard()
+	size, got, err := copyBody(reader, hdr, adm.limit, out)
+	if errors.Is(err, errLimitExceeded) {
+		logger.Warn("Rejected file", "status", adm.reject.Status, "reason", adm.reject.Message)
+		return adm.reject, logger
+	}
+	if err != nil {
+		logger.Warn("Error receiving file", "error", err)
+		return nack(AckInvalid, err), logger
+	}
+	if hdr.Hash != "" && got != hdr.Hash {
+		logger.Warn("Rejected file", "status", AckHashMismatch, "hash", got, "want", hdr.Hash)
+		return Ack{Status: AckHashMismatch, Message: fmt.Sprintf("received '%s' with hash %s, want %s", hdr.Name, got, hdr.Hash)}, logger
+	}
+	if err := out.Commit(hdr.Metadata, recv.policy); err != nil {
+		logger.Error("Error saving file", "error", err)
+		return nack(AckFailed, err), logger
+	}
+	if err := recv.record(remote, hdr.Name); err != nil {
+		logger.Error("Error recording upload", "error", err)
 	}
 
-	log.Printf("Successfully received file: %s, Size: %d bytes\n", filename, len(data))
+	logger.Info("Received file", "size", size)
+	return Ack{Status: AckStored}, logger
 }
@@ -1,9 +1,29 @@
 package network
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-libp2p/p2p/net/swarm"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/saurabhSPatel/p2p-file-sharing/config"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/file"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/logging"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -12,7 +32,7 @@ import (
 func TestSetupHost(t *testing.T) {
 	ctx := context.Background()
 
-	host, err := SetupHost(ctx)
+	host, err := SetupHost(ctx, config.Default(), logging.Discard())
 	if err != nil {
 		t.Fatalf("Failed to setup host: %v", err)
 	}
@@ -34,13 +54,13 @@ func TestSendAndReceiveFile(t *testing.T) {
 	ctx := context.Background()
 
 	// Create two hosts
-	host1, err := SetupHost(ctx)
+	host1, err := SetupHost(ctx, config.Default(), logging.Discard())
 	if err != nil {
 		t.Fatalf("Failed to create host1: %v", err)
 	}
 	defer host1.Close()
 
-	host2, err := SetupHost(ctx)
+	host2, err := SetupHost(ctx, config.Default(), logging.Discard())
 	if err != nil {
 		t.Fatalf("Failed to create host2: %v", err)
 	}
@@ -62,7 +82,7 @@ func TestSendAndReceiveFile(t *testing.T) {
 
 	go func() {
 		time.Sleep(time.Second) // Give host2 some time to set up the stream handler
-		err := SendFile(ctx, host1, host2.ID(), filename, fileContent)
+		err := host1.SendFile(ctx, host2.ID(), filename, fileContent)
 		if err != nil {
 			t.Errorf("Failed to send file: %v", err)
 		}
@@ -74,6 +94,9 @@ func TestSendAndReceiveFile(t *testing.T) {
 		if err != nil {
 			t.Fatalf("Error receiving file: %v", err)
 		}
+		if err := writeAck(stream, Ack{Status: AckStored}); err != nil {
+			t.Errorf("Error acknowledging file: %v", err)
+		}
 
 		if receivedFilename != filename {
 			t.Errorf("Expected filename %s, got %s", filename, receivedFilename)
@@ -91,13 +114,15 @@ func TestHandleStream(t *testing.T) {
 	ctx := context.Background()
 
 	// Set up two hosts (one to send, one to receive)
-	host1, err := SetupHost(ctx)
+	host1, err := SetupHost(ctx, config.Default(), logging.Discard())
 	if err != nil {
 		t.Fatalf("Failed to create host1: %v", err)
 	}
 	defer host1.Close()
 
-	host2, err := SetupHost(ctx)
+	cfg := config.Default()
+	cfg.DownloadDir = t.TempDir()
+	host2, err := SetupHost(ctx, cfg, logging.Discard())
 	if err != nil {
 		t.Fatalf("Failed to create host2: %v", err)
 	}
@@ -113,24 +138,1245 @@ func TestHandleStream(t *testing.T) {
 		t.Fatalf("Failed to connect host2 to host1: %v", err)
 	}
 
-	// Set up stream handler for host2 to use HandleStream for incoming files
-	host2.SetStreamHandler(ProtocolID, func(stream network.Stream) {
-		HandleStream(stream)
-	})
-
 	// Prepare file data to send
 	filename := "testfile.txt"
 	fileContent := []byte("This is a test file content.")
 
-	// Use a goroutine to simulate sending a file from host1 to host2
-	go func() {
-		time.Sleep(time.Second) // Give host2 time to set up the stream handler
-		err := SendFile(ctx, host1, host2.ID(), filename, fileContent)
+	// SendFile returns once host2's upload handler stored the file.
+	if err := host1.SendFile(ctx, host2.ID(), filename, fileContent); err != nil {
+		t.Fatalf("Failed to send file: %v", err)
+	}
+	got, err := os.ReadFile(filepath.Join(cfg.DownloadDir, filename))
+	if err != nil || string(got) != string(fileContent) {
+		t.Errorf("stored file = %q, %v; want %q", got, err, fileContent)
+	}
+}
+
+func TestSendFile_Rejected(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	sender, err := SetupHost(ctx, config.Default(), logging.Discard())
+	if err != nil {
+		t.Fatalf("Failed to create host: %v", err)
+	}
+	defer sender.Close()
+	other, err := SetupHost(ctx, config.Default(), logging.Discard())
+	if err != nil {
+		t.Fatalf("Failed to create host: %v", err)
+	}
+	defer other.Close()
+
+	newReceiver := func(allow ...string) *Node {
+		cfg := config.Default()
+		cfg.DownloadDir = t.TempDir()
+		cfg.Uploads.Allow = allow
+		h, err := SetupHost(ctx, cfg, logging.Discard())
 		if err != nil {
-			t.Errorf("Failed to send file: %v", err)
+			t.Fatalf("Failed to create host: %v", err)
 		}
-	}()
+		t.Cleanup(func() { h.Close() })
+		if err := sender.Connect(ctx, peer.AddrInfo{ID: h.ID(), Addrs: h.Addrs()}); err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		return h
+	}
+	open := newReceiver()
+	restricted := newReceiver(other.ID().String())
+	allowed := newReceiver(sender.ID().String())
+
+	data := []byte("quarterly report")
+	tests := []struct {
+		name     string
+		receiver *Node
+		hdr      Header
+		wantErr  error
+	}{
+		{name: "stored", receiver: open, hdr: Header{Name: "report.txt", Hash: hashData(data)}},
+		{name: "allowed peer", receiver: allowed, hdr: Header{Name: "report.txt", Hash: hashData(data)}},
+		{name: "peer not allowed", receiver: restricted, hdr: Header{Name: "report.txt"}, wantErr: ErrForbidden},
+		{name: "absolute name", receiver: open, hdr: Header{Name: "/tmp/report.txt"}, wantErr: ErrInvalidFile},
+		{name: "name outside download directory", receiver: open, hdr: Header{Name: "../report.txt"}, wantErr: ErrInvalidFile},
+		{name: "hash mismatch", receiver: open, hdr: Header{Name: "report.txt", Hash: hashData([]byte("other"))}, wantErr: ErrHashMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := sender.sendFile(ctx, tt.receiver.ID(), tt.hdr, data)
+			if tt.wantErr == nil && err != nil {
+				t.Fatalf("sendFile() error = %v", err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("sendFile() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// A rejection aborts the upload before the rest of a large file is sent.
+	if err := sender.SendFile(ctx, restricted.ID(), "large.bin", make([]byte, 64<<20)); !errors.Is(err, ErrForbidden) {
+		t.Errorf("SendFile() error = %v, want %v", err, ErrForbidden)
+	}
+	if _, err := sender.SendFileDelta(ctx, restricted.ID(), "report.txt", data, file.Metadata{}); !errors.Is(err, ErrForbidden) {
+		t.Errorf("SendFileDelta() error = %v, want %v", err, ErrForbidden)
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "report.txt"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sender.SendTree(ctx, restricted.ID(), "project", dir); !errors.Is(err, ErrForbidden) {
+		t.Errorf("SendTree() error = %v, want %v", err, ErrForbidden)
+	}
+}
+
+func TestSendFile_Quota(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	newSender := func() *Node {
+		h, err := SetupHost(ctx, config.Default(), logging.Discard())
+		if err != nil {
+			t.Fatalf("Failed to create host: %v", err)
+		}
+		t.Cleanup(func() { h.Close() })
+		return h
+	}
+	sender, other := newSender(), newSender()
+	newReceiver := func(uploads config.UploadConfig) *Node {
+		cfg := config.Default()
+		cfg.DownloadDir = t.TempDir()
+		cfg.DataDir = t.TempDir()
+		cfg.Uploads = uploads
+		h, err := SetupHost(ctx, cfg, logging.Discard())
+		if err != nil {
+			t.Fatalf("Failed to create host: %v", err)
+		}
+		t.Cleanup(func() { h.Close() })
+		for _, s := range []*Node{sender, other} {
+			if err := s.Connect(ctx, peer.AddrInfo{ID: h.ID(), Addrs: h.Addrs()}); err != nil {
+				t.Fatalf("Failed to connect: %v", err)
+			}
+		}
+		return h
+	}
+	maxSize := newReceiver(config.UploadConfig{MaxFileSize: 1000})
+	peerQuota := newReceiver(config.UploadConfig{PeerQuota: 1500})
+	quota := newReceiver(config.UploadConfig{Quota: 2500})
+	full := newReceiver(config.UploadConfig{MinFreeSpace: 1 << 62})
+
+	random := func(n int) []byte {
+		data := make([]byte, n)
+		rand.New(rand.NewSource(int64(n))).Read(data)
+		return data
+	}
+	tests := []struct {
+		name     string
+		from     *Node
+		receiver *Node
+		file     string
+		size     int
+		wantErr  error
+	}{
+		{name: "within max file size", from: sender, receiver: maxSize, file: "a.bin", size: 1000},
+		{name: "over max file size", from: sender, receiver: maxSize, file: "b.bin", size: 1001, wantErr: ErrTooLarge},
+		{name: "within peer quota", from: sender, receiver: peerQuota, file: "a.bin", size: 1000},
+		{name: "over peer quota", from: sender, receiver: peerQuota, file: "b.bin", size: 1000, wantErr: ErrQuotaExceeded},
+		{name: "replacing own upload", from: sender, receiver: peerQuota, file: "a.bin", size: 1400},
+		{name: "other peer's quota", from: other, receiver: peerQuota, file: "c.bin", size: 1000},
+		{name: "within total quota", from: sender, receiver: quota, file: "a.bin", size: 2000},
+		{name: "over total quota", from: other, receiver: quota, file: "b.bin", size: 1000, wantErr: ErrQuotaExceeded},
+		{name: "free space", from: sender, receiver: full, file: "a.bin", size: 10, wantErr: ErrDiskFull},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.from.SendFile(ctx, tt.receiver.ID(), tt.file, random(tt.size))
+			if tt.wantErr == nil && err != nil {
+				t.Fatalf("SendFile() error = %v", err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("SendFile() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// The limits also hold when the header understates the size, and for delta uploads.
+	if _, err := sender.sendFile(ctx, maxSize.ID(), Header{Name: "c.bin"}, random(2000)); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("sendFile() without a size error = %v, want %v", err, ErrTooLarge)
+	}
+	if _, err := sender.SendFileDelta(ctx, maxSize.ID(), "d.bin", random(2000), file.Metadata{}); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("SendFileDelta() error = %v, want %v", err, ErrTooLarge)
+	}
+
+	// Trees are held to the maximum file size per file and to the quotas as a whole.
+	dir := t.TempDir()
+	for name, size := range map[string]int{"a.bin": 800, "b.bin": 800} {
+		if err := os.WriteFile(filepath.Join(dir, name), random(size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := sender.SendTree(ctx, maxSize.ID(), "tree", dir); err != nil {
+		t.Errorf("SendTree() of files within max file size error = %v", err)
+	}
+	if _, err := other.SendTree(ctx, peerQuota.ID(), "tree", dir); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("SendTree() over peer quota error = %v, want %v", err, ErrQuotaExceeded)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "c.bin"), random(1001), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sender.SendTree(ctx, maxSize.ID(), "large", dir); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("SendTree() over max file size error = %v, want %v", err, ErrTooLarge)
+	}
+}
+
+func TestReceiver_Admit(t *testing.T) {
+	cfg := config.Default()
+	cfg.DownloadDir = t.TempDir()
+	cfg.DataDir = t.TempDir()
+	cfg.Uploads = config.UploadConfig{Quota: 2000, PeerQuota: 1500}
+	recv, err := newReceiver(cfg)
+	if err != nil {
+		t.Fatalf("newReceiver() error = %v", err)
+	}
+	p1, p2 := peer.ID("peer-1"), peer.ID("peer-2")
+
+	// Uploads in progress count against the quotas until they are released.
+	first, _, ok := recv.admit(p1, "a.bin", 1000)
+	if !ok {
+		t.Fatalf("admit() of the first upload was rejected")
+	}
+	if _, ack, ok := recv.admit(p1, "b.bin", 1000); ok || ack.Status != AckQuotaExceeded {
+		t.Errorf("admit() over the peer quota = %v, %v, want %s", ack, ok, AckQuotaExceeded)
+	}
+	if _, ack, ok := recv.admit(p2, "c.bin", 1500); ok || ack.Status != AckQuotaExceeded {
+		t.Errorf("admit() over the total quota = %v, %v, want %s", ack, ok, AckQuotaExceeded)
+	}
+	first.release()
+	if _, _, ok := recv.admit(p2, "c.bin", 1500); !ok {
+		t.Errorf("admit() after release was rejected")
+	}
+
+	// A tree reserves the space of its files as they arrive.
+	tree, _, ok := recv.admitTree(p1, "tree")
+	if !ok {
+		t.Fatalf("admitTree() was rejected")
+	}
+	if _, ok := tree.grow(400); !ok {
+		t.Errorf("grow() within the quotas was rejected")
+	}
+	if ack, ok := tree.grow(200); ok || ack.Status != AckQuotaExceeded {
+		t.Errorf("grow() over the total quota = %v, %v, want %s", ack, ok, AckQuotaExceeded)
+	}
+}
+
+func TestResourceLimits(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	sender, err := SetupHost(ctx, config.Default(), logging.Discard())
+	if err != nil {
+		t.Fatalf("Failed to setup host: %v", err)
+	}
+	defer sender.Close()
+	const holdProtocol = "/test/hold/1.0.0"
+	cfg := config.Default()
+	cfg.DownloadDir = t.TempDir()
+	cfg.Resources.ProtocolPeer = map[string]config.ResourceLimits{
+		ProtocolID:            {Memory: 2 << 20},
+		DeltaUploadProtocolID: {Memory: 2 << 20},
+	}
+	cfg.Resources.Protocols = map[string]config.ResourceLimits{holdProtocol: {Streams: 1, Memory: 1 << 20}}
+	receiver, err := SetupHost(ctx, cfg, logging.Discard())
+	if err != nil {
+		t.Fatalf("Failed to setup host: %v", err)
+	}
+	defer receiver.Close()
+	receiver.SetStreamHandler(holdProtocol, func(stream network.Stream) {
+		// The reservation exceeds the protocol's memory limit and is refused.
+		if err := stream.Scope().ReserveMemory(2<<20, network.ReservationPriorityAlways); err == nil {
+			t.Errorf("ReserveMemory() over the protocol limit succeeded")
+		}
+		_, _ = stream.Write([]byte{'.'})
+		<-ctx.Done()
+		_ = stream.Reset()
+	})
+	if err := sender.Connect(ctx, peer.AddrInfo{ID: receiver.ID(), Addrs: receiver.Addrs()}); err != nil {
+		t.Fatalf("Failed to connect hosts: %v", err)
+	}
+
+	// Uploads are written to disk as they arrive, so they take no memory for the file.
+	large := make([]byte, 3<<20)
+	if err := sender.SendFile(ctx, receiver.ID(), "large.bin", large); err != nil {
+		t.Errorf("SendFile() of a file over the memory limit error = %v", err)
+	}
+	if _, err := sender.SendFileDelta(ctx, receiver.ID(), "large.bin", large, file.Metadata{}); err != nil {
+		t.Errorf("SendFileDelta() of a file over the memory limit error = %v", err)
+	}
+
+	// The receiver serves a single stream of the protocol at a time.
+	for i, wantErr := range []bool{false, true} {
+		stream, err := sender.NewStream(ctx, receiver.ID(), holdProtocol)
+		if err != nil {
+			t.Fatalf("NewStream() error = %v", err)
+		}
+		defer stream.Reset()
+		_ = stream.SetReadDeadline(time.Now().Add(10 * time.Second))
+		if _, err := stream.Read(make([]byte, 1)); (err != nil) != wantErr {
+			t.Errorf("stream %d: Read() error = %v, want error %t", i, err, wantErr)
+		}
+	}
+
+	got := receiver.ResourceRejections()
+	if got[RejectedMemory] == 0 || got[RejectedProtocol] == 0 {
+		t.Errorf("ResourceRejections() = %v, want memory and protocol rejections", got)
+	}
+}
+
+func TestAck_Err(t *testing.T) {
+	tests := []struct {
+		name    string
+		ack     Ack
+		wantErr error
+	}{
+		{name: "stored", ack: Ack{Status: AckStored}},
+		{name: "forbidden", ack: Ack{Status: AckForbidden}, wantErr: ErrForbidden},
+		{name: "hash mismatch", ack: Ack{Status: AckHashMismatch, Message: "bad hash"}, wantErr: ErrHashMismatch},
+		{name: "quota exceeded", ack: Ack{Status: AckQuotaExceeded}, wantErr: ErrQuotaExceeded},
+		{name: "disk full", ack: nack(AckFailed, &fs.PathError{Op: "write", Path: "f", Err: syscall.ENOSPC}), wantErr: ErrDiskFull},
+		{name: "resource limit", ack: nack(AckFailed, fmt.Errorf("reserving memory: %w", network.ErrResourceLimitExceeded)), wantErr: ErrBusy},
+		{name: "other failure", ack: nack(AckFailed, errors.New("permission denied")), wantErr: ErrNotStored},
+		{name: "unknown status", ack: Ack{Status: "exploded"}, wantErr: ErrNotStored},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.ack.Err()
+			if (tt.wantErr == nil) != (err == nil) || (tt.wantErr != nil && !errors.Is(err, tt.wantErr)) {
+				t.Errorf("Err() = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestStreamTimeouts(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
 
-	// Wait for the transfer to complete
-	time.Sleep(3 * time.Second) // Give enough time for the file transfer and stream handling
+	server, err := SetupHost(ctx, config.Default(), logging.Discard())
+	if err != nil {
+		t.Fatalf("Failed to setup host: %v", err)
+	}
+	defer server.Close()
+	// The stalled peer accepts streams and never answers.
+	const stallProtocol = "/test/stall/1.0.0"
+	server.SetStreamHandler(stallProtocol, func(stream network.Stream) {
+		<-ctx.Done()
+		_ = stream.Reset()
+	})
+	// The slow peer keeps the stream busy, sending a byte every 20ms.
+	const slowProtocol = "/test/slow/1.0.0"
+	server.SetStreamHandler(slowProtocol, func(stream network.Stream) {
+		defer stream.Close()
+		for i := 0; i < 20; i++ {
+			if _, err := stream.Write([]byte{'.'}); err != nil {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	})
+
+	tests := []struct {
+		name     string
+		streams  config.StreamConfig
+		protocol protocol.ID
+		cancel   time.Duration
+		wantErr  error
+	}{
+		{name: "idle", streams: config.StreamConfig{IdleTimeout: config.Duration(200 * time.Millisecond)}, protocol: stallProtocol, wantErr: ErrStreamTimeout},
+		{name: "busy within idle timeout", streams: config.StreamConfig{IdleTimeout: config.Duration(200 * time.Millisecond)}, protocol: slowProtocol},
+		{name: "read timeout", streams: config.StreamConfig{ReadTimeout: config.Duration(300 * time.Millisecond)}, protocol: slowProtocol, wantErr: ErrStreamTimeout},
+		{name: "cancelled", protocol: stallProtocol, cancel: 200 * time.Millisecond, wantErr: context.Canceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.Default()
+			cfg.Streams = tt.streams
+			client, err := SetupHost(ctx, cfg, logging.Discard())
+			if err != nil {
+				t.Fatalf("Failed to setup host: %v", err)
+			}
+			defer client.Close()
+			if err := client.Connect(ctx, peer.AddrInfo{ID: server.ID(), Addrs: server.Addrs()}); err != nil {
+				t.Fatalf("Failed to connect hosts: %v", err)
+			}
+
+			streamCtx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			if tt.cancel > 0 {
+				time.AfterFunc(tt.cancel, cancel)
+			}
+			stream, err := client.NewStream(streamCtx, server.ID(), tt.protocol)
+			if err != nil {
+				t.Fatalf("NewStream() error = %v", err)
+			}
+			_, err = io.ReadAll(stream)
+			if (tt.wantErr == nil) != (err == nil) || (tt.wantErr != nil && !errors.Is(err, tt.wantErr)) {
+				t.Errorf("ReadAll() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// A receiver abandons an upload that stalls halfway.
+	cfg := config.Default()
+	cfg.DownloadDir = t.TempDir()
+	cfg.Streams.IdleTimeout = config.Duration(200 * time.Millisecond)
+	receiver, err := SetupHost(ctx, cfg, logging.Discard())
+	if err != nil {
+		t.Fatalf("Failed to setup host: %v", err)
+	}
+	defer receiver.Close()
+	if err := server.Connect(ctx, peer.AddrInfo{ID: receiver.ID(), Addrs: receiver.Addrs()}); err != nil {
+		t.Fatalf("Failed to connect hosts: %v", err)
+	}
+	stream, err := server.NewStream(ctx, receiver.ID(), ProtocolID)
+	if err != nil {
+		t.Fatalf("NewStream() error = %v", err)
+	}
+	defer stream.Close()
+	if _, err := stream.Write([]byte(`{"name": "stalled.txt", `)); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	_ = stream.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadAll(stream); !errors.Is(err, network.ErrReset) {
+		t.Errorf("stalled upload error = %v, want %v", err, network.ErrReset)
+	}
+}
+
+func TestErrorType(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{err: Ack{Status: AckQuotaExceeded, Message: "full"}.Err(), want: "quota_exceeded"},
+		{err: fmt.Errorf("%w: %w", ErrNoAck, fmt.Errorf("%w: i/o deadline reached", ErrStreamTimeout)), want: "timeout"},
+		{err: fmt.Errorf("stream closed: %w", context.Canceled), want: "canceled"},
+		{err: fmt.Errorf("%w: EOF", ErrNoAck), want: "no_ack"},
+		{err: fmt.Errorf("%w: a.txt", ErrFileUnavailable), want: "unavailable"},
+		{err: network.ErrReset, want: "reset"},
+		{err: io.ErrUnexpectedEOF, want: "other"},
+	}
+	for _, tt := range tests {
+		if got := errorType(tt.err); got != tt.want {
+			t.Errorf("errorType(%v) = %s, want %s", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestTracing(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	recorder := tracetest.NewSpanRecorder()
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(prev)
+
+	cfg := config.Default()
+	cfg.SharedDir = t.TempDir()
+	cfg.DownloadDir = t.TempDir()
+	if err := os.WriteFile(filepath.Join(cfg.SharedDir, "a.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	server, err := SetupHost(ctx, cfg, logging.Discard())
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer server.Close()
+	client, err := SetupHost(ctx, config.Default(), logging.Discard())
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer client.Close()
+	client.Peerstore().AddAddrs(server.ID(), server.Addrs(), peerstore.PermanentAddrTTL)
+
+	// span waits for the ended span with the given name and kind, which the server
+	// may end after the client returns.
+	span := func(name string, kind string) sdktrace.ReadOnlySpan {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			for _, s := range recorder.Ended() {
+				if s.Name() == name && s.SpanKind().String() == kind {
+					return s
+				}
+			}
+		}
+		t.Fatalf("No %s span %s", kind, name)
+		return nil
+	}
+
+	if _, _, err := client.FetchFile(ctx, server.ID(), "a.txt"); err != nil {
+		t.Fatalf("FetchFile() error = %v", err)
+	}
+	receive := span(spanReceive, "client")
+	for _, s := range []sdktrace.ReadOnlySpan{span(spanDial, "internal"), span(spanOpenStream, "internal"), span(spanSend, "server")} {
+		if s.SpanContext().TraceID() != receive.SpanContext().TraceID() || s.Parent().SpanID() != receive.SpanContext().SpanID() {
+			t.Errorf("Download span %s is not a child of %s", s.Name(), receive.Name())
+		}
+	}
+
+	recorder.Reset()
+	if err := client.SendFile(ctx, server.ID(), "b.txt", []byte("world")); err != nil {
+		t.Fatalf("SendFile() error = %v", err)
+	}
+	send, received := span(spanSend, "client"), span(spanReceive, "server")
+	if received.SpanContext().TraceID() != send.SpanContext().TraceID() || received.Parent().SpanID() != send.SpanContext().SpanID() {
+		t.Errorf("Upload span %s is not a child of %s", received.Name(), send.Name())
+	}
+}
+
+func TestMatchProtocol(t *testing.T) {
+	tests := []struct {
+		name string
+		id   protocol.ID
+		want bool
+	}{
+		{name: "current version", id: ProtocolID, want: true},
+		{name: "newer minor version", id: "/p2p-file-sharing/3.4.2", want: true},
+		{name: "different major version", id: "/p2p-file-sharing/2.0.0", want: false},
+		{name: "capability protocol", id: CompressionCapability, want: false},
+		{name: "malformed version", id: "/p2p-file-sharing/1.x.0", want: false},
+		{name: "other protocol", id: "/ipfs/ping/1.0.0", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := MatchProtocol(tt.id); got != tt.want {
+				t.Errorf("MatchProtocol(%q) = %v, want %v", tt.id, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPeerStats_Score(t *testing.T) {
+	tests := []struct {
+		name  string
+		stats PeerStats
+		want  int
+	}{
+		{name: "unknown peer", stats: PeerStats{}, want: 50},
+		{name: "reliable peer", stats: PeerStats{Successes: 8}, want: 90},
+		{name: "failing peer", stats: PeerStats{Failures: 8}, want: 10},
+		{name: "slow peer", stats: PeerStats{Successes: 8, Latency: 200 * time.Millisecond}, want: 70},
+		{name: "latency penalty is capped", stats: PeerStats{Latency: time.Minute}, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.stats.Score(); got != tt.want {
+				t.Errorf("Score() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecordTransfer(t *testing.T) {
+	ctx := context.Background()
+
+	host1, err := SetupHost(ctx, config.Default(), logging.Discard())
+	if err != nil {
+		t.Fatalf("Failed to create host1: %v", err)
+	}
+	defer host1.Close()
+
+	host2, err := SetupHost(ctx, config.Default(), logging.Discard())
+	if err != nil {
+		t.Fatalf("Failed to create host2: %v", err)
+	}
+	defer host2.Close()
+
+	host1.RecordTransfer(host2.ID(), Sent, 1000, time.Second, nil)
+	host1.RecordTransfer(host2.ID(), Sent, 2000, time.Second, nil)
+	host1.RecordTransfer(host2.ID(), Sent, 0, time.Second, io.ErrUnexpectedEOF)
+
+	stats := Stats(host1, host2.ID())
+	if stats.Successes != 2 || stats.Failures != 1 {
+		t.Errorf("Stats() = %+v, want 2 successes and 1 failure", stats)
+	}
+	if want := 0.3*2000 + 0.7*1000; stats.Throughput != want {
+		t.Errorf("Throughput = %v, want %v", stats.Throughput, want)
+	}
+
+	info := host1.ConnManager().GetTagInfo(host2.ID())
+	if info == nil || info.Tags[scoreTag] != stats.Score() {
+		t.Errorf("Expected score tag %d, got %+v", stats.Score(), info)
+	}
+}
+
+func TestSetupHost_AddressBook(t *testing.T) {
+	ctx := context.Background()
+
+	host1, err := SetupHost(ctx, config.Default(), logging.Discard())
+	if err != nil {
+		t.Fatalf("Failed to create host1: %v", err)
+	}
+	defer host1.Close()
+
+	cfg := config.Default()
+	cfg.AddressBook = []string{fmt.Sprintf("%s/p2p/%s", host1.Addrs()[0], host1.ID())}
+	host2, err := SetupHost(ctx, cfg, logging.Discard())
+	if err != nil {
+		t.Fatalf("Failed to create host2: %v", err)
+	}
+	defer host2.Close()
+
+	if !host2.ConnManager().IsProtected(host1.ID(), addressBookTag) {
+		t.Errorf("Expected address-book peer %s to be protected", host1.ID())
+	}
+
+	cfg.AddressBook = []string{"/ip4/127.0.0.1/tcp/4001"}
+	if _, err := SetupHost(ctx, cfg, logging.Discard()); err == nil {
+		t.Errorf("Expected an error for an address-book entry without a peer ID")
+	}
+}
+
+func TestLoadIdentity(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "identity.key")
+
+	first, err := LoadIdentity(path)
+	if err != nil {
+		t.Fatalf("LoadIdentity() error = %v", err)
+	}
+	second, err := LoadIdentity(path)
+	if err != nil {
+		t.Fatalf("LoadIdentity() error = %v", err)
+	}
+	if !first.Equals(second) {
+		t.Errorf("Expected the saved identity to be loaded again")
+	}
+
+	if key, err := LoadIdentity(""); key != nil || err != nil {
+		t.Errorf("LoadIdentity(\"\") = %v, %v, want nil, nil", key, err)
+	}
+}
+
+func TestRankPeers(t *testing.T) {
+	ctx := context.Background()
+
+	h, err := SetupHost(ctx, config.Default(), logging.Discard())
+	if err != nil {
+		t.Fatalf("Failed to create host: %v", err)
+	}
+	defer h.Close()
+
+	ids := make([]peer.ID, 4)
+	for i := range ids {
+		other, err := SetupHost(ctx, config.Default(), logging.Discard())
+		if err != nil {
+			t.Fatalf("Failed to create peer host: %v", err)
+		}
+		defer other.Close()
+		ids[i] = other.ID()
+	}
+
+	// ids[0]: slow link, ids[1]: fast link, ids[2]: failing, ids[3]: unknown but nearby.
+	h.Peerstore().RecordLatency(ids[0], 300*time.Millisecond)
+	h.RecordTransfer(ids[0], Sent, 1000, time.Second, nil)
+	h.Peerstore().RecordLatency(ids[1], 5*time.Millisecond)
+	h.RecordTransfer(ids[1], Sent, 1000, time.Millisecond, nil)
+	h.RecordTransfer(ids[2], Sent, 0, time.Second, io.ErrUnexpectedEOF)
+	h.Peerstore().RecordLatency(ids[3], 5*time.Millisecond)
+
+	var peers []peer.AddrInfo
+	for _, id := range ids {
+		peers = append(peers, peer.AddrInfo{ID: id})
+	}
+
+	var got []peer.ID
+	for _, pi := range RankPeers(h, peers) {
+		got = append(got, pi.ID)
+	}
+	want := []peer.ID{ids[1], ids[3], ids[0], ids[2]}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("RankPeers() = %v, want %v", got, want)
+		}
+	}
+}
+
+// TestSetupHost_RelayedConnection simulates a peer behind NAT that is only reachable
+// through a local circuit relay.
+func TestSetupHost_RelayedConnection(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	relayCfg := config.Default()
+	relayCfg.NAT = config.NATConfig{RelayService: true, ForceReachability: "public"}
+	relay, err := SetupHost(ctx, relayCfg, logging.Discard())
+	if err != nil {
+		t.Fatalf("Failed to create relay: %v", err)
+	}
+	defer relay.Close()
+
+	privateCfg := config.Default()
+	privateCfg.DownloadDir = t.TempDir()
+	privateCfg.NAT = config.NATConfig{
+		ForceReachability: "private",
+		StaticRelays:      []string{fmt.Sprintf("%s/p2p/%s", relay.Addrs()[0], relay.ID())},
+	}
+	private, err := SetupHost(ctx, privateCfg, logging.Discard())
+	if err != nil {
+		t.Fatalf("Failed to create private host: %v", err)
+	}
+	defer private.Close()
+
+	if got := Reachability(private); got != network.ReachabilityPrivate {
+		t.Errorf("Reachability() = %s, want %s", got, network.ReachabilityPrivate)
+	}
+
+	dialer, err := SetupHost(ctx, config.Default(), logging.Discard())
+	if err != nil {
+		t.Fatalf("Failed to create dialer: %v", err)
+	}
+	defer dialer.Close()
+
+	// Relay addresses on loopback are not advertised, so dial the circuit address
+	// directly until the private host has reserved a slot on the relay.
+	circuit := fmt.Sprintf("%s/p2p/%s/p2p-circuit/p2p/%s", relay.Addrs()[0], relay.ID(), private.ID())
+	pi, err := peer.AddrInfoFromString(circuit)
+	if err != nil {
+		t.Fatalf("Failed to parse circuit address %s: %v", circuit, err)
+	}
+	for {
+		err := dialer.Connect(ctx, *pi)
+		if err == nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("Failed to connect through relay: %v", err)
+		case <-time.After(500 * time.Millisecond):
+			dialer.Network().(*swarm.Swarm).Backoff().Clear(private.ID())
+		}
+	}
+
+	conns := dialer.Network().ConnsToPeer(private.ID())
+	if len(conns) == 0 {
+		t.Fatalf("Expected a connection to the private host")
+	}
+	if !conns[0].Stat().Limited {
+		t.Errorf("Expected the connection to be relayed, got %s", conns[0].RemoteMultiaddr())
+	}
+
+	// Transfers work over the relayed connection alone.
+	content := []byte("relayed content")
+	if err := dialer.SendFile(ctx, private.ID(), "relayed.txt", content); err != nil {
+		t.Fatalf("Failed to send file through relay: %v", err)
+	}
+	got, err := os.ReadFile(filepath.Join(privateCfg.DownloadDir, "relayed.txt"))
+	if err != nil || !bytes.Equal(got, content) {
+		t.Errorf("stored file = %q, %v; want %q", got, err, content)
+	}
+	for _, c := range dialer.Network().ConnsToPeer(private.ID()) {
+		if !c.Stat().Limited {
+			t.Errorf("Expected only relayed connections, got %s", c.RemoteMultiaddr())
+		}
+	}
+}
+
+func TestTransportName(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{addr: "/ip4/127.0.0.1/tcp/4001", want: "tcp"},
+		{addr: "/ip6/::1/udp/4001/quic-v1", want: "quic-v1"},
+		{addr: "/ip4/127.0.0.1/udp/4001/quic-v1/webtransport", want: "webtransport"},
+		{addr: "/ip4/127.0.0.1/tcp/4001/p2p/12D3KooWDpJ7As7BWAwRMfu1VU2WCqNjvq387JEYKDBj4kx6nXTN/p2p-circuit", want: "p2p-circuit"},
+		{addr: "/ip4/127.0.0.1/udp/4001", want: "unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			if got := TransportName(ma.StringCast(tt.addr)); got != tt.want {
+				t.Errorf("TransportName(%s) = %v, want %v", tt.addr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetupHost_Transports(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cfg := config.Default()
+	cfg.Transports = config.TransportConfig{QUIC: true, WebTransport: true, IPv6: true}
+	quicHost, err := SetupHost(ctx, cfg, logging.Discard())
+	if err != nil {
+		t.Fatalf("Failed to create QUIC host: %v", err)
+	}
+	defer quicHost.Close()
+
+	groups := AddrsByTransport(quicHost.Addrs())
+	if len(groups["tcp"]) != 0 {
+		t.Errorf("Expected no TCP addresses, got %v", groups["tcp"])
+	}
+	for _, name := range []string{"quic-v1", "webtransport"} {
+		if len(groups[name]) == 0 {
+			t.Errorf("Expected %s addresses, got %v", name, quicHost.Addrs())
+		}
+	}
+
+	// A TCP-only host has no transport for the QUIC-only host's addresses.
+	tcpCfg := config.Default()
+	tcpCfg.Transports = config.TransportConfig{TCP: true}
+	tcpHost, err := SetupHost(ctx, tcpCfg, logging.Discard())
+	if err != nil {
+		t.Fatalf("Failed to create TCP host: %v", err)
+	}
+	defer tcpHost.Close()
+
+	target := peer.AddrInfo{ID: quicHost.ID(), Addrs: quicHost.Addrs()}
+	if err := tcpHost.Connect(ctx, target); err == nil {
+		t.Errorf("Expected TCP-only host to fail dialing a QUIC-only host")
+	}
+
+	cfg.Transports = config.TransportConfig{}
+	if _, err := SetupHost(ctx, cfg, logging.Discard()); err == nil {
+		t.Errorf("Expected an error when no transport is enabled")
+	}
+}
+
+// writeSwarmKey writes a swarm key file with the given hex-encoded key.
+func writeSwarmKey(t *testing.T, key string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "swarm.key")
+	content := "/key/swarm/psk/1.0.0/\n/base16/\n" + key + "\n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write swarm key: %v", err)
+	}
+	return path
+}
+
+func TestSetupHost_PrivateNetwork(t *testing.T) {
+	// A mismatched handshake can take until the upgrader's 15s negotiation timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	key1 := writeSwarmKey(t, strings.Repeat("ab", 32))
+	key2 := writeSwarmKey(t, strings.Repeat("cd", 32))
+
+	newHost := func(keyPath string) *Node {
+		cfg := config.Default()
+		cfg.SwarmKeyPath = keyPath
+		h, err := SetupHost(ctx, cfg, logging.Discard())
+		if err != nil {
+			t.Fatalf("Failed to create host: %v", err)
+		}
+		t.Cleanup(func() { h.Close() })
+		return h
+	}
+
+	member := newHost(key1)
+	tests := []struct {
+		name     string
+		target   *Node
+		wantErr  bool
+		mismatch bool
+	}{
+		{name: "same key", target: newHost(key1)},
+		{name: "different key", target: newHost(key2), wantErr: true, mismatch: true},
+		{name: "public node", target: newHost(""), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := member.Connect(ctx, peer.AddrInfo{ID: tt.target.ID(), Addrs: tt.target.Addrs()})
+			if tt.wantErr != (err != nil) || tt.mismatch != errors.Is(err, ErrSwarmKeyMismatch) {
+				t.Errorf("Connect() error = %v, want error %v, mismatch %v", err, tt.wantErr, tt.mismatch)
+			}
+		})
+	}
+
+	if fingerprint, ok := member.PrivateNetwork(); !ok || len(fingerprint) != 16 {
+		t.Errorf("PrivateNetwork() = %q, %v, want a 16 character fingerprint", fingerprint, ok)
+	}
+
+	if _, err := LoadSwarmKey(writeSwarmKey(t, "not-hex")); err == nil {
+		t.Errorf("Expected an error for a malformed swarm key")
+	}
+}
+
+func TestFetchFile(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cfg := config.Default()
+	cfg.SharedDir = t.TempDir()
+	modTime := time.Date(2024, 2, 3, 4, 5, 6, 0, time.UTC)
+	if err := os.WriteFile(filepath.Join(cfg.SharedDir, "a.txt"), []byte("hello"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filepath.Join(cfg.SharedDir, "a.txt"), modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	server, err := SetupHost(ctx, cfg, logging.Discard())
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer server.Close()
+
+	client, err := SetupHost(ctx, config.Default(), logging.Discard())
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer client.Close()
+	if err := client.Connect(ctx, peer.AddrInfo{ID: server.ID(), Addrs: server.Addrs()}); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+
+	entries, err := client.ListRemoteFiles(ctx, server.ID())
+	if err != nil {
+		t.Fatalf("ListRemoteFiles() error = %v", err)
+	}
+	if len(entries) != 1 || entries[0].Path != "a.txt" || entries[0].Size != 5 {
+		t.Errorf("ListRemoteFiles() = %+v, want a.txt", entries)
+	}
+
+	tests := []struct {
+		name     string
+		file     string
+		want     string
+		wantMeta file.Metadata
+		wantErr  error
+	}{
+		{name: "shared file", file: "a.txt", want: "hello", wantMeta: file.Metadata{Mode: 0750, ModTime: modTime}},
+		{name: "missing file", file: "b.txt", wantErr: ErrFileUnavailable},
+		{name: "outside shared directory", file: "../a.txt", wantErr: ErrFileUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, md, err := client.FetchFile(ctx, server.ID(), tt.file)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("FetchFile() error = %v, want %v", err, tt.wantErr)
+			}
+			if string(data) != tt.want {
+				t.Errorf("FetchFile() = %q, want %q", data, tt.want)
+			}
+			if md.Mode != tt.wantMeta.Mode || !md.ModTime.Equal(tt.wantMeta.ModTime) {
+				t.Errorf("FetchFile() metadata = %+v, want %+v", md, tt.wantMeta)
+			}
+		})
+	}
+}
+
+func TestSendTree_FetchTree(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	newHost := func() (*Node, config.Config) {
+		cfg := config.Default()
+		cfg.SharedDir = t.TempDir()
+		cfg.DownloadDir = t.TempDir()
+		h, err := SetupHost(ctx, cfg, logging.Discard())
+		if err != nil {
+			t.Fatalf("Failed to create host: %v", err)
+		}
+		t.Cleanup(func() { h.Close() })
+		return h, cfg
+	}
+	server, serverCfg := newHost()
+	client, clientCfg := newHost()
+	if err := client.Connect(ctx, peer.AddrInfo{ID: server.ID(), Addrs: server.Addrs()}); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+
+	project := filepath.Join(serverCfg.SharedDir, "project")
+	if err := os.MkdirAll(filepath.Join(project, "src"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(project, "empty"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(project, "src", "main.go"), []byte("package main"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := client.FetchTree(ctx, server.ID(), "project", clientCfg.DownloadDir, file.Policy(clientCfg.Receive))
+	if err != nil {
+		t.Fatalf("FetchTree() error = %v", err)
+	}
+	if stats.Files != 1 || stats.Dirs != 2 {
+		t.Errorf("FetchTree() stats = %+v, want 1 file and 2 directories", stats)
+	}
+	fetched := filepath.Join(clientCfg.DownloadDir, "project")
+	if data, err := os.ReadFile(filepath.Join(fetched, "src", "main.go")); err != nil || string(data) != "package main" {
+		t.Errorf("fetched main.go = %q, %v", data, err)
+	}
+	if _, err := client.FetchTree(ctx, server.ID(), "missing", clientCfg.DownloadDir, file.Policy(clientCfg.Receive)); !errors.Is(err, ErrFileUnavailable) {
+		t.Errorf("FetchTree() error = %v, want %v", err, ErrFileUnavailable)
+	}
+
+	// Upload the fetched copy back; it lands in the server's download directory.
+	if _, err := client.SendTree(ctx, server.ID(), "project", fetched); err != nil {
+		t.Fatalf("SendTree() error = %v", err)
+	}
+	uploaded := filepath.Join(serverCfg.DownloadDir, "project", "empty")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if info, err := os.Stat(uploaded); err == nil && info.IsDir() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("uploaded tree did not appear in the download directory")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// Transferring the same tree again replaces the previous copy.
+	if err := os.WriteFile(filepath.Join(project, "src", "main.go"), []byte("package main // v2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.FetchTree(ctx, server.ID(), "project", clientCfg.DownloadDir, file.Policy(clientCfg.Receive)); err != nil {
+		t.Fatalf("FetchTree() again error = %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(fetched, "src", "main.go")); err != nil || string(data) != "package main // v2" {
+		t.Errorf("fetched main.go = %q, %v after fetching again", data, err)
+	}
+	if _, err := client.SendTree(ctx, server.ID(), "project", fetched); err != nil {
+		t.Fatalf("SendTree() again error = %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(serverCfg.DownloadDir, "project", "src", "main.go")); err != nil || string(data) != "package main // v2" {
+		t.Errorf("uploaded main.go = %q, %v after uploading again", data, err)
+	}
+}
+
+func TestWriteFile_Compression(t *testing.T) {
+	text := []byte(strings.Repeat("the quick brown fox jumps over the lazy dog\n", 200))
+	random := make([]byte, 8192)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	tests := []struct {
+		name        string
+		compression string
+		data        []byte
+		smaller     bool
+	}{
+		{name: "uncompressed", compression: "", data: text},
+		{name: "zstd", compression: CompressionZstd, data: text, smaller: true},
+		{name: "gzip", compression: CompressionGzip, data: text, smaller: true},
+		{name: "empty", compression: CompressionZstd, data: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf strings.Builder
+			wire, err := writeFile(&buf, Header{Name: "a.txt", Compression: tt.compression, Size: int64(len(tt.data))}, bytes.NewReader(tt.data))
+			if err != nil {
+				t.Fatalf("writeFile() error = %v", err)
+			}
+			if wire != int64(buf.Len()) {
+				t.Errorf("writeFile() = %d bytes, wrote %d", wire, buf.Len())
+			}
+			if tt.smaller && wire >= int64(len(tt.data)) {
+				t.Errorf("writeFile() wrote %d bytes for %d bytes of content", wire, len(tt.data))
+			}
+			hdr, data, read, err := receiveFile(strings.NewReader(buf.String()), 0)
+			if err != nil {
+				t.Fatalf("receiveFile() error = %v", err)
+			}
+			if hdr.Name != "a.txt" || string(data) != string(tt.data) || read != wire {
+				t.Errorf("receiveFile() = %q, %d bytes read, want the sent content and %d bytes", hdr.Name, read, wire)
+			}
+		})
+	}
+
+	long := `{"name":"` + strings.Repeat("a", maxLineSize) + `"}` + "\n"
+	if _, _, _, err := receiveFile(strings.NewReader(long), 0); !errors.Is(err, errLineTooLong) {
+		t.Errorf("receiveFile() error = %v for an oversized header, want %v", err, errLineTooLong)
+	}
+
+	// Content that decompresses to more than the announced or the maximum size is refused.
+	limits := []struct {
+		name    string
+		size    int64
+		maxSize int64
+		wantErr error
+	}{
+		{name: "understated size", size: 100, wantErr: errLimitExceeded},
+		{name: "over the maximum", size: int64(len(text)), maxSize: 1000, wantErr: ErrDownloadTooLarge},
+	}
+	for _, tt := range limits {
+		var buf strings.Builder
+		if _, err := writeFile(&buf, Header{Name: "a.txt", Compression: CompressionZstd, Size: tt.size}, bytes.NewReader(text)); err != nil {
+			t.Fatalf("writeFile() error = %v", err)
+		}
+		if _, _, _, err := receiveFile(strings.NewReader(buf.String()), tt.maxSize); !errors.Is(err, tt.wantErr) {
+			t.Errorf("receiveFile() with %s error = %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+
+	// A zstd frame asking for a window larger than the decoder allows is refused.
+	// Its header declares a 32MiB window, followed by a raw block holding "a".
+	wide := []byte{0x28, 0xb5, 0x2f, 0xfd, 0x00, 15 << 3, 0x09, 0x00, 0x00, 'a'}
+	if dec, err := decompressReader(bytes.NewReader(wide), CompressionZstd); err == nil {
+		if _, err := io.Copy(io.Discard, dec); err == nil {
+			t.Errorf("decompressReader() accepted a window larger than %d bytes", zstdWindowSize)
+		}
+		dec.Close()
+	}
+
+	if !compressible(text) {
+		t.Errorf("compressible() = false for repetitive text")
+	}
+	if compressible(random) {
+		t.Errorf("compressible() = true for random data")
+	}
+	if compressible([]byte("short")) {
+		t.Errorf("compressible() = true for a tiny file")
+	}
+}
+
+func TestFetchFile_Compressed(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	text := []byte(strings.Repeat("compressible line of text\n", 1000))
+	cfg := config.Default()
+	cfg.SharedDir = t.TempDir()
+	for _, name := range []string{"notes.txt", "archive.zip"} {
+		if err := os.WriteFile(filepath.Join(cfg.SharedDir, name), text, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server, err := SetupHost(ctx, cfg, logging.Discard())
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer server.Close()
+	client, err := SetupHost(ctx, config.Default(), logging.Discard())
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer client.Close()
+	if err := client.Connect(ctx, peer.AddrInfo{ID: server.ID(), Addrs: server.Addrs()}); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	// The server compresses once identify has told it the client's capabilities.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if supported, _ := server.Peerstore().SupportsProtocols(client.ID(), CompressionCapability); len(supported) > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("client capabilities were not identified")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	tests := []struct {
+		file       string
+		compressed bool
+	}{
+		{file: "notes.txt", compressed: true},
+		{file: "archive.zip", compressed: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			before := Stats(client, server.ID())
+			data, _, err := client.FetchFile(ctx, server.ID(), tt.file)
+			if err != nil {
+				t.Fatalf("FetchFile() error = %v", err)
+			}
+			if string(data) != string(text) {
+				t.Fatalf("FetchFile() returned %d bytes, want the %d byte file", len(data), len(text))
+			}
+			after := Stats(client, server.ID())
+			logical, wire := after.LogicalBytes-before.LogicalBytes, after.WireBytes-before.WireBytes
+			if logical != int64(len(text)) {
+				t.Errorf("logical bytes = %d, want %d", logical, len(text))
+			}
+			if compressed := wire < logical; compressed != tt.compressed {
+				t.Errorf("%d bytes on the wire for %d logical bytes, want compressed = %v", wire, logical, tt.compressed)
+			}
+		})
+	}
+}
+
+func TestSendFileDelta_FetchFileDelta(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	newHost := func() (*Node, config.Config) {
+		cfg := config.Default()
+		cfg.SharedDir = t.TempDir()
+		cfg.DownloadDir = t.TempDir()
+		h, err := SetupHost(ctx, cfg, logging.Discard())
+		if err != nil {
+			t.Fatalf("Failed to create host: %v", err)
+		}
+		t.Cleanup(func() { h.Close() })
+		return h, cfg
+	}
+	server, serverCfg := newHost()
+	client, clientCfg := newHost()
+	if err := client.Connect(ctx, peer.AddrInfo{ID: server.ID(), Addrs: server.Addrs()}); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+
+	// Both sides hold a copy of the file that differs in a few bytes.
+	original := make([]byte, 256<<10)
+	rand.New(rand.NewSource(1)).Read(original)
+	updated := append([]byte(nil), original...)
+	copy(updated[100<<10:], "changed")
+	write := func(path string, data []byte) {
+		t.Helper()
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(filepath.Join(serverCfg.SharedDir, "big.bin"), updated)
+	local := filepath.Join(clientCfg.DownloadDir, "big.bin")
+	write(local, original)
+
+	stats, err := client.FetchFileDelta(ctx, server.ID(), "big.bin", local, file.Policy{})
+	if err != nil {
+		t.Fatalf("FetchFileDelta() error = %v", err)
+	}
+	if data, err := os.ReadFile(local); err != nil || string(data) != string(updated) {
+		t.Errorf("FetchFileDelta() stored content that differs from the shared file: %v", err)
+	}
+	if stats.Literal > int64(len(updated))/10 {
+		t.Errorf("FetchFileDelta() fetched %d literal bytes of %d", stats.Literal, len(updated))
+	}
+	// Nothing but the updated file is left in the download directory.
+	if entries, _ := os.ReadDir(clientCfg.DownloadDir); len(entries) != 1 {
+		t.Errorf("download directory holds %d entries, want 1", len(entries))
+	}
+	if _, err := client.FetchFileDelta(ctx, server.ID(), "missing.bin", local, file.Policy{}); !errors.Is(err, ErrFileUnavailable) {
+		t.Errorf("FetchFileDelta() error = %v, want %v", err, ErrFileUnavailable)
+	}
+
+	// Uploading the update to a peer holding the original only sends the change.
+	uploaded := filepath.Join(serverCfg.DownloadDir, "big.bin")
+	write(uploaded, original)
+	stats, err = client.SendFileDelta(ctx, server.ID(), "big.bin", updated, file.Metadata{})
+	if err != nil {
+		t.Fatalf("SendFileDelta() error = %v", err)
+	}
+	if stats.Literal > int64(len(updated))/10 {
+		t.Errorf("SendFileDelta() sent %d literal bytes of %d", stats.Literal, len(updated))
+	}
+	if got, err := os.ReadFile(uploaded); err != nil || string(got) != string(updated) {
+		t.Errorf("uploaded file was not updated: %v", err)
+	}
+	if _, err := client.SendFileDelta(ctx, server.ID(), "../escape.bin", updated, file.Metadata{}); err == nil {
+		t.Errorf("SendFileDelta() succeeded for a path outside the download directory")
+	}
+
+	// A file that shrank is sent whole, since the larger copy's signature is dropped.
+	shrunk := updated[:8<<10]
+	write(filepath.Join(serverCfg.SharedDir, "big.bin"), shrunk)
+	if _, err := client.FetchFileDelta(ctx, server.ID(), "big.bin", local, file.Policy{}); err != nil {
+		t.Fatalf("FetchFileDelta() of a shrunk file error = %v", err)
+	}
+	if data, err := os.ReadFile(local); err != nil || string(data) != string(shrunk) {
+		t.Errorf("FetchFileDelta() stored content that differs from the shrunk file: %v", err)
+	}
+	if _, err := client.SendFileDelta(ctx, server.ID(), "big.bin", shrunk, file.Metadata{}); err != nil {
+		t.Fatalf("SendFileDelta() of a shrunk file error = %v", err)
+	}
+	if got, err := os.ReadFile(uploaded); err != nil || string(got) != string(shrunk) {
+		t.Errorf("uploaded file was not shrunk: %v", err)
+	}
 }
@@ -0,0 +1,163 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/pnet"
+	pnetconn "github.com/libp2p/go-libp2p/p2p/net/pnet"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/tracing"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ErrSwarmKeyMismatch is returned by Connect when the peer is part of a private
+// network with a different swarm key.
+var ErrSwarmKeyMismatch = errors.New("peer does not share this node's swarm key")
+
+// LoadSwarmKey reads a pre-shared key in the standard swarm key file format.
+func LoadSwarmKey(path string) (pnet.PSK, error) {
+	cleanPath := filepath.Clean(path)
+	f, err := os.Open(cleanPath)
+	if err != nil {
+		return nil, fmt.Errorf("error opening swarm key '%s': %w", cleanPath, err)
+	}
+	defer f.Close()
+
+	psk, err := pnet.DecodeV1PSK(f)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding swarm key '%s': %w", cleanPath, err)
+	}
+	return psk, nil
+}
+
+// SwarmKeyFingerprint returns a short hash of a swarm key that can be compared
+// between nodes without revealing the key.
+func SwarmKeyFingerprint(psk pnet.PSK) string {
+	sum := sha256.Sum256(psk)
+	return hex.EncodeToString(sum[:8])
+}
+
+// PrivateNetwork returns the swarm key fingerprint of the node, and false if the
+// node is not part of a private network.
+func (n *Node) PrivateNetwork() (string, bool) {
+	if n.psk == nil {
+		return "", false
+	}
+	return SwarmKeyFingerprint(n.psk), true
+}
+
+// Connect dials a peer like host.Connect. In a private network, a dial that fails
+// because the peer runs a private network with another swarm key is reported as
+// ErrSwarmKeyMismatch.
+func (n *Node) Connect(ctx context.Context, pi peer.AddrInfo) (err error) {
+	ctx, span := tracing.Start(ctx, spanDial, trace.WithAttributes(tracing.Peer(pi.ID)))
+	defer func() { tracing.End(span, err) }()
+
+	err = n.Host.Connect(ctx, pi)
+	if err == nil || n.psk == nil || ctx.Err() != nil {
+		return err
+	}
+	addrs := slices.Concat(pi.Addrs, n.Peerstore().Addrs(pi.ID))
+	if probeSwarmKey(ctx, n.psk, addrs) == keyMismatch {
+		return fmt.Errorf("%w (local key fingerprint %s): %v", ErrSwarmKeyMismatch, SwarmKeyFingerprint(n.psk), err)
+	}
+	return err
+}
+
+// multistreamHeader is the first message a libp2p listener sends on a new
+// connection, before any private-network encryption.
+var multistreamHeader = []byte("\x13/multistream/1.0.0\n")
+
+// probeTimeout bounds how long probeSwarmKey waits for a peer's first message.
+const probeTimeout = 5 * time.Second
+
+// keyProbe is the outcome of probing a peer's private network.
+type keyProbe int
+
+const (
+	// keyUnknown means no address of the peer answered.
+	keyUnknown keyProbe = iota
+	// keyPublic means the peer is not part of a private network.
+	keyPublic
+	// keyMatch means the peer encrypts with the local swarm key.
+	keyMatch
+	// keyMismatch means the peer is part of a private network with another key.
+	keyMismatch
+)
+
+// probeSwarmKey connects to the TCP addresses of a peer until one answers, and
+// tells from the listener's first message whether it is encrypted, and if so,
+// whether psk decrypts it.
+func probeSwarmKey(ctx context.Context, psk pnet.PSK, addrs []ma.Multiaddr) keyProbe {
+	for _, addr := range addrs {
+		if _, last := ma.SplitLast(addr); last == nil || last.Protocol().Code != ma.P_TCP {
+			continue
+		}
+		if result := probeAddr(ctx, psk, addr); result != keyUnknown {
+			return result
+		}
+	}
+	return keyUnknown
+}
+
+// probeAddr probes the private network of the listener at addr.
+func probeAddr(ctx context.Context, psk pnet.PSK, addr ma.Multiaddr) keyProbe {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	var d manet.Dialer
+	conn, err := d.DialContext(ctx, addr)
+	if err != nil {
+		return keyUnknown
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		return keyUnknown
+	}
+
+	r := bufio.NewReader(conn)
+	first, err := r.Peek(len(multistreamHeader))
+	if err != nil {
+		return keyUnknown
+	}
+	if bytes.Equal(first, multistreamHeader) {
+		return keyPublic
+	}
+	// The listener's message is preceded by the nonce of its encryption.
+	protected, err := pnetconn.NewProtectedConn(psk, &bufferedConn{Conn: conn, r: r})
+	if err != nil {
+		return keyUnknown
+	}
+	msg := make([]byte, len(multistreamHeader))
+	if _, err := io.ReadFull(protected, msg); err != nil {
+		return keyUnknown
+	}
+	if bytes.Equal(msg, multistreamHeader) {
+		return keyMatch
+	}
+	return keyMismatch
+}
+
+// bufferedConn reads a connection through a reader that may hold its first bytes.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
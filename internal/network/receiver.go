@@ -0,0 +1,330 @@
+package network
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/saurabhSPatel/p2p-file-sharing/config"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/file"
+)
+
+// uploadsFile is the file in the data directory recording which peer uploaded each
+// file in the download directory. It is only kept when a per-peer quota is set.
+const uploadsFile = "uploads.json"
+
+// errLimitExceeded is returned when a received file grows past the size it was
+// admitted or announced with.
+var errLimitExceeded = errors.New("file exceeds its size limit")
+
+// receiver stores the files and directories peers upload to a host, within the
+// configured quotas. Limits of 0 are unlimited.
+type receiver struct {
+	downloadDir string
+	policy      file.Policy
+	// allowed holds the peers that may upload; nil accepts every peer.
+	allowed      map[peer.ID]struct{}
+	maxFileSize  int64
+	quota        int64
+	peerQuota    int64
+	minFreeSpace int64
+	uploadsPath  string
+
+	mu sync.Mutex
+	// owners maps the uploads in the download directory, by slash-separated path,
+	// to the peer that uploaded them.
+	owners map[string]peer.ID
+	// reserved holds the bytes admitted for each peer's uploads in progress, which
+	// count against the quotas until they are stored or rejected.
+	reserved map[peer.ID]int64
+}
+
+// admission is an upload admitted by the receiver. The space it reserved counts
+// against the quotas until it is released.
+type admission struct {
+	r    *receiver
+	peer peer.ID
+	rel  string
+	// limit is the number of bytes the upload may take, and reject the rejection
+	// to send once it takes more.
+	limit    int64
+	reject   Ack
+	reserved int64
+}
+
+// newReceiver creates the receiver for a host's configuration.
+func newReceiver(cfg config.Config) (*receiver, error) {
+	r := &receiver{
+		downloadDir:  cfg.DownloadDir,
+		policy:       file.Policy(cfg.Receive),
+		maxFileSize:  int64(cfg.Uploads.MaxFileSize),
+		quota:        int64(cfg.Uploads.Quota),
+		peerQuota:    int64(cfg.Uploads.PeerQuota),
+		minFreeSpace: int64(cfg.Uploads.MinFreeSpace),
+		uploadsPath:  filepath.Join(cfg.DataDir, uploadsFile),
+		owners:       make(map[string]peer.ID),
+		reserved:     make(map[peer.ID]int64),
+	}
+	if len(cfg.Uploads.Allow) > 0 {
+		r.allowed = make(map[peer.ID]struct{}, len(cfg.Uploads.Allow))
+	}
+	for _, s := range cfg.Uploads.Allow {
+		id, err := peer.Decode(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid uploads.allow entry '%s': %w", s, err)
+		}
+		r.allowed[id] = struct{}{}
+	}
+
+	if r.peerQuota > 0 {
+		data, err := os.ReadFile(r.uploadsPath)
+		switch {
+		case err == nil:
+			if err := json.Unmarshal(data, &r.owners); err != nil {
+				return nil, fmt.Errorf("error parsing uploads '%s': %w", r.uploadsPath, err)
+			}
+		case !errors.Is(err, fs.ErrNotExist):
+			return nil, fmt.Errorf("error reading uploads '%s': %w", r.uploadsPath, err)
+		}
+	}
+	return r, nil
+}
+
+// allows reports whether a peer may upload to the host.
+func (r *receiver) allows(p peer.ID) bool {
+	if r.allowed == nil {
+		return true
+	}
+	_, ok := r.allowed[p]
+	return ok
+}
+
+// admit checks whether a peer may store a file of the given size under rel, where
+// a size of 0 is unknown, and reserves the space the file may take. It returns the
+// admission, which must be released once the file is stored or rejected, or the
+// rejection to send right away.
+func (r *receiver) admit(p peer.ID, rel string, size int64) (*admission, Ack, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	limit, reject, err := r.allowance(p, rel)
+	if err != nil {
+		return nil, nack(AckFailed, err), false
+	}
+	if r.maxFileSize > 0 && r.maxFileSize < limit {
+		limit = r.maxFileSize
+		reject = Ack{Status: AckTooLarge, Message: fmt.Sprintf("files are limited to %d bytes", r.maxFileSize)}
+	}
+	if size > limit || limit == 0 {
+		return nil, reject, false
+	}
+	if size > 0 {
+		// Only the announced size is reserved, so the file may not grow past it.
+		limit = size
+		reject = Ack{Status: AckInvalid, Message: fmt.Sprintf("file exceeds its announced size of %d bytes", size)}
+	}
+	a := &admission{r: r, peer: p, rel: rel, limit: limit, reject: reject}
+	if r.limited() {
+		a.reserved = limit
+		r.reserved[p] += limit
+	}
+	return a, Ack{}, true
+}
+
+// admitTree checks whether a peer may store a directory tree under rel. Since the
+// size of a tree is not known up front, its files reserve their space with grow as
+// they arrive.
+func (r *receiver) admitTree(p peer.ID, rel string) (*admission, Ack, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	limit, reject, err := r.allowance(p, rel)
+	if err != nil {
+		return nil, nack(AckFailed, err), false
+	}
+	if limit == 0 {
+		return nil, reject, false
+	}
+	return &admission{r: r, peer: p, rel: rel, limit: limit, reject: reject}, Ack{}, true
+}
+
+// grow reserves n more bytes for the upload, returning the rejection to send if
+// the quotas do not leave room for them.
+func (a *admission) grow(n int64) (Ack, bool) {
+	r := a.r
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.limited() {
+		return Ack{}, true
+	}
+	// The upload's own reservation is not counted against it.
+	r.reserved[a.peer] -= a.reserved
+	limit, reject, err := r.allowance(a.peer, a.rel)
+	r.reserved[a.peer] += a.reserved
+	if err != nil {
+		return nack(AckFailed, err), false
+	}
+	if a.reserved+n > limit {
+		return reject, false
+	}
+	a.reserved += n
+	r.reserved[a.peer] += n
+	return Ack{}, true
+}
+
+// release returns the space reserved by the upload to the quotas.
+func (a *admission) release() {
+	r := a.r
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.reserved[a.peer] -= a.reserved; r.reserved[a.peer] <= 0 {
+		delete(r.reserved, a.peer)
+	}
+	a.reserved = 0
+}
+
+// limited reports whether any quota or free space limit is set.
+func (r *receiver) limited() bool {
+	return r.quota > 0 || r.peerQuota > 0 || r.minFreeSpace > 0
+}
+
+// allowance returns how many bytes a peer may store under rel within the quotas and
+// the free space to keep, counting the space freed by replacing an existing copy
+// and the space reserved by uploads in progress, and the rejection to send once an
+// upload exceeds it. r.mu must be held.
+func (r *receiver) allowance(p peer.ID, rel string) (int64, Ack, error) {
+	rel = path.Clean(rel)
+	limit, reject := int64(math.MaxInt64), Ack{}
+	restrict := func(n int64, ack Ack) {
+		if n < limit {
+			limit, reject = max(n, 0), ack
+		}
+	}
+
+	dest, err := file.LocalPath(r.downloadDir, rel)
+	if err != nil {
+		return 0, Ack{}, err
+	}
+	existing, err := file.DirSize(dest)
+	if err != nil {
+		return 0, Ack{}, err
+	}
+	var inFlight int64
+	for _, n := range r.reserved {
+		inFlight += n
+	}
+	if r.quota > 0 {
+		used, err := file.DirSize(r.downloadDir)
+		if err != nil {
+			return 0, Ack{}, err
+		}
+		restrict(r.quota-used+existing-inFlight, Ack{Status: AckQuotaExceeded, Message: fmt.Sprintf("download directory is limited to %d bytes", r.quota)})
+	}
+	if r.peerQuota > 0 {
+		used, err := r.usage(p)
+		if err != nil {
+			return 0, Ack{}, err
+		}
+		if r.owners[rel] == p {
+			used -= existing
+		}
+		restrict(r.peerQuota-used-r.reserved[p], Ack{Status: AckQuotaExceeded, Message: fmt.Sprintf("uploads are limited to %d bytes per peer", r.peerQuota)})
+	}
+	if r.minFreeSpace > 0 {
+		// Uploads are written next to the copy they replace, so it frees no space.
+		if err := os.MkdirAll(r.downloadDir, 0755); err != nil {
+			return 0, Ack{}, fmt.Errorf("error creating download directory: %w", err)
+		}
+		free, err := file.FreeSpace(r.downloadDir)
+		if err != nil && !errors.Is(err, errors.ErrUnsupported) {
+			return 0, Ack{}, fmt.Errorf("error checking free space: %w", err)
+		}
+		if err == nil {
+			restrict(free-r.minFreeSpace-inFlight, Ack{Status: AckDiskFull, Message: fmt.Sprintf("%d bytes must remain free", r.minFreeSpace)})
+		}
+	}
+	return limit, reject, nil
+}
+
+// usage returns the size of the uploads a peer keeps in the download directory,
+// forgetting those that were removed. r.mu must be held.
+func (r *receiver) usage(p peer.ID) (int64, error) {
+	var used int64
+	for rel, owner := range r.owners {
+		if owner != p {
+			continue
+		}
+		local, err := file.LocalPath(r.downloadDir, rel)
+		if err != nil {
+			delete(r.owners, rel)
+			continue
+		}
+		if _, err := os.Stat(local); errors.Is(err, fs.ErrNotExist) {
+			delete(r.owners, rel)
+			continue
+		}
+		size, err := file.DirSize(local)
+		if err != nil {
+			return 0, err
+		}
+		used += size
+	}
+	return used, nil
+}
+
+// record notes that a peer uploaded the file or directory at rel, for its quota.
+func (r *receiver) record(p peer.ID, rel string) error {
+	if r.peerQuota <= 0 {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.owners[path.Clean(rel)] = p
+	data, err := json.MarshalIndent(r.owners, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding uploads: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(r.uploadsPath), 0700); err != nil {
+		return fmt.Errorf("error saving uploads: %w", err)
+	}
+	return file.WriteFileAtomic(r.uploadsPath, data, time.Time{})
+}
+
+// readAllLimit reads r until EOF, failing with errLimitExceeded once it yields more
+// than limit bytes.
+func readAllLimit(r io.Reader, limit int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, limit))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(r, make([]byte, 1)); err == nil {
+		return nil, errLimitExceeded
+	}
+	return data, nil
+}
+
+// limitWriter fails with errLimitExceeded once more than n bytes are written.
+type limitWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (l *limitWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > l.n {
+		return 0, errLimitExceeded
+	}
+	l.n -= int64(len(p))
+	return l.w.Write(p)
+}
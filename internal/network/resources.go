@@ -0,0 +1,144 @@
+package network
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
+	"github.com/saurabhSPatel/p2p-file-sharing/config"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/logging"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/metrics"
+)
+
+// ResourceRejection is the scope whose limit made the resource manager refuse a
+// connection, a stream or a memory reservation.
+type ResourceRejection string
+
+const (
+	RejectedConn         ResourceRejection = "conn"
+	RejectedStream       ResourceRejection = "stream"
+	RejectedPeer         ResourceRejection = "peer"
+	RejectedProtocol     ResourceRejection = "protocol"
+	RejectedProtocolPeer ResourceRejection = "protocol_peer"
+	RejectedService      ResourceRejection = "service"
+	RejectedServicePeer  ResourceRejection = "service_peer"
+	RejectedMemory       ResourceRejection = "memory"
+)
+
+// newResourceManager creates a resource manager with libp2p's default limits,
+// overridden by the configured limits. Received files are written to disk as they
+// arrive, so streams keep libp2p's finite per-stream memory limit.
+func newResourceManager(cfg config.ResourceConfig, logger *slog.Logger) (network.ResourceManager, *rejections, error) {
+	scaling := rcmgr.DefaultLimits
+	libp2p.SetDefaultServiceLimits(&scaling)
+
+	partial := rcmgr.PartialLimitConfig{
+		System:      resourceLimits(cfg.System),
+		PeerDefault: resourceLimits(cfg.Peer),
+	}
+	if len(cfg.Protocols) > 0 {
+		partial.Protocol = make(map[protocol.ID]rcmgr.ResourceLimits, len(cfg.Protocols))
+		for pid, l := range cfg.Protocols {
+			partial.Protocol[protocol.ID(pid)] = resourceLimits(l)
+		}
+	}
+	if len(cfg.ProtocolPeer) > 0 {
+		partial.ProtocolPeer = make(map[protocol.ID]rcmgr.ResourceLimits, len(cfg.ProtocolPeer))
+		for pid, l := range cfg.ProtocolPeer {
+			partial.ProtocolPeer[protocol.ID(pid)] = resourceLimits(l)
+		}
+	}
+
+	rej := &rejections{counts: make(map[ResourceRejection]uint64), logger: logger}
+	rm, err := rcmgr.NewResourceManager(rcmgr.NewFixedLimiter(partial.Build(scaling.AutoScale())), rcmgr.WithMetrics(rej))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create resource manager: %w", err)
+	}
+	return rm, rej, nil
+}
+
+// resourceLimits converts configured limits, where 0 keeps the default.
+func resourceLimits(l config.ResourceLimits) rcmgr.ResourceLimits {
+	return rcmgr.ResourceLimits{
+		Streams: rcmgr.LimitVal(l.Streams),
+		Memory:  rcmgr.LimitVal64(l.Memory),
+		FD:      rcmgr.LimitVal(l.FDs),
+	}
+}
+
+// ResourceRejections returns how often the node's resource manager refused a
+// connection, stream or memory reservation, by the scope whose limit was reached.
+func (n *Node) ResourceRejections() map[ResourceRejection]uint64 {
+	return n.rejections.snapshot()
+}
+
+// rejections counts and logs the resource manager's refusals. It implements
+// rcmgr.MetricsReporter.
+type rejections struct {
+	mu     sync.Mutex
+	counts map[ResourceRejection]uint64
+	logger *slog.Logger
+}
+
+func (r *rejections) block(reason ResourceRejection, args ...any) {
+	r.mu.Lock()
+	r.counts[reason]++
+	r.mu.Unlock()
+	metrics.ResourceRejections.WithLabelValues(string(reason)).Inc()
+	r.logger.Warn("Resource limit reached", append([]any{"scope", reason}, args...)...)
+}
+
+func (r *rejections) snapshot() map[ResourceRejection]uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	counts := make(map[ResourceRejection]uint64, len(r.counts))
+	for reason, n := range r.counts {
+		counts[reason] = n
+	}
+	return counts
+}
+
+func (r *rejections) BlockConn(dir network.Direction, usefd bool) {
+	r.block(RejectedConn, "direction", dir)
+}
+
+func (r *rejections) BlockStream(p peer.ID, dir network.Direction) {
+	r.block(RejectedStream, logging.Peer(p), "direction", dir)
+}
+
+func (r *rejections) BlockPeer(p peer.ID) {
+	r.block(RejectedPeer, logging.Peer(p))
+}
+
+func (r *rejections) BlockProtocol(proto protocol.ID) {
+	r.block(RejectedProtocol, "protocol", proto)
+}
+
+func (r *rejections) BlockProtocolPeer(proto protocol.ID, p peer.ID) {
+	r.block(RejectedProtocolPeer, logging.Peer(p), "protocol", proto)
+}
+
+func (r *rejections) BlockService(svc string) {
+	r.block(RejectedService, "service", svc)
+}
+
+func (r *rejections) BlockServicePeer(svc string, p peer.ID) {
+	r.block(RejectedServicePeer, logging.Peer(p), "service", svc)
+}
+
+func (r *rejections) BlockMemory(size int) {
+	r.block(RejectedMemory, "size", size)
+}
+
+func (r *rejections) AllowConn(network.Direction, bool)      {}
+func (r *rejections) AllowStream(peer.ID, network.Direction) {}
+func (r *rejections) AllowPeer(peer.ID)                      {}
+func (r *rejections) AllowProtocol(protocol.ID)              {}
+func (r *rejections) AllowService(string)                    {}
+func (r *rejections) AllowMemory(int)                        {}
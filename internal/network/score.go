@@ -0,0 +1,189 @@
+package network
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/logging"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/metrics"
+)
+
+const (
+	// statsKey is the peerstore metadata key holding a peer's transfer history.
+	statsKey = "p2p-file-sharing/stats"
+	// scoreTag is the connection manager tag carrying a peer's score.
+	scoreTag = "p2p-file-sharing/score"
+	// addressBookTag protects address-book peers from being pruned.
+	addressBookTag = "p2p-file-sharing/address-book"
+	// pingTimeout bounds a single latency probe.
+	pingTimeout = 10 * time.Second
+	// pingInterval is the time between latency probes of connected peers.
+	pingInterval = 30 * time.Second
+	// throughputSmoothing is the weight of the newest sample in the throughput EWMA.
+	throughputSmoothing = 0.3
+)
+
+// PeerStats summarizes the transfer history and latency of a peer.
+type PeerStats struct {
+	Successes int
+	Failures  int
+	// Latency is the ping round-trip time, smoothed by the peerstore as an EWMA.
+	Latency time.Duration
+	// Throughput is an EWMA of the bytes per second of successful transfers.
+	Throughput float64
+	// LogicalBytes totals the file content transferred with the peer, and WireBytes
+	// the bytes those transfers took on the wire after compression.
+	LogicalBytes int64
+	WireBytes    int64
+}
+
+// Score ranks the peer between 0 and 100; the connection manager prunes low scores
+// first. The success rate is smoothed so unknown peers start at 50, and every 10ms
+// of latency costs one point, up to 50.
+func (s PeerStats) Score() int {
+	score := 100 * (s.Successes + 1) / (s.Successes + s.Failures + 2)
+	penalty := int(s.Latency / (10 * time.Millisecond))
+	if penalty > 50 {
+		penalty = 50
+	}
+	if score -= penalty; score < 0 {
+		score = 0
+	}
+	return score
+}
+
+// Stats returns the recorded statistics of a peer.
+func Stats(h host.Host, p peer.ID) PeerStats {
+	var stats PeerStats
+	if v, err := h.Peerstore().Get(p, statsKey); err == nil {
+		stats, _ = v.(PeerStats)
+	}
+	stats.Latency = h.Peerstore().LatencyEWMA(p)
+	return stats
+}
+
+// RecordTransfer records the outcome of a transfer of size bytes that took elapsed,
+// updates the peer's score and counts the transfer in the metrics.
+func (n *Node) RecordTransfer(p peer.ID, dir Direction, size int64, elapsed time.Duration, transferErr error) {
+	observeTransfer(dir, elapsed, transferErr)
+
+	n.statsMu.Lock()
+	stats := Stats(n, p)
+	if transferErr == nil {
+		stats.Successes++
+		if elapsed > 0 {
+			sample := float64(size) / elapsed.Seconds()
+			if stats.Throughput == 0 {
+				stats.Throughput = sample
+			} else {
+				stats.Throughput = throughputSmoothing*sample + (1-throughputSmoothing)*stats.Throughput
+			}
+		}
+	} else {
+		stats.Failures++
+	}
+	if err := n.Peerstore().Put(p, statsKey, stats); err != nil {
+		n.logger.Error("Error storing peer stats", logging.Peer(p), "error", err)
+	}
+	n.statsMu.Unlock()
+
+	updateScore(n, p)
+}
+
+// RecordBytes adds a transfer of logical bytes of file content, which took wire
+// bytes on the stream, to the peer's totals.
+func (n *Node) RecordBytes(p peer.ID, logical, wire int64) {
+	n.statsMu.Lock()
+	defer n.statsMu.Unlock()
+	stats := Stats(n, p)
+	stats.LogicalBytes += logical
+	stats.WireBytes += wire
+	if err := n.Peerstore().Put(p, statsKey, stats); err != nil {
+		n.logger.Error("Error storing peer stats", logging.Peer(p), "error", err)
+	}
+}
+
+// updateScore refreshes the connection manager tag of a peer from its statistics.
+func updateScore(h host.Host, p peer.ID) {
+	h.ConnManager().TagPeer(p, scoreTag, Stats(h, p).Score())
+}
+
+// RankPeers orders peers from most to least preferred for a transfer: higher scores
+// (reliable, low-latency peers) first, then higher throughput.
+func RankPeers(h host.Host, peers []peer.AddrInfo) []peer.AddrInfo {
+	ranked := make([]peer.AddrInfo, len(peers))
+	copy(ranked, peers)
+
+	stats := make(map[peer.ID]PeerStats, len(peers))
+	for _, pi := range peers {
+		stats[pi.ID] = Stats(h, pi.ID)
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		a, b := stats[ranked[i].ID], stats[ranked[j].ID]
+		if a.Score() != b.Score() {
+			return a.Score() > b.Score()
+		}
+		return a.Throughput > b.Throughput
+	})
+	return ranked
+}
+
+// pingPeers periodically measures the round-trip time to every connected peer.
+func (n *Node) pingPeers(ctx context.Context) {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, p := range n.Network().Peers() {
+				n.pingPeer(ctx, p)
+			}
+		}
+	}
+}
+
+// pingPeer measures the round-trip time to a peer and refreshes its score.
+func (n *Node) pingPeer(ctx context.Context, p peer.ID) {
+	ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+
+	res, ok := <-ping.Ping(ctx, n.Host, p)
+	if !ok {
+		return
+	}
+	if res.Error != nil {
+		metrics.Errors.WithLabelValues("ping").Inc()
+		n.logger.Debug("Error pinging peer", logging.Peer(p), "error", res.Error)
+		return
+	}
+	metrics.PingRTT.Observe(res.RTT.Seconds())
+	updateScore(n, p)
+}
+
+// InAddressBook reports whether a peer is one of the configured address-book peers.
+func InAddressBook(h host.Host, p peer.ID) bool {
+	return h.ConnManager().IsProtected(p, addressBookTag)
+}
+
+// protectAddressBook adds the address-book peers to the peerstore, protects them from
+// pruning and dials them in the background.
+func (n *Node) protectAddressBook(ctx context.Context, peers []peer.AddrInfo) {
+	for _, pi := range peers {
+		n.Peerstore().AddAddrs(pi.ID, pi.Addrs, peerstore.PermanentAddrTTL)
+		n.ConnManager().Protect(pi.ID, addressBookTag)
+
+		go func(pi peer.AddrInfo) {
+			if err := n.Connect(ctx, pi); err != nil {
+				n.logger.Warn("Error connecting to address-book peer", logging.Peer(pi.ID), "error", err)
+			}
+		}(pi)
+	}
+}
@@ -0,0 +1,281 @@
+package network
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/file"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/index"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/logging"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/tracing"
+)
+
+const (
+	// ListProtocolID serves the listing of the shared directory.
+	ListProtocolID = protocolPrefix + "list/1.0.0"
+	// FetchProtocolID serves the content of a file in the shared directory.
+	FetchProtocolID = protocolPrefix + "fetch/3.0.0"
+	// WatchProtocolID streams changes to the shared directory as they happen.
+	WatchProtocolID = protocolPrefix + "watch/1.0.0"
+)
+
+var (
+	// ErrFileUnavailable is returned by FetchFile when the peer does not serve the file.
+	ErrFileUnavailable = errors.New("file not available on peer")
+	// ErrDownloadTooLarge is returned by FetchFile when the file exceeds the
+	// configured maximum download size.
+	ErrDownloadTooLarge = errors.New("file exceeds the maximum download size")
+)
+
+// ServeFiles lets peers list and fetch the files and directories in the shared directory.
+func (n *Node) ServeFiles(sharedDir string) {
+	n.SetStreamHandler(ListProtocolID, n.WithTimeouts(func(stream network.Stream) {
+		n.handleList(stream, sharedDir)
+	}))
+	n.SetStreamHandler(FetchProtocolID, n.WithTimeouts(func(stream network.Stream) {
+		n.handleFetch(stream, sharedDir)
+	}))
+	n.SetStreamHandler(FetchTreeProtocolID, n.WithTimeouts(func(stream network.Stream) {
+		n.handleFetchTree(stream, sharedDir)
+	}))
+	n.SetStreamHandler(DeltaFetchProtocolID, n.WithTimeouts(func(stream network.Stream) {
+		n.handleDeltaFetch(stream, sharedDir)
+	}))
+}
+
+// ServeIndex serves listings from the index instead of scanning the shared directory,
+// and streams the index's change events to watching peers. Watch streams are
+// exempt from the idle timeout, as changes may be far apart.
+func (n *Node) ServeIndex(idx *index.Index) {
+	n.SetStreamHandler(ListProtocolID, n.WithTimeouts(func(stream network.Stream) {
+		defer stream.Close()
+		n.sendListing(stream, idx.Entries())
+	}))
+	n.SetStreamHandler(WatchProtocolID, func(stream network.Stream) {
+		n.handleWatch(stream, idx)
+	})
+}
+
+// handleList writes the shared directory listing as JSON.
+func (n *Node) handleList(stream network.Stream, sharedDir string) {
+	defer stream.Close()
+
+	entries, err := file.Scan(sharedDir)
+	if err != nil {
+		n.streamLogger(stream).Error("Error listing shared directory", "error", err)
+		_ = stream.Reset()
+		return
+	}
+	n.sendListing(stream, entries)
+}
+
+// sendListing writes a listing as JSON.
+func (n *Node) sendListing(stream network.Stream, entries []file.Entry) {
+	if err := json.NewEncoder(stream).Encode(entries); err != nil {
+		n.streamLogger(stream).Warn("Error sending listing", "error", err)
+		_ = stream.Reset()
+	}
+}
+
+// handleFetch reads a request naming a relative path and writes the file using the
+// transfer format.
+func (n *Node) handleFetch(stream network.Stream, sharedDir string) {
+	defer stream.Close()
+	logger := n.streamLogger(stream)
+
+	req, err := readHeader(bufio.NewReader(stream))
+	if err != nil {
+		logger.Warn("Error reading fetch request", "error", err)
+		_ = stream.Reset()
+		return
+	}
+	name := req.Name
+
+	path, err := file.LocalPath(sharedDir, name)
+	if err != nil {
+		logger.Warn("Rejected fetch request", "error", err)
+		_ = stream.Reset()
+		return
+	}
+	req.Transfer = transferID(req)
+	logger = logger.With(logging.Transfer(req.Transfer), "name", name)
+	_, span := serveTransfer(spanSend, stream.Conn().RemotePeer(), req)
+	hdr := Header{Name: name, Transfer: req.Transfer}
+	// The file is streamed from disk rather than read into memory.
+	f, size, sample, err := openServed(path)
+	if err == nil {
+		defer f.Close()
+		hdr.Size = size
+		span.SetAttributes(tracing.Size(hdr.Size))
+		hdr.Metadata, err = file.ReadMetadata(path)
+	}
+	if err != nil {
+		tracing.End(span, err)
+		logger.Warn("Error serving file", "error", err)
+		_ = stream.Reset()
+		return
+	}
+	start := time.Now()
+	hdr.Compression = n.compressionFor(stream.Conn().RemotePeer(), name, sample)
+	_, err = writeFile(stream, hdr, io.LimitReader(f, size))
+	observeTransfer(Sent, time.Since(start), err)
+	tracing.End(span, err)
+	if err != nil {
+		logger.Warn("Error serving file", "error", err)
+		_ = stream.Reset()
+		return
+	}
+	logger.Debug("Served file", "size", hdr.Size)
+}
+
+// openServed opens a regular file for serving and returns its size along with the
+// start of its content, enough to decide whether to compress it. Only the size it
+// has now should be read, to match the size announced in its header.
+func openServed(path string) (*os.File, int64, []byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, nil, err
+	}
+	if !info.Mode().IsRegular() {
+		f.Close()
+		return nil, 0, nil, fmt.Errorf("'%s' is not a regular file", path)
+	}
+	sample := make([]byte, min(info.Size(), compressionSampleSize))
+	if _, err := f.ReadAt(sample, 0); err != nil && err != io.EOF {
+		f.Close()
+		return nil, 0, nil, err
+	}
+	return f, info.Size(), sample, nil
+}
+
+// handleWatch writes index events as JSON lines until the watching peer goes away.
+func (n *Node) handleWatch(stream network.Stream, idx *index.Index) {
+	ctx, cancel := context.WithCancel(n.ctx)
+	defer cancel()
+
+	// The watcher never writes; a read returns once it closes or resets the stream.
+	go func() {
+		_, _ = io.Copy(io.Discard, stream)
+		cancel()
+	}()
+
+	enc := json.NewEncoder(stream)
+	for ev := range idx.Events(ctx) {
+		if err := enc.Encode(ev); err != nil {
+			_ = stream.Reset()
+			return
+		}
+	}
+	_ = stream.Close()
+}
+
+// WatchRemoteFiles streams the changes to a peer's shared directory. The channel is
+// closed when ctx is done or the peer stops serving changes.
+func (n *Node) WatchRemoteFiles(ctx context.Context, peerID peer.ID) (<-chan index.Event, error) {
+	// Watch streams are exempt from the idle timeout, as changes may be far apart.
+	stream, err := n.Host.NewStream(ctx, peerID, WatchProtocolID)
+	if err != nil {
+		return nil, fmt.Errorf("error creating new stream: %w", err)
+	}
+
+	events := make(chan index.Event)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = stream.Reset()
+		case <-done:
+		}
+	}()
+	go func() {
+		defer close(events)
+		defer close(done)
+		defer stream.Close()
+
+		dec := json.NewDecoder(stream)
+		for {
+			var ev index.Event
+			if err := dec.Decode(&ev); err != nil {
+				return
+			}
+			select {
+			case events <- ev:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+// ListRemoteFiles returns the listing of a peer's shared directory.
+func (n *Node) ListRemoteFiles(ctx context.Context, peerID peer.ID) ([]file.Entry, error) {
+	stream, err := n.NewStream(ctx, peerID, ListProtocolID)
+	if err != nil {
+		return nil, fmt.Errorf("error creating new stream: %w", err)
+	}
+	defer stream.Close()
+
+	if err := stream.CloseWrite(); err != nil {
+		return nil, fmt.Errorf("error sending list request: %w", err)
+	}
+	var entries []file.Entry
+	if err := json.NewDecoder(stream).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("error reading listing: %w", err)
+	}
+	return entries, nil
+}
+
+// FetchFile downloads a file from a peer's shared directory by its relative path,
+// along with its attributes.
+func (n *Node) FetchFile(ctx context.Context, peerID peer.ID, name string) ([]byte, file.Metadata, error) {
+	ctx, span, req := startFetch(ctx, peerID, name)
+	data, md, err := n.fetchFile(ctx, peerID, req)
+	tracing.End(span, err)
+	return data, md, err
+}
+
+// fetchFile runs the requesting side of the fetch protocol.
+func (n *Node) fetchFile(ctx context.Context, peerID peer.ID, req Header) ([]byte, file.Metadata, error) {
+	name := req.Name
+	stream, err := n.NewStream(ctx, peerID, FetchProtocolID)
+	if err != nil {
+		return nil, file.Metadata{}, fmt.Errorf("error creating new stream: %w", err)
+	}
+	defer stream.Close()
+
+	if err := writeHeader(stream, req); err != nil {
+		return nil, file.Metadata{}, fmt.Errorf("error requesting file: %w", err)
+	}
+	if err := stream.CloseWrite(); err != nil {
+		return nil, file.Metadata{}, fmt.Errorf("error requesting file: %w", err)
+	}
+
+	hdr, data, wire, err := receiveFile(stream, n.maxDownload)
+	if errors.Is(err, network.ErrReset) {
+		return nil, file.Metadata{}, fmt.Errorf("%w: %s", ErrFileUnavailable, name)
+	}
+	if err != nil {
+		return nil, file.Metadata{}, err
+	}
+	if hdr.Name != name {
+		return nil, file.Metadata{}, fmt.Errorf("received unexpected file '%s'", hdr.Name)
+	}
+	n.RecordBytes(peerID, int64(len(data)), wire)
+	n.logger.Info("Received file", logging.Peer(peerID), transferAttr(hdr),
+		"name", name, "size", len(data), "wire_bytes", wire)
+	return data, hdr.Metadata, nil
+}
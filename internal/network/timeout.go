@@ -0,0 +1,154 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/metrics"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/tracing"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ErrStreamTimeout is returned when a stream is idle for longer than its idle
+// timeout or is still transferring when its read or write timeout passes.
+var ErrStreamTimeout = errors.New("stream timed out")
+
+// NewStream opens a stream like host.NewStream, applying the node's stream timeouts
+// and resetting the stream once ctx is done. A peer that is not connected is dialed
+// first, so that dialing and negotiating the stream are traced separately. Streams
+// may use relayed connections, which are the only path to peers behind NAT.
+func (n *Node) NewStream(ctx context.Context, p peer.ID, pids ...protocol.ID) (network.Stream, error) {
+	if c := n.Network().Connectedness(p); c != network.Connected && c != network.Limited {
+		if err := n.Connect(ctx, peer.AddrInfo{ID: p}); err != nil {
+			return nil, err
+		}
+	}
+	sctx, span := tracing.Start(network.WithAllowLimitedConn(ctx, "transfer"), spanOpenStream, trace.WithAttributes(tracing.Peer(p)))
+	stream, err := n.Host.NewStream(sctx, p, pids...)
+	if err == nil {
+		span.SetAttributes(tracing.Protocol(stream.Protocol()))
+	}
+	tracing.End(span, err)
+	if err != nil {
+		return nil, err
+	}
+	return n.withTimeouts(ctx, stream), nil
+}
+
+// WithTimeouts wraps a stream handler so the streams it serves have the node's
+// stream timeouts and are reset once the node shuts down. Like the streams opened
+// with NewStream, they are counted in the metrics.
+func (n *Node) WithTimeouts(handler network.StreamHandler) network.StreamHandler {
+	return func(stream network.Stream) {
+		handler(n.withTimeouts(n.ctx, stream))
+	}
+}
+
+// withTimeouts applies the node's stream timeouts and resets the stream once ctx
+// is done.
+func (n *Node) withTimeouts(ctx context.Context, stream network.Stream) network.Stream {
+	cfg := n.timeouts
+	remote := stream.Conn().RemotePeer().String()
+	s := &timedStream{
+		Stream:   stream,
+		ctx:      ctx,
+		idle:     time.Duration(cfg.IdleTimeout),
+		active:   metrics.ActiveStreams.WithLabelValues(string(stream.Protocol())),
+		sent:     metrics.StreamBytes.WithLabelValues(string(Sent), remote),
+		received: metrics.StreamBytes.WithLabelValues(string(Received), remote),
+	}
+	s.active.Inc()
+	now := time.Now()
+	if cfg.ReadTimeout > 0 {
+		s.readBy = now.Add(time.Duration(cfg.ReadTimeout))
+	}
+	if cfg.WriteTimeout > 0 {
+		s.writeBy = now.Add(time.Duration(cfg.WriteTimeout))
+	}
+	s.stop = context.AfterFunc(ctx, func() { _ = stream.Reset() })
+	return s
+}
+
+// timedStream is a stream that fails once it has been idle for too long, once its
+// read or write timeout passes, or once the context it was opened with is done.
+type timedStream struct {
+	network.Stream
+	ctx     context.Context
+	idle    time.Duration
+	readBy  time.Time
+	writeBy time.Time
+	stop    func() bool
+
+	active         prometheus.Gauge
+	sent, received prometheus.Counter
+	release        sync.Once
+}
+
+func (s *timedStream) Read(p []byte) (int, error) {
+	_ = s.Stream.SetReadDeadline(s.deadline(s.readBy))
+	n, err := s.Stream.Read(p)
+	s.received.Add(float64(n))
+	return n, s.check(err)
+}
+
+func (s *timedStream) Write(p []byte) (int, error) {
+	_ = s.Stream.SetWriteDeadline(s.deadline(s.writeBy))
+	n, err := s.Stream.Write(p)
+	s.sent.Add(float64(n))
+	return n, s.check(err)
+}
+
+func (s *timedStream) Close() error {
+	s.done()
+	return s.Stream.Close()
+}
+
+func (s *timedStream) Reset() error {
+	s.done()
+	return s.Stream.Reset()
+}
+
+// done stops watching the context and stops counting the stream as active.
+func (s *timedStream) done() {
+	s.stop()
+	s.release.Do(s.active.Dec)
+}
+
+// deadline returns the deadline of the next read or write: the idle timeout from
+// now, or the stream's overall deadline by if that comes first.
+func (s *timedStream) deadline(by time.Time) time.Time {
+	var d time.Time
+	if s.idle > 0 {
+		d = time.Now().Add(s.idle)
+	}
+	if !by.IsZero() && (d.IsZero() || by.Before(d)) {
+		d = by
+	}
+	return d
+}
+
+// check translates the error of a read or write, resetting the stream when it
+// timed out so the peer notices too.
+func (s *timedStream) check(err error) error {
+	if err == nil || err == io.EOF {
+		return err
+	}
+	if ctxErr := s.ctx.Err(); ctxErr != nil {
+		return fmt.Errorf("stream closed: %w", ctxErr)
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		_ = s.Stream.Reset()
+		return fmt.Errorf("%w: %v", ErrStreamTimeout, err)
+	}
+	return err
+}
@@ -0,0 +1,48 @@
+package network
+
+import (
+	"context"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/logging"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Names of the network spans. Each peer records its side of a transfer: the
+// uploader and the serving peer of a download send, the other peer receives.
+const (
+	spanDial       = "network.dial"
+	spanOpenStream = "network.open_stream"
+	spanSend       = "network.send"
+	spanReceive    = "network.receive"
+)
+
+// startTransfer starts the span of a transfer with a peer, described by hdr. Spans
+// of the peer that started the transfer are clients, the others are servers.
+func startTransfer(ctx context.Context, name string, kind trace.SpanKind, p peer.ID, hdr Header) (context.Context, trace.Span) {
+	attrs := []attribute.KeyValue{tracing.Peer(p), tracing.File(hdr.Name)}
+	if hdr.Transfer != "" {
+		attrs = append(attrs, tracing.Transfer(hdr.Transfer))
+	}
+	if hdr.Size > 0 {
+		attrs = append(attrs, tracing.Size(hdr.Size))
+	}
+	return tracing.Start(ctx, name, trace.WithSpanKind(kind), trace.WithAttributes(attrs...))
+}
+
+// startFetch starts the span of a download from a peer and returns the request
+// naming the file, which carries the span's trace context.
+func startFetch(ctx context.Context, p peer.ID, name string) (context.Context, trace.Span, Header) {
+	req := Header{Name: name, Transfer: logging.NewTransferID()}
+	ctx, span := startTransfer(ctx, spanReceive, trace.SpanKindClient, p, req)
+	req.Trace = tracing.Inject(ctx)
+	return ctx, span, req
+}
+
+// serveTransfer starts the span of a transfer started by a peer, continuing the
+// trace context the peer sent in hdr.
+func serveTransfer(name string, p peer.ID, hdr Header) (context.Context, trace.Span) {
+	return startTransfer(tracing.Extract(context.Background(), hdr.Trace), name, trace.SpanKindServer, p, hdr)
+}
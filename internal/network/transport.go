@@ -0,0 +1,82 @@
+package network
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/libp2p/go-libp2p"
+	quic "github.com/libp2p/go-libp2p/p2p/transport/quic"
+	"github.com/libp2p/go-libp2p/p2p/transport/tcp"
+	webtransport "github.com/libp2p/go-libp2p/p2p/transport/webtransport"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/saurabhSPatel/p2p-file-sharing/config"
+)
+
+// transportOptions returns the libp2p options enabling the configured transports and
+// listen addresses.
+func transportOptions(cfg config.TransportConfig) ([]libp2p.Option, error) {
+	if !cfg.TCP && !cfg.QUIC && !cfg.WebTransport {
+		return nil, fmt.Errorf("no transport enabled")
+	}
+
+	families := []string{"/ip4/0.0.0.0"}
+	if cfg.IPv6 {
+		families = append(families, "/ip6/::")
+	}
+
+	var opts []libp2p.Option
+	var listenAddrs []string
+	if cfg.TCP {
+		opts = append(opts, libp2p.Transport(tcp.NewTCPTransport))
+		for _, family := range families {
+			listenAddrs = append(listenAddrs, fmt.Sprintf("%s/tcp/%d", family, cfg.Port))
+		}
+	}
+	if cfg.QUIC {
+		opts = append(opts, libp2p.Transport(quic.NewTransport))
+		for _, family := range families {
+			listenAddrs = append(listenAddrs, fmt.Sprintf("%s/udp/%d/quic-v1", family, cfg.Port))
+		}
+	}
+	if cfg.WebTransport {
+		opts = append(opts, libp2p.Transport(webtransport.New))
+		for _, family := range families {
+			listenAddrs = append(listenAddrs, fmt.Sprintf("%s/udp/%d/quic-v1/webtransport", family, cfg.Port))
+		}
+	}
+
+	return append(opts, libp2p.ListenAddrStrings(listenAddrs...)), nil
+}
+
+// TransportName returns the name of the transport an address uses, such as "tcp",
+// "quic-v1", "webtransport" or "p2p-circuit".
+func TransportName(addr ma.Multiaddr) string {
+	// Later protocols are layered on earlier ones, so the last match wins.
+	name := "unknown"
+	for _, code := range []int{ma.P_TCP, ma.P_QUIC_V1, ma.P_WEBTRANSPORT, ma.P_CIRCUIT} {
+		if _, err := addr.ValueForProtocol(code); err == nil {
+			name = ma.ProtocolWithCode(code).Name
+		}
+	}
+	return name
+}
+
+// AddrsByTransport groups addresses by transport name.
+func AddrsByTransport(addrs []ma.Multiaddr) map[string][]ma.Multiaddr {
+	groups := make(map[string][]ma.Multiaddr)
+	for _, addr := range addrs {
+		name := TransportName(addr)
+		groups[name] = append(groups[name], addr)
+	}
+	return groups
+}
+
+// TransportNames returns the sorted transport names of a grouping.
+func TransportNames(groups map[string][]ma.Multiaddr) []string {
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
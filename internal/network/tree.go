@@ -0,0 +1,284 @@
+package network
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/file"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/logging"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/tracing"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// TreeProtocolID uploads a directory tree, which the peer stores in its download directory.
+	TreeProtocolID = protocolPrefix + "tree/3.0.0"
+	// FetchTreeProtocolID serves a directory tree from the shared directory.
+	FetchTreeProtocolID = protocolPrefix + "fetch-tree/2.0.0"
+)
+
+// Both tree protocols send a header naming the directory followed by a tar archive
+// written by file.WriteTree. The requester of a fetch sends the header alone, and
+// the receiver of an upload answers with an Ack like the receiver of a file.
+
+// SendTree uploads the directory tree at dir to a peer under the given name.
+func (n *Node) SendTree(ctx context.Context, peerID peer.ID, name string, dir string) (file.TreeStats, error) {
+	start := time.Now()
+	hdr := Header{Name: name, Transfer: logging.NewTransferID()}
+	ctx, span := startTransfer(ctx, spanSend, trace.SpanKindClient, peerID, hdr)
+	hdr.Trace = tracing.Inject(ctx)
+	stats, err := n.sendTree(ctx, peerID, hdr, dir)
+	span.SetAttributes(tracing.Size(stats.Bytes))
+	tracing.End(span, err)
+	n.RecordTransfer(peerID, Sent, stats.Bytes, time.Since(start), err)
+	return stats, err
+}
+
+// sendTree writes the tree to a new stream and waits for the peer's ack without
+// recording the outcome.
+func (n *Node) sendTree(ctx context.Context, peerID peer.ID, hdr Header, dir string) (file.TreeStats, error) {
+	stream, err := n.NewStream(ctx, peerID, TreeProtocolID)
+	if err != nil {
+		return file.TreeStats{}, fmt.Errorf("error creating new stream: %w", err)
+	}
+	defer stream.Close()
+
+	// As with files, a rejection may arrive before the whole tree is written and
+	// aborts the upload.
+	acks := make(chan error, 1)
+	go func() {
+		err := readAck(bufio.NewReader(stream), AckStored)
+		if err != nil && !errors.Is(err, ErrNoAck) {
+			_ = stream.Reset()
+		}
+		acks <- err
+	}()
+
+	stats, err := writeTree(stream, hdr, dir)
+	if err == nil {
+		if err = stream.CloseWrite(); err != nil {
+			err = fmt.Errorf("error closing stream: %w", err)
+		}
+	}
+	if err != nil {
+		// A reset tells the peer to discard the partial tree.
+		_ = stream.Reset()
+		if ackErr := <-acks; ackErr != nil && !errors.Is(ackErr, ErrNoAck) {
+			return stats, ackErr
+		}
+		return stats, err
+	}
+	if err := <-acks; err != nil {
+		return stats, err
+	}
+
+	n.logger.Info("Directory stored by peer", logging.Peer(peerID), logging.Transfer(hdr.Transfer),
+		"name", hdr.Name, "files", stats.Files, "dirs", stats.Dirs, "size", stats.Bytes)
+	return stats, nil
+}
+
+// writeTree writes the header followed by the tar archive of dir.
+func writeTree(stream network.Stream, hdr Header, dir string) (file.TreeStats, error) {
+	writer := bufio.NewWriter(stream)
+	if err := writeHeader(writer, hdr); err != nil {
+		return file.TreeStats{}, err
+	}
+	stats, err := file.WriteTree(writer, dir)
+	if err != nil {
+		return stats, err
+	}
+	if err := writer.Flush(); err != nil {
+		return stats, fmt.Errorf("error flushing data: %w", err)
+	}
+	return stats, nil
+}
+
+// handleTree stores an uploaded directory tree in the download directory and
+// answers with an Ack.
+func (n *Node) handleTree(stream network.Stream) {
+	logger := n.streamLogger(stream)
+	defer func() {
+		if err := stream.Close(); err != nil {
+			logger.Debug("Error closing stream", "error", err)
+		}
+	}()
+
+	ack, logger := n.receiveTreeUpload(stream, logger)
+	if err := writeAck(stream, ack); err != nil {
+		logger.Warn("Error acknowledging directory", "error", err)
+		return
+	}
+	if ack.Status != AckStored {
+		// The rest of a rejected tree is discarded until the sender reads the ack
+		// and aborts.
+		_ = stream.CloseWrite()
+		_, _ = io.Copy(io.Discard, stream)
+	}
+}
+
+// receiveTreeUpload stores a tree uploaded over the stream and returns the verdict
+// for the uploader, along with logger annotated with the upload once it is known.
+func (n *Node) receiveTreeUpload(stream network.Stream, logger *slog.Logger) (Ack, *slog.Logger) {
+	remote := stream.Conn().RemotePeer()
+	recv := n.recv
+	if !recv.allows(remote) {
+		logger.Warn("Rejected directory: uploads from this peer are not allowed")
+		return Ack{Status: AckForbidden}, logger
+	}
+
+	reader := bufio.NewReader(stream)
+	hdr, err := readHeader(reader)
+	if err != nil {
+		logger.Warn("Error reading directory header", "error", err)
+		return nack(AckInvalid, err), logger
+	}
+	logger = logger.With(transferAttr(hdr), "name", hdr.Name)
+
+	_, span := serveTransfer(spanReceive, remote, hdr)
+	stats, ack := receiveTree(reader, hdr.Name, remote, recv, logger)
+	span.SetAttributes(tracing.Size(stats.Bytes))
+	tracing.End(span, ack.Err())
+	if ack.Status != AckStored {
+		return ack, logger
+	}
+	if err := recv.record(remote, hdr.Name); err != nil {
+		logger.Error("Error recording upload", "error", err)
+	}
+	logger.Info("Received directory", "files", stats.Files, "dirs", stats.Dirs, "size", stats.Bytes)
+	return ack, logger
+}
+
+// receiveTree extracts a tree uploaded by a peer into the download directory.
+func receiveTree(r io.Reader, name string, remote peer.ID, recv *receiver, logger *slog.Logger) (file.TreeStats, Ack) {
+	dest, err := file.LocalPath(recv.downloadDir, name)
+	if err != nil {
+		logger.Warn("Rejected directory", "error", err)
+		return file.TreeStats{}, nack(AckInvalid, err)
+	}
+	adm, reject, ok := recv.admitTree(remote, name)
+	if !ok {
+		logger.Warn("Rejected directory", "status", reject.Status, "reason", reject.Message)
+		return file.TreeStats{}, reject
+	}
+	defer adm.release()
+
+	// Each file reserves its space before it is extracted, and the tree is
+	// rejected once one does not fit.
+	limits := file.TreeLimits{
+		MaxFileSize: recv.maxFileSize,
+		Reserve: func(size int64) error {
+			if ack, ok := adm.grow(size); !ok {
+				reject = ack
+				return errLimitExceeded
+			}
+			return nil
+		},
+	}
+	start := time.Now()
+	stats, err := file.ExtractTree(r, dest, recv.policy, limits)
+	observeTransfer(Received, time.Since(start), err)
+	switch {
+	case errors.Is(err, file.ErrFileTooLarge):
+		reject = Ack{Status: AckTooLarge, Message: err.Error()}
+	case errors.Is(err, errLimitExceeded):
+	case err != nil:
+		logger.Warn("Error receiving directory", "error", err)
+		return stats, nack(AckInvalid, err)
+	default:
+		return stats, Ack{Status: AckStored}
+	}
+	logger.Warn("Rejected directory", "status", reject.Status, "reason", reject.Message)
+	return stats, reject
+}
+
+// handleFetchTree serves a directory tree from the shared directory.
+func (n *Node) handleFetchTree(stream network.Stream, sharedDir string) {
+	defer stream.Close()
+	logger := n.streamLogger(stream)
+
+	req, err := readHeader(bufio.NewReader(stream))
+	if err != nil {
+		logger.Warn("Error reading fetch request", "error", err)
+		_ = stream.Reset()
+		return
+	}
+
+	dir, err := file.LocalPath(sharedDir, req.Name)
+	if err != nil {
+		logger.Warn("Rejected fetch request", "error", err)
+		_ = stream.Reset()
+		return
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		_ = stream.Reset()
+		return
+	}
+	req.Transfer = transferID(req)
+	_, span := serveTransfer(spanSend, stream.Conn().RemotePeer(), req)
+	start := time.Now()
+	stats, err := writeTree(stream, Header{Name: req.Name, Transfer: req.Transfer}, dir)
+	observeTransfer(Sent, time.Since(start), err)
+	span.SetAttributes(tracing.Size(stats.Bytes))
+	tracing.End(span, err)
+	if err != nil {
+		logger.Warn("Error serving directory", logging.Transfer(req.Transfer), "name", req.Name, "error", err)
+		_ = stream.Reset()
+	}
+}
+
+// FetchTree downloads a directory tree from a peer's shared directory into
+// downloadDir, keeping its relative path and the attributes the policy allows.
+func (n *Node) FetchTree(ctx context.Context, peerID peer.ID, name string, downloadDir string, policy file.Policy) (file.TreeStats, error) {
+	ctx, span, req := startFetch(ctx, peerID, name)
+	stats, err := n.fetchTree(ctx, peerID, req, downloadDir, policy)
+	span.SetAttributes(tracing.Size(stats.Bytes))
+	tracing.End(span, err)
+	return stats, err
+}
+
+// fetchTree runs the requesting side of the fetch-tree protocol.
+func (n *Node) fetchTree(ctx context.Context, peerID peer.ID, req Header, downloadDir string, policy file.Policy) (file.TreeStats, error) {
+	name := req.Name
+	dest, err := file.LocalPath(downloadDir, name)
+	if err != nil {
+		return file.TreeStats{}, err
+	}
+
+	stream, err := n.NewStream(ctx, peerID, FetchTreeProtocolID)
+	if err != nil {
+		return file.TreeStats{}, fmt.Errorf("error creating new stream: %w", err)
+	}
+	defer stream.Close()
+
+	if err := writeHeader(stream, req); err != nil {
+		return file.TreeStats{}, fmt.Errorf("error requesting directory: %w", err)
+	}
+	if err := stream.CloseWrite(); err != nil {
+		return file.TreeStats{}, fmt.Errorf("error requesting directory: %w", err)
+	}
+
+	reader := bufio.NewReader(stream)
+	hdr, err := readHeader(reader)
+	if errors.Is(err, network.ErrReset) {
+		return file.TreeStats{}, fmt.Errorf("%w: %s", ErrFileUnavailable, name)
+	}
+	if err != nil {
+		return file.TreeStats{}, err
+	}
+	if hdr.Name != name {
+		return file.TreeStats{}, fmt.Errorf("received unexpected directory '%s'", hdr.Name)
+	}
+	stats, err := file.ExtractTree(reader, dest, policy, file.TreeLimits{MaxFileSize: n.maxDownload})
+	if errors.Is(err, file.ErrFileTooLarge) {
+		err = fmt.Errorf("%w: %w", ErrDownloadTooLarge, err)
+	}
+	return stats, err
+}
@@ -0,0 +1,307 @@
+// Package outbox delivers uploads to peers that may be offline. Queued files are
+// kept in the data directory and retried with backoff until the peer acknowledges
+// them, including across restarts, or rejects them for good.
+package outbox
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/discovery"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/file"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/logging"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/network"
+)
+
+const (
+	// stateFile is the name of the file in the data directory listing queued uploads.
+	stateFile = "outbox.json"
+	// contentDir is the directory in the data directory holding queued file contents.
+	contentDir = "outbox"
+	// minBackoff is the delay before the first retry; it doubles with every failure.
+	minBackoff = 5 * time.Second
+	// maxBackoff caps the delay between retries.
+	maxBackoff = time.Hour
+	// deliveryTimeout bounds a single delivery attempt.
+	deliveryTimeout = 10 * time.Minute
+)
+
+// Item is a queued upload.
+type Item struct {
+	ID       string        `json:"id"`
+	Peer     peer.ID       `json:"peer"`
+	Name     string        `json:"name"`
+	Size     int64         `json:"size"`
+	Metadata file.Metadata `json:"metadata"`
+	Queued   time.Time     `json:"queued"`
+	Attempts int           `json:"attempts"`
+	// NextAttempt is when the upload is retried, unless the peer reappears earlier.
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// Outbox queues uploads and delivers them in the background.
+type Outbox struct {
+	ctx       context.Context
+	host      *network.Node
+	dir       string
+	statePath string
+	wake      chan struct{}
+	logger    *slog.Logger
+
+	mu    sync.Mutex
+	items map[string]*Item
+}
+
+// NewOutbox loads the uploads queued in dataDir by a previous run. Deliveries log
+// to logger.
+func NewOutbox(ctx context.Context, h *network.Node, dataDir string, logger *slog.Logger) (*Outbox, error) {
+	o := &Outbox{
+		ctx:       ctx,
+		host:      h,
+		dir:       filepath.Join(dataDir, contentDir),
+		statePath: filepath.Join(dataDir, stateFile),
+		wake:      make(chan struct{}, 1),
+		logger:    logger,
+		items:     make(map[string]*Item),
+	}
+	if err := os.MkdirAll(o.dir, 0700); err != nil {
+		return nil, fmt.Errorf("error creating outbox directory '%s': %w", o.dir, err)
+	}
+
+	data, err := os.ReadFile(o.statePath)
+	switch {
+	case err == nil:
+		var items []*Item
+		if err := json.Unmarshal(data, &items); err != nil {
+			return nil, fmt.Errorf("error parsing outbox '%s': %w", o.statePath, err)
+		}
+		for _, item := range items {
+			o.items[item.ID] = item
+		}
+	case !errors.Is(err, fs.ErrNotExist):
+		return nil, fmt.Errorf("error reading outbox '%s': %w", o.statePath, err)
+	}
+	return o, nil
+}
+
+// Start delivers queued uploads in the background until the context given to
+// NewOutbox is done. Uploads to a peer are retried at once when peers reports that
+// the peer reappeared.
+func (o *Outbox) Start(peers <-chan discovery.PeerEvent) {
+	go o.run(peers)
+}
+
+// Enqueue queues a file for delivery to a peer. The content is copied into the
+// outbox, so later changes to the original file are not delivered.
+func (o *Outbox) Enqueue(p peer.ID, name string, data []byte, md file.Metadata) (Item, error) {
+	id, err := newID()
+	if err != nil {
+		return Item{}, err
+	}
+	if err := file.WriteFileAtomic(filepath.Join(o.dir, id), data, time.Time{}); err != nil {
+		return Item{}, fmt.Errorf("error queueing '%s': %w", name, err)
+	}
+
+	now := time.Now()
+	item := &Item{ID: id, Peer: p, Name: name, Size: int64(len(data)), Metadata: md, Queued: now, NextAttempt: now}
+	o.mu.Lock()
+	o.items[id] = item
+	err = o.saveLocked()
+	o.mu.Unlock()
+	if err != nil {
+		return Item{}, err
+	}
+
+	o.notify()
+	return *item, nil
+}
+
+// Items returns the queued uploads, oldest first.
+func (o *Outbox) Items() []Item {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	items := make([]Item, 0, len(o.items))
+	for _, item := range o.items {
+		items = append(items, *item)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Queued.Before(items[j].Queued) })
+	return items
+}
+
+// run delivers uploads when they are due, when new ones are queued and when their
+// peer reappears.
+func (o *Outbox) run(peers <-chan discovery.PeerEvent) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-o.ctx.Done():
+			return
+		case ev, ok := <-peers:
+			if !ok {
+				peers = nil
+				continue
+			}
+			if ev.Type != discovery.PeerIdentified || !o.retryNow(ev.Peer.ID) {
+				continue
+			}
+		case <-o.wake:
+		case <-timer.C:
+		}
+		o.deliverDue()
+		timer.Reset(o.untilNext())
+	}
+}
+
+// retryNow makes the uploads to a peer due, reporting whether there are any.
+func (o *Outbox) retryNow(p peer.ID) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	found := false
+	for _, item := range o.items {
+		if item.Peer == p {
+			item.NextAttempt = time.Now()
+			found = true
+		}
+	}
+	return found
+}
+
+// deliverDue attempts every upload that is due.
+func (o *Outbox) deliverDue() {
+	o.mu.Lock()
+	var due []Item
+	now := time.Now()
+	for _, item := range o.items {
+		if !item.NextAttempt.After(now) {
+			due = append(due, *item)
+		}
+	}
+	o.mu.Unlock()
+	sort.Slice(due, func(i, j int) bool { return due[i].Queued.Before(due[j].Queued) })
+
+	for _, item := range due {
+		if o.ctx.Err() != nil {
+			return
+		}
+		err := o.deliver(item)
+
+		o.mu.Lock()
+		done := err == nil || permanent(err)
+		if err == nil {
+			delete(o.items, item.ID)
+			o.logger.Info("Delivered upload", logging.Peer(item.Peer), "name", item.Name, "attempts", item.Attempts+1)
+		} else if done {
+			delete(o.items, item.ID)
+			o.logger.Error("Upload rejected by peer, dropping it", logging.Peer(item.Peer), "name", item.Name,
+				"attempts", item.Attempts+1, "error", err)
+		} else if queued, ok := o.items[item.ID]; ok {
+			queued.Attempts++
+			queued.LastError = err.Error()
+			queued.NextAttempt = time.Now().Add(backoff(queued.Attempts))
+			o.logger.Warn("Delivery failed", logging.Peer(item.Peer), "name", item.Name,
+				"attempts", queued.Attempts, "retry_in", backoff(queued.Attempts), "error", err)
+		}
+		if err := o.saveLocked(); err != nil {
+			o.logger.Error("Error saving outbox", "error", err)
+		}
+		o.mu.Unlock()
+
+		if done {
+			if err := os.Remove(filepath.Join(o.dir, item.ID)); err != nil {
+				o.logger.Error("Error removing queued upload", "id", item.ID, "error", err)
+			}
+		}
+	}
+}
+
+// permanent reports whether a delivery failed in a way retrying cannot fix: the
+// peer refused the file itself rather than being unreachable, busy, over its quota
+// or short of disk space for now.
+func permanent(err error) bool {
+	for _, target := range []error{network.ErrForbidden, network.ErrInvalidFile, network.ErrTooLarge} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// deliver uploads a queued file. It succeeds once the peer acknowledges the file
+// as stored, and otherwise fails with the error matching the peer's ack status.
+func (o *Outbox) deliver(item Item) error {
+	data, err := os.ReadFile(filepath.Join(o.dir, item.ID))
+	if err != nil {
+		return fmt.Errorf("error reading queued upload: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(o.ctx, deliveryTimeout)
+	defer cancel()
+	_, err = o.host.SendFileDelta(ctx, item.Peer, item.Name, data, item.Metadata)
+	return err
+}
+
+// untilNext returns the time until the next upload is due.
+func (o *Outbox) untilNext() time.Duration {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	next := maxBackoff
+	for _, item := range o.items {
+		next = min(next, max(time.Until(item.NextAttempt), 0))
+	}
+	return next
+}
+
+// notify wakes the delivery loop without blocking.
+func (o *Outbox) notify() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// saveLocked persists the list of queued uploads.
+func (o *Outbox) saveLocked() error {
+	items := make([]*Item, 0, len(o.items))
+	for _, item := range o.items {
+		items = append(items, item)
+	}
+	data, err := json.MarshalIndent(items, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding outbox: %w", err)
+	}
+	return file.WriteFileAtomic(o.statePath, data, time.Time{})
+}
+
+// backoff returns the delay before retrying an upload that failed attempts times.
+func backoff(attempts int) time.Duration {
+	d := minBackoff
+	for i := 1; i < attempts && d < maxBackoff; i++ {
+		d *= 2
+	}
+	return min(d, maxBackoff)
+}
+
+// newID returns a random identifier for a queued upload.
+func newID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error generating upload ID: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,143 @@
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/saurabhSPatel/p2p-file-sharing/config"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/discovery"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/file"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/logging"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/network"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{attempts: 1, want: 5 * time.Second},
+		{attempts: 2, want: 10 * time.Second},
+		{attempts: 5, want: 80 * time.Second},
+		{attempts: 12, want: time.Hour},
+		{attempts: 100, want: time.Hour},
+	}
+	for _, tt := range tests {
+		if got := backoff(tt.attempts); got != tt.want {
+			t.Errorf("backoff(%d) = %s, want %s", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestPermanent(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{err: network.ErrForbidden, want: true},
+		{err: fmt.Errorf("%w: files are limited to 10 bytes", network.ErrTooLarge), want: true},
+		{err: network.ErrQuotaExceeded, want: false},
+		{err: network.ErrInvalidFile, want: true},
+		{err: network.ErrBusy, want: false},
+		{err: network.ErrDiskFull, want: false},
+		{err: network.ErrNoAck, want: false},
+		{err: errors.New("error creating new stream: no addresses"), want: false},
+	}
+	for _, tt := range tests {
+		if got := permanent(tt.err); got != tt.want {
+			t.Errorf("permanent(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestOutbox(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	sender, err := network.SetupHost(ctx, config.Default(), logging.Discard())
+	if err != nil {
+		t.Fatalf("Failed to setup host: %v", err)
+	}
+	defer sender.Close()
+	cfg := config.Default()
+	cfg.DownloadDir = t.TempDir()
+	recipient, err := network.SetupHost(ctx, cfg, logging.Discard())
+	if err != nil {
+		t.Fatalf("Failed to setup host: %v", err)
+	}
+	defer recipient.Close()
+
+	// The recipient is unknown to the sender, so the upload waits in the outbox.
+	dataDir := t.TempDir()
+	o, err := NewOutbox(ctx, sender, dataDir, logging.Discard())
+	if err != nil {
+		t.Fatalf("NewOutbox() error = %v", err)
+	}
+	data := bytes.Repeat([]byte("queued report "), 1000)
+	md := file.Metadata{Mode: 0644, ModTime: time.Now().Truncate(time.Second)}
+	item, err := o.Enqueue(recipient.ID(), "report.txt", data, md)
+	if err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+	o.deliverDue()
+	items := o.Items()
+	if len(items) != 1 || items[0].Attempts != 1 || items[0].LastError == "" {
+		t.Fatalf("Items() = %+v, want one failed attempt", items)
+	}
+
+	// A restarted outbox resumes the queued upload.
+	o, err = NewOutbox(ctx, sender, dataDir, logging.Discard())
+	if err != nil {
+		t.Fatalf("NewOutbox() error = %v", err)
+	}
+	if items := o.Items(); len(items) != 1 || items[0].ID != item.ID || items[0].Peer != recipient.ID() {
+		t.Fatalf("Items() after restart = %+v, want %s", items, item.ID)
+	}
+
+	// Once the recipient reappears, the upload is delivered well before its backoff.
+	peers := make(chan discovery.PeerEvent, 1)
+	o.Start(peers)
+	info := peer.AddrInfo{ID: recipient.ID(), Addrs: recipient.Addrs()}
+	if err := sender.Connect(ctx, info); err != nil {
+		t.Fatalf("Failed to connect hosts: %v", err)
+	}
+	peers <- discovery.PeerEvent{Type: discovery.PeerIdentified, Peer: info}
+
+	for len(o.Items()) > 0 {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("Timed out waiting for delivery, outbox = %+v", o.Items())
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	got, err := os.ReadFile(filepath.Join(cfg.DownloadDir, "report.txt"))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("delivered file = %d bytes, %v; want %d bytes", len(got), err, len(data))
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, contentDir, item.ID)); !os.IsNotExist(err) {
+		t.Errorf("queued content still exists after delivery: %v", err)
+	}
+
+	// An upload the recipient refuses is dropped rather than retried.
+	rejected, err := o.Enqueue(recipient.ID(), "/etc/passwd", data, md)
+	if err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+	for len(o.Items()) > 0 {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("Timed out waiting for the rejected upload to be dropped, outbox = %+v", o.Items())
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, contentDir, rejected.ID)); !os.IsNotExist(err) {
+		t.Errorf("queued content still exists after rejection: %v", err)
+	}
+}
@@ -0,0 +1,354 @@
+// Package seal encrypts files for a set of recipient peers, so they stay private
+// at rest and on any peer that stores or relays them. It follows the design of age:
+// a random file key encrypts the content in authenticated chunks, and the file key
+// is wrapped for each recipient with an X25519 key agreement against the Curve25519
+// form of the recipient's Ed25519 libp2p identity key.
+//
+// A sealed file starts with a text header:
+//
+//	p2p-file-sharing/seal/v1
+//	-> X25519 <ephemeral public key> <wrapped file key>
+//	--- <header MAC>
+//
+// with one "->" line per recipient, followed by a random nonce and the chunks.
+package seal
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Extension is appended to the name of sealed files.
+const Extension = ".p2penc"
+
+const (
+	magic        = "p2p-file-sharing/seal/v1"
+	stanzaPrefix = "-> X25519 "
+	macPrefix    = "--- "
+	// maxRecipients bounds the header of a sealed file.
+	maxRecipients = 1024
+	fileKeySize   = 16
+	nonceSize     = 16
+	// chunkSize is the plaintext size of every chunk but the last.
+	chunkSize = 64 << 10
+)
+
+var (
+	// ErrNotRecipient is returned when a file was not sealed for the given key.
+	ErrNotRecipient = errors.New("file is not sealed for this peer")
+	// ErrUnsupportedKey is returned for identity keys other than Ed25519.
+	ErrUnsupportedKey = errors.New("only Ed25519 identity keys are supported")
+	// ErrInvalidFile is returned for a malformed or tampered sealed file.
+	ErrInvalidFile = errors.New("invalid sealed file")
+)
+
+var b64 = base64.RawStdEncoding
+
+// Encrypt seals the content read from r for the given recipients and writes it to w.
+func Encrypt(w io.Writer, r io.Reader, recipients []crypto.PubKey) error {
+	if len(recipients) == 0 {
+		return fmt.Errorf("at least one recipient is required")
+	}
+	if len(recipients) > maxRecipients {
+		return fmt.Errorf("at most %d recipients are supported", maxRecipients)
+	}
+	fileKey := make([]byte, fileKeySize)
+	if _, err := rand.Read(fileKey); err != nil {
+		return fmt.Errorf("error generating file key: %w", err)
+	}
+
+	var hdr bytes.Buffer
+	hdr.WriteString(magic + "\n")
+	for _, pub := range recipients {
+		stanza, err := wrapKey(fileKey, pub)
+		if err != nil {
+			return err
+		}
+		hdr.WriteString(stanza + "\n")
+	}
+	hdr.WriteString(strings.TrimSpace(macPrefix))
+	mac := headerMAC(fileKey, hdr.Bytes())
+	hdr.WriteString(" " + b64.EncodeToString(mac) + "\n")
+
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("error generating nonce: %w", err)
+	}
+	writer := bufio.NewWriter(w)
+	if _, err := writer.Write(hdr.Bytes()); err != nil {
+		return fmt.Errorf("error writing header: %w", err)
+	}
+	if _, err := writer.Write(nonce); err != nil {
+		return fmt.Errorf("error writing header: %w", err)
+	}
+
+	aead, err := chacha20poly1305.New(deriveKey(fileKey, nonce, "payload"))
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReaderSize(r, chunkSize)
+	buf := make([]byte, chunkSize, chunkSize+aead.Overhead())
+	for counter := uint64(0); ; counter++ {
+		n, err := io.ReadFull(reader, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("error reading content: %w", err)
+		}
+		// The last chunk is marked in its nonce, so truncation is detected.
+		last := n < chunkSize
+		if !last {
+			if _, err := reader.Peek(1); err == io.EOF {
+				last = true
+			}
+		}
+		sealed := aead.Seal(buf[:0], chunkNonce(counter, last), buf[:n], nil)
+		if _, err := writer.Write(sealed); err != nil {
+			return fmt.Errorf("error writing content: %w", err)
+		}
+		if last {
+			break
+		}
+		buf = buf[:chunkSize]
+	}
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("error writing content: %w", err)
+	}
+	return nil
+}
+
+// Decrypt opens a file sealed for the peer holding priv and writes its content to
+// w. Content is written as it is authenticated, so on error w may hold a prefix of
+// the file and should be discarded.
+func Decrypt(w io.Writer, r io.Reader, priv crypto.PrivKey) error {
+	identity, err := x25519Private(priv)
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(r)
+	fileKey, err := readHeader(reader, identity)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, nonceSize)
+	if _, err := io.ReadFull(reader, nonce); err != nil {
+		return fmt.Errorf("%w: missing nonce", ErrInvalidFile)
+	}
+	aead, err := chacha20poly1305.New(deriveKey(fileKey, nonce, "payload"))
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, chunkSize+aead.Overhead())
+	for counter := uint64(0); ; counter++ {
+		n, err := io.ReadFull(reader, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("error reading content: %w", err)
+		}
+		last := n < len(buf)
+		if !last {
+			if _, err := reader.Peek(1); err == io.EOF {
+				last = true
+			}
+		}
+		plain, err := aead.Open(buf[:0], chunkNonce(counter, last), buf[:n], nil)
+		if err != nil {
+			return fmt.Errorf("%w: chunk %d failed authentication", ErrInvalidFile, counter)
+		}
+		if _, err := w.Write(plain); err != nil {
+			return fmt.Errorf("error writing content: %w", err)
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// readHeader parses the header, unwraps the file key with identity and checks the MAC.
+func readHeader(r *bufio.Reader, identity []byte) ([]byte, error) {
+	var hdr bytes.Buffer
+	line, err := r.ReadString('\n')
+	if err != nil || line != magic+"\n" {
+		return nil, fmt.Errorf("%w: unknown format", ErrInvalidFile)
+	}
+	hdr.WriteString(line)
+
+	var fileKey []byte
+	for i := 0; ; i++ {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("%w: truncated header", ErrInvalidFile)
+		}
+		if mac, ok := strings.CutPrefix(line, macPrefix); ok {
+			hdr.WriteString(strings.TrimSpace(macPrefix))
+			if fileKey == nil {
+				return nil, ErrNotRecipient
+			}
+			got, err := b64.DecodeString(strings.TrimSuffix(mac, "\n"))
+			if err != nil || !hmac.Equal(got, headerMAC(fileKey, hdr.Bytes())) {
+				return nil, fmt.Errorf("%w: header MAC mismatch", ErrInvalidFile)
+			}
+			return fileKey, nil
+		}
+		if i >= maxRecipients {
+			return nil, fmt.Errorf("%w: too many recipients", ErrInvalidFile)
+		}
+		hdr.WriteString(line)
+		stanza, ok := strings.CutPrefix(strings.TrimSuffix(line, "\n"), stanzaPrefix)
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown recipient line", ErrInvalidFile)
+		}
+		if fileKey == nil {
+			fileKey = unwrapKey(stanza, identity)
+		}
+	}
+}
+
+// wrapKey encrypts the file key for a recipient and returns the header line.
+func wrapKey(fileKey []byte, pub crypto.PubKey) (string, error) {
+	recipient, err := x25519Public(pub)
+	if err != nil {
+		return "", err
+	}
+	ephemeral := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(ephemeral); err != nil {
+		return "", fmt.Errorf("error generating ephemeral key: %w", err)
+	}
+	ephemeralPub, err := curve25519.X25519(ephemeral, curve25519.Basepoint)
+	if err != nil {
+		return "", err
+	}
+	shared, err := curve25519.X25519(ephemeral, recipient)
+	if err != nil {
+		return "", fmt.Errorf("error wrapping file key: %w", err)
+	}
+	aead, err := chacha20poly1305.New(deriveKey(shared, append(ephemeralPub, recipient...), "x25519"))
+	if err != nil {
+		return "", err
+	}
+	wrapped := aead.Seal(nil, make([]byte, chacha20poly1305.NonceSize), fileKey, nil)
+	return stanzaPrefix + b64.EncodeToString(ephemeralPub) + " " + b64.EncodeToString(wrapped), nil
+}
+
+// unwrapKey returns the file key from a recipient line, or nil if the line is not
+// for identity.
+func unwrapKey(stanza string, identity []byte) []byte {
+	fields := strings.Fields(stanza)
+	if len(fields) != 2 {
+		return nil
+	}
+	ephemeralPub, err := b64.DecodeString(fields[0])
+	if err != nil || len(ephemeralPub) != curve25519.PointSize {
+		return nil
+	}
+	wrapped, err := b64.DecodeString(fields[1])
+	if err != nil {
+		return nil
+	}
+	shared, err := curve25519.X25519(identity, ephemeralPub)
+	if err != nil {
+		return nil
+	}
+	recipient, err := curve25519.X25519(identity, curve25519.Basepoint)
+	if err != nil {
+		return nil
+	}
+	aead, err := chacha20poly1305.New(deriveKey(shared, append(ephemeralPub, recipient...), "x25519"))
+	if err != nil {
+		return nil
+	}
+	fileKey, err := aead.Open(nil, make([]byte, chacha20poly1305.NonceSize), wrapped, nil)
+	if err != nil || len(fileKey) != fileKeySize {
+		return nil
+	}
+	return fileKey
+}
+
+// deriveKey derives a 32-byte key for the given purpose with HKDF-SHA256.
+func deriveKey(secret, salt []byte, purpose string) []byte {
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte("p2p-file-sharing/seal/"+purpose)), key); err != nil {
+		panic(err) // HKDF-SHA256 can produce far more than 32 bytes.
+	}
+	return key
+}
+
+// headerMAC authenticates the header up to the MAC itself with the file key.
+func headerMAC(fileKey, hdr []byte) []byte {
+	mac := hmac.New(sha256.New, deriveKey(fileKey, nil, "header"))
+	mac.Write(hdr)
+	return mac.Sum(nil)
+}
+
+// chunkNonce is the big-endian chunk counter followed by a flag marking the last chunk.
+func chunkNonce(counter uint64, last bool) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[3:11], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// x25519Public converts an Ed25519 public key to its Curve25519 form, using the
+// birational map u = (1 + y) / (1 - y).
+func x25519Public(pub crypto.PubKey) ([]byte, error) {
+	if _, ok := pub.(*crypto.Ed25519PublicKey); !ok {
+		return nil, ErrUnsupportedKey
+	}
+	raw, err := pub.Raw()
+	if err != nil {
+		return nil, err
+	}
+	p := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+	le := append([]byte(nil), raw...)
+	le[31] &= 0x7f // drop the sign of x
+	y := new(big.Int).SetBytes(reverse(le))
+
+	num := new(big.Int).Add(big.NewInt(1), y)
+	den := new(big.Int).Sub(big.NewInt(1), y)
+	den.Mod(den, p)
+	if den.Sign() == 0 {
+		return nil, fmt.Errorf("%w: invalid Ed25519 key", ErrUnsupportedKey)
+	}
+	u := num.Mul(num, den.ModInverse(den, p))
+	u.Mod(u, p)
+	return reverse(u.FillBytes(make([]byte, curve25519.PointSize))), nil
+}
+
+// x25519Private derives the Curve25519 scalar of an Ed25519 private key, as the
+// key's signing scalar is derived from its seed.
+func x25519Private(priv crypto.PrivKey) ([]byte, error) {
+	if _, ok := priv.(*crypto.Ed25519PrivateKey); !ok {
+		return nil, ErrUnsupportedKey
+	}
+	raw, err := priv.Raw()
+	if err != nil {
+		return nil, err
+	}
+	digest := sha512.Sum512(raw[:32])
+	return digest[:curve25519.ScalarSize], nil
+}
+
+// reverse reverses b in place and returns it, converting between little- and
+// big-endian encodings.
+func reverse(b []byte) []byte {
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return b
+}
@@ -0,0 +1,109 @@
+package seal
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"golang.org/x/crypto/curve25519"
+)
+
+func generateKey(t *testing.T) (crypto.PrivKey, crypto.PubKey) {
+	t.Helper()
+	priv, pub, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv, pub
+}
+
+func TestEncrypt_Decrypt(t *testing.T) {
+	alice, alicePub := generateKey(t)
+	bob, bobPub := generateKey(t)
+	eve, _ := generateKey(t)
+
+	for _, size := range []int{0, 1, chunkSize, chunkSize + 1, 3*chunkSize - 7} {
+		content := make([]byte, size)
+		rand.New(rand.NewSource(int64(size))).Read(content)
+
+		var sealed bytes.Buffer
+		if err := Encrypt(&sealed, bytes.NewReader(content), []crypto.PubKey{alicePub, bobPub}); err != nil {
+			t.Fatalf("Encrypt() error = %v", err)
+		}
+		if size >= 16 && bytes.Contains(sealed.Bytes(), content) {
+			t.Errorf("sealed file of %d bytes contains the plaintext", size)
+		}
+		for name, priv := range map[string]crypto.PrivKey{"alice": alice, "bob": bob} {
+			var opened bytes.Buffer
+			if err := Decrypt(&opened, bytes.NewReader(sealed.Bytes()), priv); err != nil {
+				t.Fatalf("Decrypt() by %s of %d bytes error = %v", name, size, err)
+			}
+			if !bytes.Equal(opened.Bytes(), content) {
+				t.Errorf("Decrypt() by %s returned %d bytes, want the %d byte content", name, opened.Len(), size)
+			}
+		}
+		if err := Decrypt(&bytes.Buffer{}, bytes.NewReader(sealed.Bytes()), eve); !errors.Is(err, ErrNotRecipient) {
+			t.Errorf("Decrypt() by a non-recipient error = %v, want %v", err, ErrNotRecipient)
+		}
+	}
+}
+
+func TestDecrypt_Tampered(t *testing.T) {
+	priv, pub := generateKey(t)
+	content := bytes.Repeat([]byte("secret "), chunkSize/3)
+	var sealed bytes.Buffer
+	if err := Encrypt(&sealed, bytes.NewReader(content), []crypto.PubKey{pub}); err != nil {
+		t.Fatalf("Encrypt() error = %v", err)
+	}
+	headerEnd := bytes.Index(sealed.Bytes(), []byte("\n---")) + 1
+
+	tests := []struct {
+		name   string
+		modify func([]byte) []byte
+	}{
+		{name: "flipped content bit", modify: func(b []byte) []byte { b[len(b)-20] ^= 1; return b }},
+		{name: "truncated after a chunk", modify: func(b []byte) []byte { return b[:len(b)-(len(content)-chunkSize)-16] }},
+		{name: "dropped last bytes", modify: func(b []byte) []byte { return b[:len(b)-1] }},
+		{name: "modified header", modify: func(b []byte) []byte {
+			return append(b[:headerEnd:headerEnd], append([]byte("-> X25519 AAAA AAAA\n"), b[headerEnd:]...)...)
+		}},
+		{name: "unknown format", modify: func(b []byte) []byte { b[0] = 'x'; return b }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := tt.modify(append([]byte(nil), sealed.Bytes()...))
+			if err := Decrypt(&bytes.Buffer{}, bytes.NewReader(data), priv); !errors.Is(err, ErrInvalidFile) {
+				t.Errorf("Decrypt() error = %v, want %v", err, ErrInvalidFile)
+			}
+		})
+	}
+}
+
+func TestX25519Keys(t *testing.T) {
+	priv, pub := generateKey(t)
+	scalar, err := x25519Private(priv)
+	if err != nil {
+		t.Fatalf("x25519Private() error = %v", err)
+	}
+	want, err := curve25519.X25519(scalar, curve25519.Basepoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := x25519Public(pub)
+	if err != nil {
+		t.Fatalf("x25519Public() error = %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("x25519Public() = %x, want %x", got, want)
+	}
+
+	_, secpPub, err := crypto.GenerateSecp256k1Key(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Encrypt(&bytes.Buffer{}, bytes.NewReader(nil), []crypto.PubKey{secpPub}); !errors.Is(err, ErrUnsupportedKey) {
+		t.Errorf("Encrypt() error = %v, want %v", err, ErrUnsupportedKey)
+	}
+}
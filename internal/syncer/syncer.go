@@ -0,0 +1,537 @@
+package syncer
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	corenet "github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/file"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/index"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/logging"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/network"
+)
+
+// SyncProtocolID is used to ask a peer to sync its shared folder with ours in return.
+const SyncProtocolID = "/p2p-file-sharing/sync/1.0.0"
+
+// stateFile is the name of the file in the data directory holding the sync state.
+const stateFile = "sync.json"
+
+// Mode selects how a subscription treats local changes.
+type Mode string
+
+const (
+	// Mirror replicates a peer's shared folder into ours; remote changes always win.
+	Mirror Mode = "mirror"
+	// TwoWay replicates changes in both directions and detects conflicting edits.
+	TwoWay Mode = "two-way"
+)
+
+// ParseMode parses a sync mode name.
+func ParseMode(s string) (Mode, error) {
+	switch Mode(s) {
+	case Mirror, TwoWay:
+		return Mode(s), nil
+	default:
+		return "", fmt.Errorf("unknown sync mode '%s', expected '%s' or '%s'", s, Mirror, TwoWay)
+	}
+}
+
+// Result summarizes one synchronization round with a peer.
+type Result struct {
+	Downloaded int
+	Conflicts  int
+	Deleted    int
+}
+
+// state is the part of the syncer persisted across restarts.
+type state struct {
+	Subscriptions map[peer.ID]Mode `json:"subscriptions"`
+	// Synced holds, per peer, the content hash of every path as of the last sync.
+	// It is the common ancestor used to tell which side changed a file.
+	Synced map[peer.ID]map[string]string `json:"synced"`
+}
+
+// Syncer keeps the shared directory in sync with the shared folders of subscribed peers.
+type Syncer struct {
+	ctx       context.Context
+	host      *network.Node
+	index     *index.Index
+	policy    file.Policy
+	dir       string
+	statePath string
+	interval  time.Duration
+	logger    *slog.Logger
+
+	mu      sync.Mutex
+	state   state
+	cancels map[peer.ID]context.CancelFunc
+
+	// roundMu serializes sync rounds, which all write to the shared directory.
+	roundMu sync.Mutex
+}
+
+// NewSyncer loads the sync state from dataDir and registers the sync protocol handler.
+// The index of sharedDir provides the local side of each comparison, and policy
+// selects the attributes restored on synced files. Modification times are always
+// restored since conflict resolution relies on them. Sync rounds log to logger.
+func NewSyncer(ctx context.Context, h *network.Node, idx *index.Index, policy file.Policy, sharedDir, dataDir string, interval time.Duration, logger *slog.Logger) (*Syncer, error) {
+	policy.ModTime = true
+	s := &Syncer{
+		ctx:       ctx,
+		host:      h,
+		index:     idx,
+		policy:    policy,
+		dir:       sharedDir,
+		statePath: filepath.Join(dataDir, stateFile),
+		interval:  interval,
+		logger:    logger,
+		state: state{
+			Subscriptions: make(map[peer.ID]Mode),
+			Synced:        make(map[peer.ID]map[string]string),
+		},
+		cancels: make(map[peer.ID]context.CancelFunc),
+	}
+
+	data, err := os.ReadFile(s.statePath)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &s.state); err != nil {
+			return nil, fmt.Errorf("error parsing sync state '%s': %w", s.statePath, err)
+		}
+	case !errors.Is(err, fs.ErrNotExist):
+		return nil, fmt.Errorf("error reading sync state '%s': %w", s.statePath, err)
+	}
+
+	h.SetStreamHandler(SyncProtocolID, h.WithTimeouts(s.handleSyncRequest))
+	return s, nil
+}
+
+// Start resumes the subscriptions saved by a previous run.
+func (s *Syncer) Start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for p, mode := range s.state.Subscriptions {
+		s.startLocked(p, mode)
+	}
+}
+
+// Subscribe starts replicating a peer's shared folder. In two-way mode the peer is
+// asked to subscribe to our folder in return, which it only accepts from peers in
+// its address book.
+func (s *Syncer) Subscribe(p peer.ID, mode Mode) error {
+	if mode == TwoWay {
+		if err := s.requestTwoWay(p); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.state.Subscriptions[p] = mode
+	s.startLocked(p, mode)
+	return s.saveLocked()
+}
+
+// Unsubscribe stops replicating a peer's shared folder.
+func (s *Syncer) Unsubscribe(p peer.ID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.state.Subscriptions[p]; !ok {
+		return fmt.Errorf("not subscribed to peer %s", p)
+	}
+	if cancel, ok := s.cancels[p]; ok {
+		cancel()
+		delete(s.cancels, p)
+	}
+	delete(s.state.Subscriptions, p)
+	delete(s.state.Synced, p)
+	return s.saveLocked()
+}
+
+// Subscriptions returns the subscribed peers and their modes.
+func (s *Syncer) Subscriptions() map[peer.ID]Mode {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	subs := make(map[peer.ID]Mode, len(s.state.Subscriptions))
+	for p, mode := range s.state.Subscriptions {
+		subs[p] = mode
+	}
+	return subs
+}
+
+// startLocked starts the polling loop for a subscription, replacing any running one.
+func (s *Syncer) startLocked(p peer.ID, mode Mode) {
+	if cancel, ok := s.cancels[p]; ok {
+		cancel()
+	}
+	ctx, cancel := context.WithCancel(s.ctx)
+	s.cancels[p] = cancel
+	go s.run(ctx, p, mode)
+}
+
+// run syncs with a peer until ctx is done. Besides polling every interval, it syncs
+// as soon as the peer reports a change to its shared folder.
+func (s *Syncer) run(ctx context.Context, p peer.ID, mode Mode) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	var changes <-chan index.Event
+	for {
+		if changes == nil {
+			// Peers without the watch protocol are only polled.
+			changes, _ = s.host.WatchRemoteFiles(ctx, p)
+		}
+
+		res, err := s.SyncOnce(ctx, p, mode)
+		if err != nil {
+			s.logger.Warn("Error syncing with peer", logging.Peer(p), "mode", mode, "error", err)
+		} else if res.Downloaded > 0 || res.Conflicts > 0 || res.Deleted > 0 {
+			s.logger.Info("Synced with peer", logging.Peer(p), "mode", mode, "updated", res.Downloaded, "conflicts", res.Conflicts, "deleted", res.Deleted)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case _, ok := <-changes:
+			if !ok {
+				// The watch ended, usually because the peer went away; wait
+				// for the next poll rather than reconnecting at once.
+				changes = nil
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+				continue
+			}
+			if !drain(changes) {
+				changes = nil
+			}
+		}
+	}
+}
+
+// drain discards the events already queued, which the next sync round covers.
+// It reports whether the channel is still open.
+func drain(changes <-chan index.Event) bool {
+	for {
+		select {
+		case _, ok := <-changes:
+			if !ok {
+				return false
+			}
+		default:
+			return true
+		}
+	}
+}
+
+// SyncOnce pulls the new and changed files of a peer's shared folder and removes
+// the files the peer deleted since the last sync.
+func (s *Syncer) SyncOnce(ctx context.Context, p peer.ID, mode Mode) (Result, error) {
+	s.roundMu.Lock()
+	defer s.roundMu.Unlock()
+
+	remote, err := s.host.ListRemoteFiles(ctx, p)
+	if err != nil {
+		return Result{}, fmt.Errorf("error listing files of peer %s: %w", p, err)
+	}
+	// Catch up with changes the watcher has not applied yet; unchanged files are not reread.
+	if err := s.index.Refresh("."); err != nil {
+		return Result{}, err
+	}
+	local := make(map[string]file.Entry)
+	for _, e := range s.index.Entries() {
+		local[e.Path] = e
+	}
+
+	s.mu.Lock()
+	synced := make(map[string]string, len(s.state.Synced[p]))
+	for path, hash := range s.state.Synced[p] {
+		synced[path] = hash
+	}
+	s.mu.Unlock()
+
+	var res Result
+	listed := make(map[string]bool, len(remote))
+	for _, r := range remote {
+		listed[r.Path] = true
+		var l *file.Entry
+		if e, ok := local[r.Path]; ok {
+			l = &e
+		}
+
+		act := decide(mode, l, &r, synced[r.Path])
+		var err error
+		switch act {
+		case actionNone:
+		case actionDownload:
+			err = s.download(ctx, p, r, r.Path)
+			res.Downloaded++
+		case actionConflictKeepLocal:
+			err = s.download(ctx, p, r, conflictPath(r.Path, p, r.ModTime))
+			res.Conflicts++
+		case actionConflictTakeRemote:
+			err = s.keepConflictCopy(*l)
+			if err == nil {
+				err = s.download(ctx, p, r, r.Path)
+			}
+			res.Conflicts++
+		}
+		if err != nil {
+			return res, err
+		}
+
+		// After any action the path holds either the remote content or the
+		// winning local content; both sides converge on the winner.
+		if act == actionConflictKeepLocal {
+			synced[r.Path] = l.Hash
+		} else {
+			synced[r.Path] = r.Hash
+		}
+	}
+
+	// Paths synced before but no longer listed were deleted by the peer.
+	for rel, hash := range synced {
+		if listed[rel] {
+			continue
+		}
+		var l *file.Entry
+		if e, ok := local[rel]; ok {
+			l = &e
+		}
+		if decide(mode, l, nil, hash) == actionDelete {
+			if err := s.remove(rel); err != nil {
+				return res, err
+			}
+			res.Deleted++
+		}
+		// A local edit made after the deletion is kept, and the peer pulls it
+		// back as a new file.
+		delete(synced, rel)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.state.Subscriptions[p]; ok {
+		s.state.Synced[p] = synced
+	}
+	return res, s.saveLocked()
+}
+
+// download writes a remote file to the relative path target. Content that is already
+// in the shared directory under another path is copied instead of fetched.
+func (s *Syncer) download(ctx context.Context, p peer.ID, r file.Entry, target string) error {
+	dest, err := file.LocalPath(s.dir, target)
+	if err != nil {
+		return err
+	}
+	if data, ok := s.localCopy(r.Hash); ok {
+		return file.WriteFileAtomic(dest, data, r.ModTime)
+	}
+	// A changed file is rebuilt from the copy being replaced, fetching only the
+	// blocks that differ.
+	if _, err := s.host.FetchFileDelta(ctx, p, r.Path, dest, s.policy); err != nil {
+		return fmt.Errorf("error fetching '%s': %w", r.Path, err)
+	}
+	return nil
+}
+
+// remove deletes a local file the peer deleted.
+func (s *Syncer) remove(rel string) error {
+	path, err := file.LocalPath(s.dir, rel)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("error deleting '%s': %w", rel, err)
+	}
+	return nil
+}
+
+// localCopy reads an indexed file with the given hash, checking that it still has
+// that content.
+func (s *Syncer) localCopy(hash string) ([]byte, bool) {
+	e, ok := s.index.Lookup(hash)
+	if !ok {
+		return nil, false
+	}
+	path, err := file.LocalPath(s.dir, e.Path)
+	if err != nil {
+		return nil, false
+	}
+	data, err := file.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	sum := sha256.Sum256(data)
+	return data, hex.EncodeToString(sum[:]) == hash
+}
+
+// keepConflictCopy moves a local file that lost a conflict out of the way.
+func (s *Syncer) keepConflictCopy(l file.Entry) error {
+	src, err := file.LocalPath(s.dir, l.Path)
+	if err != nil {
+		return err
+	}
+	dest, err := file.LocalPath(s.dir, conflictPath(l.Path, s.host.ID(), l.ModTime))
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(src, dest); err != nil {
+		return fmt.Errorf("error keeping conflict copy of '%s': %w", l.Path, err)
+	}
+	return nil
+}
+
+// requestTwoWay asks a peer to subscribe to our shared folder.
+func (s *Syncer) requestTwoWay(p peer.ID) error {
+	stream, err := s.host.NewStream(s.ctx, p, SyncProtocolID)
+	if err != nil {
+		return fmt.Errorf("error creating new stream: %w", err)
+	}
+	defer stream.Close()
+
+	if _, err := stream.Write([]byte(string(TwoWay) + "\n")); err != nil {
+		return fmt.Errorf("error sending sync request: %w", err)
+	}
+	reply, err := bufio.NewReader(stream).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("error reading sync reply: %w", err)
+	}
+	if reply = strings.TrimSuffix(reply, "\n"); reply != "ok" {
+		return fmt.Errorf("peer %s refused two-way sync: %s", p, reply)
+	}
+	return nil
+}
+
+// handleSyncRequest accepts two-way sync requests from address-book peers.
+func (s *Syncer) handleSyncRequest(stream corenet.Stream) {
+	defer stream.Close()
+	remote := stream.Conn().RemotePeer()
+
+	request, err := bufio.NewReader(stream).ReadString('\n')
+	if err != nil {
+		s.logger.Warn("Error reading sync request", logging.Peer(remote), "error", err)
+		_ = stream.Reset()
+		return
+	}
+
+	reply := "ok"
+	switch {
+	case Mode(strings.TrimSuffix(request, "\n")) != TwoWay:
+		reply = "unsupported request"
+	case !network.InAddressBook(s.host, remote):
+		reply = "peer is not in the address book"
+	default:
+		s.mu.Lock()
+		s.state.Subscriptions[remote] = TwoWay
+		s.startLocked(remote, TwoWay)
+		err = s.saveLocked()
+		s.mu.Unlock()
+		if err != nil {
+			s.logger.Error("Error saving sync state", "error", err)
+		}
+		s.logger.Info("Started two-way sync requested by peer", logging.Peer(remote))
+	}
+
+	if _, err := stream.Write([]byte(reply + "\n")); err != nil {
+		s.logger.Warn("Error replying to sync request", logging.Peer(remote), "error", err)
+	}
+}
+
+// saveLocked persists the sync state.
+func (s *Syncer) saveLocked() error {
+	data, err := json.MarshalIndent(s.state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding sync state: %w", err)
+	}
+	return file.WriteFileAtomic(s.statePath, data, time.Time{})
+}
+
+// action is what a sync round does with one remote file.
+type action int
+
+const (
+	actionNone action = iota
+	// actionDownload replaces the local file with the remote one.
+	actionDownload
+	// actionConflictKeepLocal keeps the local file and saves the remote one as a conflict copy.
+	actionConflictKeepLocal
+	// actionConflictTakeRemote saves the local file as a conflict copy and takes the remote one.
+	actionConflictTakeRemote
+	// actionDelete removes the local file the peer deleted.
+	actionDelete
+)
+
+// decide compares a remote file with the local copy and the hash both sides had at
+// the last sync. A nil remote is a file the peer no longer lists. Conflicts are
+// resolved the same way on both peers: the newer file wins, ties going to the
+// greater hash.
+func decide(mode Mode, local *file.Entry, remote *file.Entry, synced string) action {
+	switch {
+	case remote == nil:
+		if local == nil || synced == "" {
+			// Already gone, or a local file the peer never had.
+			return actionNone
+		}
+		if mode == Mirror || local.Hash == synced {
+			return actionDelete
+		}
+		// Changed locally after the peer deleted it; the edit wins.
+		return actionNone
+	case local != nil && local.Hash == remote.Hash:
+		return actionNone
+	case mode == Mirror:
+		return actionDownload
+	case local == nil:
+		if remote.Hash == synced {
+			// Deleted locally since the last sync.
+			return actionNone
+		}
+		return actionDownload
+	case remote.Hash == synced:
+		// Only changed locally; the peer pulls our version.
+		return actionNone
+	case local.Hash == synced:
+		return actionDownload
+	}
+
+	if remote.ModTime.After(local.ModTime) ||
+		(remote.ModTime.Equal(local.ModTime) && remote.Hash > local.Hash) {
+		return actionConflictTakeRemote
+	}
+	return actionConflictKeepLocal
+}
+
+// conflictPath names the copy of a losing file after its owner and modification time,
+// so both peers produce the same name.
+func conflictPath(rel string, owner peer.ID, modTime time.Time) string {
+	id := owner.String()
+	if len(id) > 6 {
+		id = id[len(id)-6:]
+	}
+	ext := path.Ext(rel)
+	return fmt.Sprintf("%s.sync-conflict-%s-%s%s",
+		strings.TrimSuffix(rel, ext), modTime.UTC().Format("20060102-150405"), id, ext)
+}
@@ -0,0 +1,256 @@
+package syncer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/saurabhSPatel/p2p-file-sharing/config"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/file"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/index"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/logging"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/network"
+)
+
+func TestDecide(t *testing.T) {
+	older := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	newer := older.Add(time.Hour)
+	entry := func(hash string, modTime time.Time) *file.Entry {
+		return &file.Entry{Path: "a.txt", Hash: hash, ModTime: modTime}
+	}
+
+	tests := []struct {
+		name   string
+		mode   Mode
+		local  *file.Entry
+		remote *file.Entry
+		synced string
+		want   action
+	}{
+		{name: "unchanged", mode: TwoWay, local: entry("a", older), remote: entry("a", older), synced: "a", want: actionNone},
+		{name: "mirror overwrites local changes", mode: Mirror, local: entry("b", newer), remote: entry("a", older), synced: "a", want: actionDownload},
+		{name: "new remote file", mode: TwoWay, remote: entry("a", older), want: actionDownload},
+		{name: "deleted locally", mode: TwoWay, remote: entry("a", older), synced: "a", want: actionNone},
+		{name: "changed locally", mode: TwoWay, local: entry("b", older), remote: entry("a", older), synced: "a", want: actionNone},
+		{name: "changed remotely", mode: TwoWay, local: entry("a", older), remote: entry("b", older), synced: "a", want: actionDownload},
+		{name: "conflict remote newer", mode: TwoWay, local: entry("b", older), remote: entry("c", newer), synced: "a", want: actionConflictTakeRemote},
+		{name: "conflict local newer", mode: TwoWay, local: entry("b", newer), remote: entry("c", older), synced: "a", want: actionConflictKeepLocal},
+		{name: "conflict tie greater remote hash", mode: TwoWay, local: entry("b", older), remote: entry("c", older), want: actionConflictTakeRemote},
+		{name: "conflict tie greater local hash", mode: TwoWay, local: entry("c", older), remote: entry("b", older), want: actionConflictKeepLocal},
+		{name: "deleted remotely", mode: TwoWay, local: entry("a", older), synced: "a", want: actionDelete},
+		{name: "mirror deletes local changes", mode: Mirror, local: entry("b", newer), synced: "a", want: actionDelete},
+		{name: "deleted remotely changed locally", mode: TwoWay, local: entry("b", newer), synced: "a", want: actionNone},
+		{name: "local file never synced", mode: Mirror, local: entry("a", older), want: actionNone},
+		{name: "deleted on both sides", mode: TwoWay, synced: "a", want: actionNone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := decide(tt.mode, tt.local, tt.remote, tt.synced); got != tt.want {
+				t.Errorf("decide() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConflictPath(t *testing.T) {
+	owner, err := peer.Decode("12D3KooWGzh2kzHuT3ntVYoTXbNrMB4HexGVwqyaMwJZhTZSr8tT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2024, 3, 4, 5, 6, 7, 0, time.UTC)
+
+	tests := []struct {
+		rel  string
+		want string
+	}{
+		{rel: "a.txt", want: "a.sync-conflict-20240304-050607-ZSr8tT.txt"},
+		{rel: "dir/notes", want: "dir/notes.sync-conflict-20240304-050607-ZSr8tT"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rel, func(t *testing.T) {
+			if got := conflictPath(tt.rel, owner, modTime); got != tt.want {
+				t.Errorf("conflictPath() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// newTestNode creates a host sharing and indexing its own temporary directory, and a
+// syncer for it.
+func newTestNode(t *testing.T, ctx context.Context) (host.Host, *Syncer, string) {
+	t.Helper()
+	cfg := config.Default()
+	cfg.SharedDir = t.TempDir()
+	h, err := network.SetupHost(ctx, cfg, logging.Discard())
+	if err != nil {
+		t.Fatalf("Failed to setup host: %v", err)
+	}
+	t.Cleanup(func() { h.Close() })
+
+	dataDir := t.TempDir()
+	idx, err := index.NewIndex(cfg.SharedDir, dataDir, 50*time.Millisecond, logging.Discard())
+	if err != nil {
+		t.Fatalf("Failed to load index: %v", err)
+	}
+	if err := idx.Start(ctx); err != nil {
+		t.Fatalf("Failed to start index: %v", err)
+	}
+	h.ServeIndex(idx)
+	t.Cleanup(func() { idx.Close() })
+
+	s, err := NewSyncer(ctx, h, idx, file.Policy(cfg.Receive), cfg.SharedDir, dataDir, time.Hour, logging.Discard())
+	if err != nil {
+		t.Fatalf("Failed to setup syncer: %v", err)
+	}
+	return h, s, cfg.SharedDir
+}
+
+func TestSyncer_SyncOnce(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	h1, s1, dir1 := newTestNode(t, ctx)
+	h2, s2, dir2 := newTestNode(t, ctx)
+	if err := h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}); err != nil {
+		t.Fatalf("Failed to connect hosts: %v", err)
+	}
+
+	// Listings are served from the index, which picks up changes after the debounce.
+	settle := func() { time.Sleep(300 * time.Millisecond) }
+	write := func(dir, rel, content string, modTime time.Time) {
+		t.Helper()
+		if err := file.WriteFileAtomic(filepath.Join(dir, rel), []byte(content), modTime); err != nil {
+			t.Fatal(err)
+		}
+		settle()
+	}
+	read := func(dir, rel string) string {
+		t.Helper()
+		data, err := os.ReadFile(filepath.Join(dir, rel))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	write(dir2, "sub/a.txt", "v1", base)
+
+	// The initial round copies the peer's files, including subdirectories.
+	res, err := s1.SyncOnce(ctx, h2.ID(), TwoWay)
+	if err != nil {
+		t.Fatalf("SyncOnce() error = %v", err)
+	}
+	if res.Downloaded != 1 || read(dir1, "sub/a.txt") != "v1" {
+		t.Fatalf("SyncOnce() = %+v, want sub/a.txt downloaded", res)
+	}
+	settle()
+	if _, err := s2.SyncOnce(ctx, h1.ID(), TwoWay); err != nil {
+		t.Fatalf("SyncOnce() error = %v", err)
+	}
+
+	// Both peers edit the file; the newer edit wins on both sides.
+	write(dir1, "sub/a.txt", "local", base.Add(time.Minute))
+	write(dir2, "sub/a.txt", "remote", base.Add(time.Hour))
+	res, err = s1.SyncOnce(ctx, h2.ID(), TwoWay)
+	if err != nil {
+		t.Fatalf("SyncOnce() error = %v", err)
+	}
+	if res.Conflicts != 1 || read(dir1, "sub/a.txt") != "remote" {
+		t.Fatalf("SyncOnce() = %+v, want conflict resolved to the newer remote file", res)
+	}
+	copyPath := conflictPath("sub/a.txt", h1.ID(), base.Add(time.Minute))
+	if got := read(dir1, copyPath); got != "local" {
+		t.Errorf("conflict copy = %q, want %q", got, "local")
+	}
+
+	// The peer then pulls our conflict copy and keeps its own winning version.
+	settle()
+	if _, err := s2.SyncOnce(ctx, h1.ID(), TwoWay); err != nil {
+		t.Fatalf("SyncOnce() error = %v", err)
+	}
+	if read(dir2, "sub/a.txt") != "remote" || read(dir2, copyPath) != "local" {
+		t.Errorf("peer did not converge on the conflict resolution")
+	}
+
+	// Once both sides have synced a file, a deletion by the peer is applied locally.
+	// The sync state is only kept for subscribed peers.
+	s1.mu.Lock()
+	s1.state.Subscriptions[h2.ID()] = TwoWay
+	s1.mu.Unlock()
+	settle()
+	if _, err := s1.SyncOnce(ctx, h2.ID(), TwoWay); err != nil {
+		t.Fatalf("SyncOnce() error = %v", err)
+	}
+	if err := os.Remove(filepath.Join(dir2, copyPath)); err != nil {
+		t.Fatal(err)
+	}
+	settle()
+	res, err = s1.SyncOnce(ctx, h2.ID(), TwoWay)
+	if err != nil {
+		t.Fatalf("SyncOnce() error = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir1, copyPath)); res.Deleted != 1 || !os.IsNotExist(err) {
+		t.Errorf("SyncOnce() = %+v, want the conflict copy deleted", res)
+	}
+}
+
+func TestSyncer_TwoWayRequiresAddressBook(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	h1, s1, _ := newTestNode(t, ctx)
+	h2, s2, _ := newTestNode(t, ctx)
+	if err := h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}); err != nil {
+		t.Fatalf("Failed to connect hosts: %v", err)
+	}
+
+	if err := s1.Subscribe(h2.ID(), TwoWay); err == nil {
+		t.Errorf("Subscribe() succeeded for a peer outside the address book")
+	}
+	if len(s2.Subscriptions()) != 0 {
+		t.Errorf("Subscriptions() = %v, want none", s2.Subscriptions())
+	}
+	if err := s1.Subscribe(h2.ID(), Mirror); err != nil {
+		t.Errorf("Subscribe() error = %v", err)
+	}
+	if got := s1.Subscriptions()[h2.ID()]; got != Mirror {
+		t.Errorf("Subscriptions() mode = %v, want %v", got, Mirror)
+	}
+}
+
+func TestSyncer_SyncsOnRemoteChange(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	h1, s1, dir1 := newTestNode(t, ctx)
+	h2, _, dir2 := newTestNode(t, ctx)
+	if err := h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}); err != nil {
+		t.Fatalf("Failed to connect hosts: %v", err)
+	}
+
+	// The polling interval is an hour, so only the change feed can trigger the sync.
+	if err := s1.Subscribe(h2.ID(), Mirror); err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if err := os.WriteFile(filepath.Join(dir2, "new.txt"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		data, err := os.ReadFile(filepath.Join(dir1, "new.txt"))
+		if err == nil && string(data) == "new" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("new.txt was not synced after the remote change")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,120 @@
+// Package tracing exports OpenTelemetry traces of discovery and file transfers to
+// an OTLP collector, and carries trace context between peers so that a transfer
+// is a single trace across both of them.
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/saurabhSPatel/p2p-file-sharing/config"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentation names the tracer of the node's spans.
+const instrumentation = "github.com/saurabhSPatel/p2p-file-sharing"
+
+// Keys of the span attributes shared across packages.
+const (
+	PeerKey     = attribute.Key("p2pfs.peer")
+	TransferKey = attribute.Key("p2pfs.transfer")
+	FileKey     = attribute.Key("p2pfs.file")
+	SizeKey     = attribute.Key("p2pfs.size")
+	ProtocolKey = attribute.Key("p2pfs.protocol")
+)
+
+// propagator encodes trace context as W3C traceparent and tracestate fields.
+var propagator = propagation.TraceContext{}
+
+// Setup exports the spans to the configured collector, identifying the node by its
+// peer ID. The returned function flushes the pending spans and stops the export.
+// Without an endpoint, spans are not recorded and the function does nothing.
+func Setup(ctx context.Context, cfg config.TracingConfig, id peer.ID) (func(context.Context) error, error) {
+	if cfg.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(cfg.Endpoint))
+	if err != nil {
+		return nil, fmt.Errorf("error creating trace exporter: %w", err)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName("p2pfs"),
+		semconv.ServiceInstanceID(id.String()),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("error describing trace resource: %w", err)
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagator)
+	return tp.Shutdown, nil
+}
+
+// Start starts a span with the node's tracer.
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentation).Start(ctx, name, opts...)
+}
+
+// End records err, if any, as the outcome of the span and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Inject returns the trace context of ctx to send to a peer, or nil if ctx is not
+// part of a trace.
+func Inject(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return carrier
+}
+
+// Extract returns ctx continuing the trace context received from a peer.
+func Extract(ctx context.Context, carrier map[string]string) context.Context {
+	return propagator.Extract(ctx, propagation.MapCarrier(carrier))
+}
+
+// Peer returns the attribute identifying a remote peer.
+func Peer(p peer.ID) attribute.KeyValue {
+	return PeerKey.String(p.String())
+}
+
+// Transfer returns the attribute identifying a transfer.
+func Transfer(id string) attribute.KeyValue {
+	return TransferKey.String(id)
+}
+
+// File returns the attribute naming a transferred file or directory.
+func File(name string) attribute.KeyValue {
+	return FileKey.String(name)
+}
+
+// Size returns the attribute holding the size of a transfer in bytes.
+func Size(n int64) attribute.KeyValue {
+	return SizeKey.Int64(n)
+}
+
+// Protocol returns the attribute naming the protocol of a stream.
+func Protocol(id protocol.ID) attribute.KeyValue {
+	return ProtocolKey.String(string(id))
+}
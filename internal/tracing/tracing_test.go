@@ -0,0 +1,48 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/saurabhSPatel/p2p-file-sharing/config"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestInjectExtract(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")
+
+	if got := Inject(context.Background()); got != nil {
+		t.Errorf("Inject() without a span = %v, want nil", got)
+	}
+
+	ctx, span := tracer.Start(context.Background(), "send")
+	carrier := Inject(ctx)
+	if carrier["traceparent"] == "" {
+		t.Fatalf("Inject() = %v, want a traceparent", carrier)
+	}
+	remote := trace.SpanContextFromContext(Extract(context.Background(), carrier))
+	if !remote.IsRemote() || remote.TraceID() != span.SpanContext().TraceID() || remote.SpanID() != span.SpanContext().SpanID() {
+		t.Errorf("Extract() = %v, want the context of %v", remote, span.SpanContext())
+	}
+
+	End(span, errors.New("reset"))
+	ended := recorder.Ended()
+	if len(ended) != 1 || ended[0].Status().Code != codes.Error || len(ended[0].Events()) != 1 {
+		t.Errorf("End() recorded %+v, want an error status and event", ended)
+	}
+}
+
+func TestSetup_Disabled(t *testing.T) {
+	shutdown, err := Setup(context.Background(), config.TracingConfig{}, "")
+	if err != nil {
+		t.Fatalf("Setup() error = %v", err)
+	}
+	if err := shutdown(context.Background()); err != nil {
+		t.Errorf("shutdown() error = %v", err)
+	}
+}
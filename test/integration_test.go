@@ -2,8 +2,9 @@ package test_test
 
 import (
 	"context"
-	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/saurabhSPatel/p2p-file-sharing/config"
 	"github.com/saurabhSPatel/p2p-file-sharing/internal/discovery"
+	"github.com/saurabhSPatel/p2p-file-sharing/internal/logging"
 	"github.com/saurabhSPatel/p2p-file-sharing/internal/network"
 	"os"
 	"path/filepath"
@@ -22,7 +23,7 @@ func TestPeerToPeerFileSharing(t *testing.T) {
 	sharedDir := os.TempDir()
 
 	// Setup hosts and discovery
-	hosts := setupHosts(t, ctx, 3)
+	hosts, downloadDirs := setupHosts(t, ctx, 3)
 	defer func() {
 		for _, p2pHost := range hosts {
 			err := p2pHost.Close()
@@ -43,36 +44,40 @@ func TestPeerToPeerFileSharing(t *testing.T) {
 
 	// Run test scenarios
 	t.Run("Basic File Transfer", func(t *testing.T) {
-		testFileTransfer(t, ctx, hosts[0], hosts[1], testFiles["basic"], sharedDir)
+		testFileTransfer(t, ctx, hosts[0], hosts[1], testFiles["basic"], downloadDirs[1])
 	})
 
 	t.Run("Large File Transfer", func(t *testing.T) {
-		testFileTransfer(t, ctx, hosts[1], hosts[2], testFiles["large"], sharedDir)
+		testFileTransfer(t, ctx, hosts[1], hosts[2], testFiles["large"], downloadDirs[2])
 	})
 
 	t.Run("Multiple File Transfers", func(t *testing.T) {
-		testMultipleFileTransfers(t, ctx, hosts, sharedDir)
+		testMultipleFileTransfers(t, ctx, hosts, sharedDir, downloadDirs[1])
 	})
 
 	t.Run("Concurrent Transfers", func(t *testing.T) {
-		testConcurrentTransfers(t, ctx, hosts, sharedDir)
+		testConcurrentTransfers(t, ctx, hosts, sharedDir, downloadDirs[1])
 	})
 }
 
-func setupHosts(t *testing.T, ctx context.Context, count int) []host.Host {
-	hosts := make([]host.Host, count)
+func setupHosts(t *testing.T, ctx context.Context, count int) ([]*network.Node, []string) {
+	hosts := make([]*network.Node, count)
+	downloadDirs := make([]string, count)
 	for i := 0; i < count; i++ {
-		p2pHost, err := network.SetupHost(ctx)
+		cfg := config.Default()
+		cfg.DownloadDir = t.TempDir()
+		p2pHost, err := network.SetupHost(ctx, cfg, logging.Discard())
 		require.NoError(t, err, "Failed to setup p2pHost%d", i+1)
 		hosts[i] = p2pHost
+		downloadDirs[i] = cfg.DownloadDir
 		t.Logf("Host%d ID: %s", i+1, p2pHost.ID().String())
 	}
-	return hosts
+	return hosts, downloadDirs
 }
 
-func setupDiscoveries(t *testing.T, hosts []host.Host) {
+func setupDiscoveries(t *testing.T, hosts []*network.Node) {
 	for i, p2pHost := range hosts {
-		disc := discovery.NewDiscovery(p2pHost)
+		disc := discovery.NewDiscovery(p2pHost, logging.Discard())
 		err := disc.SetupDiscovery()
 		require.NoError(t, err, "Failed to setup discovery for p2pHost%d", i+1)
 	}
@@ -100,16 +105,13 @@ func prepareTestFiles(t *testing.T, sharedDir string) map[string]testFile {
 	return files
 }
 
-func testFileTransfer(t *testing.T, ctx context.Context, sender, receiver host.Host, file testFile, sharedDir string) {
-	// Sender sends the file
-	err := network.SendFile(ctx, sender, receiver.ID(), filepath.Join(sharedDir, file.name), file.content)
+func testFileTransfer(t *testing.T, ctx context.Context, sender, receiver *network.Node, file testFile, downloadDir string) {
+	// Sender sends the file; SendFile returns once the receiver stored it
+	err := sender.SendFile(ctx, receiver.ID(), file.name, file.content)
 	require.NoError(t, err, "Failed to send file")
 
-	// Wait for the file to be processed
-	time.Sleep(1 * time.Second)
-
 	// Verify the received file
-	receivedPath := filepath.Join(sharedDir, file.name)
+	receivedPath := filepath.Join(downloadDir, file.name)
 	receivedContent, err := os.ReadFile(receivedPath)
 	require.NoError(t, err, "Failed to read received file")
 	assert.Equal(t, file.content, receivedContent, "File content mismatch")
@@ -117,7 +119,7 @@ func testFileTransfer(t *testing.T, ctx context.Context, sender, receiver host.H
 	t.Logf("File '%s' transferred successfully", file.name)
 }
 
-func testMultipleFileTransfers(t *testing.T, ctx context.Context, hosts []host.Host, sharedDir string) {
+func testMultipleFileTransfers(t *testing.T, ctx context.Context, hosts []*network.Node, sharedDir string, downloadDir string) {
 	files := []testFile{
 		{name: "file1.txt", content: []byte("Content of file1")},
 		{name: "file2.txt", content: []byte("Content of file2")},
@@ -130,11 +132,11 @@ func testMultipleFileTransfers(t *testing.T, ctx context.Context, hosts []host.H
 		require.NoError(t, err, "Failed to write test file: %s", file.name)
 
 		// Test file transfer between hosts
-		testFileTransfer(t, ctx, hosts[0], hosts[1], file, sharedDir)
+		testFileTransfer(t, ctx, hosts[0], hosts[1], file, downloadDir)
 	}
 }
 
-func testConcurrentTransfers(t *testing.T, ctx context.Context, hosts []host.Host, sharedDir string) {
+func testConcurrentTransfers(t *testing.T, ctx context.Context, hosts []*network.Node, sharedDir string, downloadDir string) {
 	files := []testFile{
 		{name: "concurrent1.txt", content: []byte("Content of concurrent1")},
 		{name: "concurrent2.txt", content: []byte("Content of concurrent2")},
@@ -149,7 +151,7 @@ func testConcurrentTransfers(t *testing.T, ctx context.Context, hosts []host.Hos
 
 		// Start concurrent file transfers
 		go func(f testFile) {
-			err := network.SendFile(ctx, hosts[0], hosts[1].ID(), filepath.Join(sharedDir, f.name), f.content)
+			err := hosts[0].SendFile(ctx, hosts[1].ID(), f.name, f.content)
 			errChan <- err
 		}(file)
 	}
@@ -158,12 +160,9 @@ func testConcurrentTransfers(t *testing.T, ctx context.Context, hosts []host.Hos
 		require.NoError(t, <-errChan, "Error in concurrent transfer")
 	}
 
-	// Wait for all files to be processed
-	time.Sleep(2 * time.Second)
-
 	// Verify all files were received correctly
 	for _, file := range files {
-		receivedPath := filepath.Join(sharedDir, file.name)
+		receivedPath := filepath.Join(downloadDir, file.name)
 		receivedContent, err := os.ReadFile(receivedPath)
 		require.NoError(t, err, "Failed to read received file")
 		assert.Equal(t, file.content, receivedContent, "File content mismatch for concurrent transfer")